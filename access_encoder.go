@@ -0,0 +1,204 @@
+package log
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	buf "go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// 访问日志格式, 用于SetRequestType和SetOutboundType
+const (
+	AccessCommon   = "common"   // NCSA Common Log Format
+	AccessCombined = "combined" // Apache Combined Log Format
+	AccessW3C      = "w3c"      // W3C Extended Log Format
+)
+
+// 访问日志额外使用的请求字段, 由HTTPMiddleware写在RequestEntry.Extras中
+const (
+	RequestKeyReferer = "referer"
+	RequestKeyProto   = "proto"
+	RequestKeyUser    = "user"
+)
+
+const (
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+	accessEmpty   = "-"
+)
+
+// w3cFields W3C格式的列, 与#Fields指令一致
+var w3cFields = []string{
+	"date", "time", "c-ip", "cs-username", "cs-method", "cs-uri-stem", "cs-uri-query", "sc-status",
+	"sc-bytes", "cs-bytes", "time-taken", "cs-version", "cs(User-Agent)", "cs(Referer)", "x-request-id",
+}
+
+var accessPool = buf.NewPool()
+
+// w3cHeader W3C格式每个文件开头的指令
+func w3cHeader() []byte {
+	return []byte(fmt.Sprintf("#Version: 1.0\n#Date: %s\n#Fields: %s\n",
+		time.Now().UTC().Format("2006-01-02 15:04:05"), strings.Join(w3cFields, " ")))
+}
+
+// accessEncoder 把请求日志的结构化字段(见RequestEntry)映射为经典的访问日志格式.
+// 缺少的字段输出为"-", 其它字段不会输出. 没有请求方法和路径的日志(比如RequestLogInfo写的)不是请求,
+// 改为输出消息: common和combined格式把消息写在请求行的位置, W3C格式写为#Remark指令.
+type accessEncoder struct {
+	*zapcore.MapObjectEncoder
+	format string
+}
+
+func newAccessEncoder(format string) zapcore.Encoder {
+	return &accessEncoder{MapObjectEncoder: zapcore.NewMapObjectEncoder(), format: format}
+}
+
+func (enc *accessEncoder) Clone() zapcore.Encoder {
+	clone := &accessEncoder{MapObjectEncoder: zapcore.NewMapObjectEncoder(), format: enc.format}
+	for k, v := range enc.Fields {
+		clone.Fields[k] = v
+	}
+	return clone
+}
+
+func (enc *accessEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*buf.Buffer, error) {
+	m := enc.Clone().(*accessEncoder)
+	for _, f := range fields {
+		f.AddTo(m)
+	}
+	line := accessPool.Get()
+	_, hasMethod := m.Fields[RequestKeyMethod]
+	_, hasPath := m.Fields[RequestKeyPath]
+	switch {
+	case !hasMethod && !hasPath && enc.format == AccessW3C:
+		line.AppendString("#Remark: ")
+		line.AppendString(strings.NewReplacer("\r", " ", "\n", " ").Replace(ent.Message))
+	case !hasMethod && !hasPath:
+		m.clf(line, ent.Time, ent.Message)
+	case enc.format == AccessW3C:
+		m.w3c(line, ent.Time)
+	default:
+		m.clf(line, ent.Time, m.value(RequestKeyMethod)+" "+m.uri()+" "+m.value(RequestKeyProto))
+	}
+	line.AppendByte('\n')
+	return line, nil
+}
+
+// value 返回字段的文本, 字段不存在或为空时返回"-"
+func (enc *accessEncoder) value(key string) string {
+	v, ok := enc.Fields[key]
+	if !ok || v == nil {
+		return accessEmpty
+	}
+	s := fmt.Sprint(v)
+	if s == "" {
+		return accessEmpty
+	}
+	return s
+}
+
+// clf NCSA Common和Apache Combined格式:
+// host ident authuser [date] "request" status bytes "referer" "user-agent"
+func (enc *accessEncoder) clf(line *buf.Buffer, t time.Time, request string) {
+	line.AppendString(enc.value(RequestKeyClientIP))
+	line.AppendString(" - ")
+	line.AppendString(enc.value(RequestKeyUser))
+	line.AppendString(" [")
+	line.AppendString(t.Format(clfTimeFormat))
+	line.AppendString(`] "`)
+	line.AppendString(clfQuote(request))
+	line.AppendString(`" `)
+	line.AppendString(enc.value(RequestKeyStatus))
+	line.AppendByte(' ')
+	if bytes := enc.value(RequestKeyBytesOut); bytes == "0" {
+		line.AppendString(accessEmpty)
+	} else {
+		line.AppendString(bytes)
+	}
+	if enc.format == AccessCombined {
+		line.AppendString(` "`)
+		line.AppendString(clfQuote(enc.value(RequestKeyReferer)))
+		line.AppendString(`" "`)
+		line.AppendString(clfQuote(enc.value(RequestKeyUserAgent)))
+		line.AppendByte('"')
+	}
+}
+
+// path 请求路径, 与请求行中一样使用转义后的形式
+func (enc *accessEncoder) path() string {
+	p, ok := enc.Fields[RequestKeyPath].(string)
+	if !ok || p == "" {
+		return accessEmpty
+	}
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+func (enc *accessEncoder) uri() string {
+	path := enc.path()
+	if q, ok := enc.Fields[RequestKeyQuery].(string); ok && q != "" {
+		return path + "?" + q
+	}
+	return path
+}
+
+// clfQuote 转义双引号,反斜杠和控制字符, 与Apache的处理方式一致
+func clfQuote(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// w3c W3C Extended格式, 列见w3cFields. 时间为UTC, time-taken的单位为秒
+func (enc *accessEncoder) w3c(line *buf.Buffer, t time.Time) {
+	t = t.UTC()
+	values := []string{
+		t.Format("2006-01-02"),
+		t.Format("15:04:05"),
+		enc.value(RequestKeyClientIP),
+		enc.value(RequestKeyUser),
+		enc.value(RequestKeyMethod),
+		enc.path(),
+		enc.value(RequestKeyQuery),
+		enc.value(RequestKeyStatus),
+		enc.value(RequestKeyBytesOut),
+		enc.value(RequestKeyBytesIn),
+		accessEmpty,
+		enc.value(RequestKeyProto),
+		enc.value(RequestKeyUserAgent),
+		enc.value(RequestKeyReferer),
+		enc.value(RequestKeyRequestID),
+	}
+	if ms, ok := enc.Fields[RequestKeyLatency].(float64); ok {
+		values[10] = strconv.FormatFloat(ms/1000, 'f', 3, 64)
+	}
+	for i, v := range values {
+		if i > 0 {
+			line.AppendByte(' ')
+		}
+		line.AppendString(w3cEscape(v))
+	}
+}
+
+// w3cEscape W3C格式用空格分隔列, 值中的空白替换为+
+func w3cEscape(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+			return '+'
+		}
+		return r
+	}, s)
+}
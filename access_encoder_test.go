@@ -0,0 +1,58 @@
+package log
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func encodeAccess(t *testing.T, format, msg string, fields ...zapcore.Field) string {
+	t.Helper()
+	ent := zapcore.Entry{Message: msg, Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	line, err := newAccessEncoder(format).EncodeEntry(ent, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer line.Free()
+	return line.String()
+}
+
+func TestAccessEncoderRequest(t *testing.T) {
+	entry := RequestEntry{Method: "GET", Path: "/a b", Query: "x=1", Status: 200, ClientIP: "10.0.0.1", BytesOut: 12}
+	got := encodeAccess(t, AccessCommon, requestMessage, entry.Fields()...)
+	want := `10.0.0.1 - - [02/Jan/2020:03:04:05 +0000] "GET /a%20b?x=1 -" 200 12` + "\n"
+	if got != want {
+		t.Fatalf("common = %q, want %q", got, want)
+	}
+}
+
+func TestAccessEncoderMessage(t *testing.T) {
+	got := encodeAccess(t, AccessCombined, `user "bob" logged in`, zap.String("user_id", "42"))
+	want := `- - - [02/Jan/2020:03:04:05 +0000] "user \"bob\" logged in" - - "-" "-"` + "\n"
+	if got != want {
+		t.Fatalf("combined = %q, want %q", got, want)
+	}
+	if got := encodeAccess(t, AccessW3C, "line 1\nline 2"); got != "#Remark: line 1 line 2\n" {
+		t.Fatalf("w3c = %q", got)
+	}
+}
+
+func TestSetOutboundType(t *testing.T) {
+	dir := tempDir(t)
+	Init(filepath.Join(dir, "app.log"), InfoLevel, true, false, SetRequestType(AccessCombined))
+	defer func() { logger.close(); logger = nil }()
+	if lt := logger.adapters[FileTypeOutbound].LogType; lt != "csv" {
+		t.Fatalf("SetRequestType changed the outbound format to %s", lt)
+	}
+
+	Init(filepath.Join(dir, "app.log"), InfoLevel, true, false, SetOutboundType(AccessW3C))
+	if lt := logger.adapters[FileTypeOutbound].LogType; lt != AccessW3C {
+		t.Fatalf("outbound format = %s, want %s", lt, AccessW3C)
+	}
+	if lt := logger.adapters[FileTypeRequest].LogType; lt != "csv" {
+		t.Fatalf("SetOutboundType changed the request format to %s", lt)
+	}
+}
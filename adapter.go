@@ -1,27 +1,74 @@
 package log
 
 import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+// utf8BOM 让Excel能正确识别csv文件中的中文
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
 type zapAdapter struct {
 	Path        string // 文件绝对地址，如：/home/homework/neso/file.log
 	Level       string // 日志输出的级别
-	LogType     string // 日志格式类型.支持:json;csv
+	LogType     string // 日志格式类型.支持:json;csv;common;combined;w3c
 	MaxFileSize int    // 日志文件大小的最大值，单位(M)
 	MaxBackups  int    // 最多保留备份数
 	MaxAge      int    // 日志文件保存的时间，单位(天)
 	Compress    bool   // 是否压缩
 	Caller      bool   // 日志是否需要显示调用位置
 	CallerDeep  int    // 调用文件回显的深度
-
-	logger *zap.Logger
-	sugar  *zap.SugaredLogger
+	audit       bool   // 是否为审计日志, 审计日志总是json格式并且同步写入
+	CSVSafe     bool   // csv格式时是否防止公式注入
+	BOM         bool   // csv格式时是否在每个文件开头写入UTF-8 BOM
+	Charset     string // 输出文件的字符集, 如gbk, gb18030; 为空时使用UTF-8
+	Invalid     string // 无效字符的处理方式.支持:replace;skip;escape(默认)
+
+	Async          bool          // 是否异步写文件
+	AsyncQueueSize int           // 异步队列的长度
+	FlushInterval  time.Duration // 异步写文件的刷新间隔
+	Overflow       string        // 异步队列满时的处理方式.支持:block;drop;droplow
+	PriorityLevel  string        // 不低于该级别的日志为重要日志, 不会被丢弃
+	PriorityQueue  int           // 异步队列中为重要日志保留的容量
+
+	SampleTick       time.Duration // 采样周期, 为0时不按消息采样
+	SampleFirst      int           // 每个周期内相同消息保留的前几条
+	SampleThereafter int           // 超过SampleFirst之后每隔几条保留一条
+
+	DedupWindow time.Duration // 重复日志的合并窗口, 为0时不合并
+
+	MaxMessageBytes int // 消息的最大字节数, 为0时不限制
+	MaxFieldBytes   int // 每个字段值的最大字节数
+	MaxFields       int // 每条日志最多的字段个数
+	MaxEntryBytes   int // 每条日志的最大字节数
+
+	SpillDir      string        // 远程Sink的磁盘队列目录, 为空时不启用
+	SpillMaxBytes int64         // 每个Sink的磁盘队列大小上限，单位(字节)
+	SpillMaxAge   time.Duration // 磁盘队列文件的最长保留时间
+
+	redactor      *redactor
+	keySamplers   []*keySampler
+	statusSampler *statusSampler
+	sinks         []Sink
+	keys          KeyProvider        // 不为nil时加密日志文件
+	manifestKey   ed25519.PrivateKey // 不为nil时切割后生成签名的清单文件
+	traceColumns  []string           // csv格式时写在消息之后固定列中的trace字段
+	drops         dropCounter
+	writer        *rollingWriter // 日志文件, 关闭时结束加密的文件
+	async         *asyncQueue    // 异步写文件时的队列
+	sinkWriters   []*sinkWriter  // 每个Sink的发送协程
+	dedup         *dedupCore     // 合并重复日志时的core
+	logger        *zap.Logger
+	sugar         *zap.SugaredLogger
 }
 
 func (z *zapAdapter) setLogType(logType string) {
@@ -50,6 +97,87 @@ func (z *zapAdapter) setCaller(caller bool) {
 func (z *zapAdapter) setCallerDeep(callerDeep int) {
 	z.CallerDeep = callerDeep
 }
+
+func (z *zapAdapter) setCSVSafe(safe bool) {
+	z.CSVSafe = safe
+}
+
+func (z *zapAdapter) setBOM(bom bool) {
+	z.BOM = bom
+}
+
+func (z *zapAdapter) setCharset(charset, invalid string) {
+	z.Charset = charset
+	z.Invalid = invalid
+}
+
+func (z *zapAdapter) setAsync(queueSize int, flushInterval time.Duration, overflow string) {
+	z.Async = true
+	z.AsyncQueueSize = queueSize
+	z.FlushInterval = flushInterval
+	z.Overflow = overflow
+}
+
+func (z *zapAdapter) setPriority(level string, reserved int) {
+	z.PriorityLevel = level
+	z.PriorityQueue = reserved
+}
+
+func (z *zapAdapter) setSampling(tick time.Duration, first, thereafter int) {
+	z.SampleTick = tick
+	z.SampleFirst = first
+	z.SampleThereafter = thereafter
+}
+
+func (z *zapAdapter) addKeySampler(s *keySampler) {
+	z.keySamplers = append(z.keySamplers, s)
+}
+
+func (z *zapAdapter) setStatusSampler(s *statusSampler) {
+	z.statusSampler = s
+}
+
+func (z *zapAdapter) setDedup(window time.Duration) {
+	z.DedupWindow = window
+}
+
+func (z *zapAdapter) addSink(sink Sink) {
+	z.sinks = append(z.sinks, sink)
+}
+
+func (z *zapAdapter) setEncryption(keys KeyProvider) {
+	z.keys = keys
+}
+
+func (z *zapAdapter) setManifestKey(key ed25519.PrivateKey) {
+	z.manifestKey = key
+}
+
+func (z *zapAdapter) setMaxMessageBytes(n int) {
+	z.MaxMessageBytes = n
+}
+
+func (z *zapAdapter) setMaxFieldBytes(n int) {
+	z.MaxFieldBytes = n
+}
+
+func (z *zapAdapter) setMaxFields(n int) {
+	z.MaxFields = n
+}
+
+func (z *zapAdapter) setMaxEntryBytes(n int) {
+	z.MaxEntryBytes = n
+}
+
+func (z *zapAdapter) setTraceColumns(keys []string) {
+	z.traceColumns = keys
+}
+
+func (z *zapAdapter) setSpillQueue(dir string, maxBytes int64, maxAge time.Duration) {
+	z.SpillDir = dir
+	z.SpillMaxBytes = maxBytes
+	z.SpillMaxAge = maxAge
+}
 func EnsureCSVSuffix(filePath string) string {
 	ext := strings.ToLower(filepath.Ext(filePath))
 
@@ -71,6 +199,8 @@ func NewZapAdapter(path, level, contentType string) *zapAdapter {
 		Compress:    true,
 		Caller:      false,
 		CallerDeep:  2,
+
+		PriorityLevel: ErrorLevel,
 	}
 }
 
@@ -91,37 +221,84 @@ func (zapAdapter *zapAdapter) Init() {
 	if zapAdapter.LogType == "csv" {
 		zapAdapter.Path = EnsureCSVSuffix(zapAdapter.Path)
 	}
-	w := zapcore.AddSync(zapAdapter.createLumberjackHook())
+	rw := newRollingWriter(zapAdapter.createLumberjackHook())
+	if zapAdapter.keys != nil {
+		rw.setCipher(newFileCipher(zapAdapter.keys))
+	}
+	zapAdapter.writer = rw
+	if zapAdapter.manifestKey != nil {
+		mw := newManifestWriter(zapAdapter.Path, zapAdapter.manifestKey, zapAdapter.keys)
+		rw.onRotate(mw.rotated)
+		rw.onSync(mw.wait)
+	}
+	if zapAdapter.LogType == "csv" && zapAdapter.BOM && isUTF8Charset(zapAdapter.Charset) {
+		rw.addHeader(func() []byte { return utf8BOM })
+	}
+	if zapAdapter.LogType == AccessW3C && !zapAdapter.audit {
+		rw.addHeader(w3cHeader)
+	}
+	var w zapcore.WriteSyncer = rw
+	// 审计日志的哈希按UTF-8内容计算, 不做转码
+	if !isUTF8Charset(zapAdapter.Charset) && !zapAdapter.audit {
+		if cw, err := newCharsetWriter(rw, zapAdapter.Charset, zapAdapter.Invalid); err != nil {
+			fmt.Fprintf(os.Stderr, "log: %s: %v\n", zapAdapter.Path, err)
+		} else {
+			w = cw
+		}
+	}
 
-	var level zapcore.Level
 	var cnf zapcore.Encoder
-
-	switch zapAdapter.Level {
-	case "debug":
-		level = zap.DebugLevel
-	case "info":
-		level = zap.InfoLevel
-	case "warn":
-		level = zap.WarnLevel
-	case "error":
-		level = zap.ErrorLevel
-	case "panic":
-		level = zap.PanicLevel
-	default:
-		level = zap.InfoLevel
-	}
+	level := parseLevel(zapAdapter.Level)
 
 	conf := zap.NewProductionEncoderConfig()
 	conf.EncodeTime = zapcore.ISO8601TimeEncoder
 	// 除非指定了csv, 否则默认使用json内容格式
 	switch zapAdapter.LogType {
 	case "csv":
-		cnf = NewCSVEncoder(conf)
+		cnf = zapAdapter.newCSVEncoder(conf)
+	case AccessCommon, AccessCombined, AccessW3C:
+		cnf = newAccessEncoder(zapAdapter.LogType)
 	default:
-		cnf = zapcore.NewJSONEncoder(conf)
+		cnf = newJSONEncoder(conf)
 	}
 
-	core := zapcore.NewCore(cnf, w, level)
+	var fileCore zapcore.Core
+	if zapAdapter.audit {
+		chain := newAuditChain(zapAdapter.Path, zapAdapter.keys)
+		rw.addHeader(chain.header)
+		fileCore = &auditCore{LevelEnabler: level, enc: newJSONEncoder(conf), out: rw, chain: chain}
+	} else if zapAdapter.Async {
+		zapAdapter.async = newAsyncQueue(w, zapAdapter.AsyncQueueSize, zapAdapter.FlushInterval, zapAdapter.Overflow,
+			parseLevel(zapAdapter.PriorityLevel), zapAdapter.PriorityQueue, &zapAdapter.drops)
+		fileCore = newAsyncCore(cnf, zapAdapter.async, level)
+	} else {
+		fileCore = zapcore.NewCore(cnf, w, level)
+	}
+	cores := []zapcore.Core{fileCore}
+	// 远程Sink统一使用json格式
+	for _, sink := range zapAdapter.sinks {
+		sw := zapAdapter.newSinkWriter(sink)
+		zapAdapter.sinkWriters = append(zapAdapter.sinkWriters, sw)
+		cores = append(cores, &sinkCore{LevelEnabler: level, enc: newJSONEncoder(conf), w: sw})
+	}
+	core := zapAdapter.wrapSampling(zapcore.NewTee(cores...))
+	if zapAdapter.DedupWindow > 0 {
+		zapAdapter.dedup = newDedupCore(core, zapAdapter.DedupWindow)
+		core = zapAdapter.dedup
+	}
+	// 在脱敏之后截断, 以免敏感内容被截断后不再匹配脱敏规则
+	limits := sizeLimits{
+		message: zapAdapter.MaxMessageBytes,
+		field:   zapAdapter.MaxFieldBytes,
+		fields:  zapAdapter.MaxFields,
+		entry:   zapAdapter.MaxEntryBytes,
+	}
+	if limits.enabled() {
+		core = &limitCore{Core: core, limits: limits}
+	}
+	if zapAdapter.redactor != nil {
+		core = &redactCore{Core: core, r: zapAdapter.redactor}
+	}
 	zapAdapter.logger = zap.New(core)
 	if zapAdapter.Caller {
 		zapAdapter.logger = zapAdapter.logger.WithOptions(zap.AddCaller(), zap.AddCallerSkip(zapAdapter.CallerDeep))
@@ -129,60 +306,104 @@ func (zapAdapter *zapAdapter) Init() {
 	zapAdapter.sugar = zapAdapter.logger.Sugar()
 }
 
+// close 写完缓存的日志后停止后台协程, 用于重新Init时释放旧的adapter
+func (zapAdapter *zapAdapter) close() {
+	zapAdapter.logger.Sync()
+	if zapAdapter.dedup != nil {
+		zapAdapter.dedup.close()
+	}
+	if zapAdapter.async != nil {
+		zapAdapter.async.close()
+	}
+	for _, sw := range zapAdapter.sinkWriters {
+		sw.close()
+	}
+	if zapAdapter.writer != nil {
+		zapAdapter.writer.close()
+	}
+}
+
+// newCSVEncoder 按adapter的配置创建csv编码器
+func (zapAdapter *zapAdapter) newCSVEncoder(conf zapcore.EncoderConfig) zapcore.Encoder {
+	enc := NewCSVEncoder(conf).(*csvEncoder)
+	enc.safe = zapAdapter.CSVSafe
+	enc.invalid = zapAdapter.Invalid
+	enc.traceKeys = zapAdapter.traceColumns
+	return enc
+}
+
+// wrapSampling 配置了采样时在core外面包一层samplingCore
+func (zapAdapter *zapAdapter) wrapSampling(core zapcore.Core) zapcore.Core {
+	if zapAdapter.SampleTick <= 0 && len(zapAdapter.keySamplers) == 0 && zapAdapter.statusSampler == nil {
+		return core
+	}
+	sc := &samplingCore{
+		Core:     core,
+		keys:     zapAdapter.keySamplers,
+		status:   zapAdapter.statusSampler,
+		critical: parseLevel(zapAdapter.PriorityLevel),
+		drops:    &zapAdapter.drops,
+	}
+	if zapAdapter.SampleTick > 0 {
+		sc.sampler = zapcore.NewSampler(core, zapAdapter.SampleTick, zapAdapter.SampleFirst, zapAdapter.SampleThereafter)
+	}
+	return sc
+}
+
 func (zapAdapter *zapAdapter) Debug(args ...interface{}) {
-	zapAdapter.sugar.Debug(args...)
+	zapAdapter.sugar.Debug(tagArgs(args)...)
 }
 
 func (zapAdapter *zapAdapter) Info(args ...interface{}) {
-	zapAdapter.sugar.Info(args...)
+	zapAdapter.sugar.Info(tagArgs(args)...)
 }
 
 func (zapAdapter *zapAdapter) Warn(args ...interface{}) {
-	zapAdapter.sugar.Warn(args...)
+	zapAdapter.sugar.Warn(tagArgs(args)...)
 }
 
 func (zapAdapter *zapAdapter) Error(args ...interface{}) {
-	zapAdapter.sugar.Error(args...)
+	zapAdapter.sugar.Error(tagArgs(args)...)
 }
 
 func (zapAdapter *zapAdapter) DPanic(args ...interface{}) {
-	zapAdapter.sugar.DPanic(args...)
+	zapAdapter.sugar.DPanic(tagArgs(args)...)
 }
 
 func (zapAdapter *zapAdapter) Panic(args ...interface{}) {
-	zapAdapter.sugar.Panic(args...)
+	zapAdapter.sugar.Panic(tagArgs(args)...)
 }
 
 func (zapAdapter *zapAdapter) Fatal(args ...interface{}) {
-	zapAdapter.sugar.Fatal(args...)
+	zapAdapter.sugar.Fatal(tagArgs(args)...)
 }
 
 func (zapAdapter *zapAdapter) Debugf(template string, args ...interface{}) {
-	zapAdapter.sugar.Debugf(template, args...)
+	zapAdapter.sugar.Debugf(template, tagArgs(args)...)
 }
 
 func (zapAdapter *zapAdapter) Infof(template string, args ...interface{}) {
-	zapAdapter.sugar.Infof(template, args...)
+	zapAdapter.sugar.Infof(template, tagArgs(args)...)
 }
 
 func (zapAdapter *zapAdapter) Warnf(template string, args ...interface{}) {
-	zapAdapter.sugar.Warnf(template, args...)
+	zapAdapter.sugar.Warnf(template, tagArgs(args)...)
 }
 
 func (zapAdapter *zapAdapter) Errorf(template string, args ...interface{}) {
-	zapAdapter.sugar.Errorf(template, args...)
+	zapAdapter.sugar.Errorf(template, tagArgs(args)...)
 }
 
 func (zapAdapter *zapAdapter) DPanicf(template string, args ...interface{}) {
-	zapAdapter.sugar.DPanicf(template, args...)
+	zapAdapter.sugar.DPanicf(template, tagArgs(args)...)
 }
 
 func (zapAdapter *zapAdapter) Panicf(template string, args ...interface{}) {
-	zapAdapter.sugar.Panicf(template, args...)
+	zapAdapter.sugar.Panicf(template, tagArgs(args)...)
 }
 
 func (zapAdapter *zapAdapter) Fatalf(template string, args ...interface{}) {
-	zapAdapter.sugar.Fatalf(template, args...)
+	zapAdapter.sugar.Fatalf(template, tagArgs(args)...)
 }
 
 func (zapAdapter *zapAdapter) Debugw(msg string, keysAndValues ...interface{}) {
@@ -212,3 +433,75 @@ func (zapAdapter *zapAdapter) Panicw(msg string, keysAndValues ...interface{}) {
 func (zapAdapter *zapAdapter) Fatalw(msg string, keysAndValues ...interface{}) {
 	zapAdapter.sugar.Fatalw(msg, keysAndValues...)
 }
+
+// Log 用强类型的字段写日志, 字段的顺序与传入的顺序一致
+func (zapAdapter *zapAdapter) Log(level zapcore.Level, msg string, fields ...zapcore.Field) {
+	if ce := zapAdapter.logger.Check(level, msg); ce != nil {
+		ce.Write(fields...)
+	}
+}
+
+// logEntry 与Log相同, 但日志时间和调用位置由调用方指定, 用于桥接其它日志库. caller未定义时不修改调用位置.
+// panic和fatal级别的日志直接写入core, 不会panic或退出程序
+func (zapAdapter *zapAdapter) logEntry(level zapcore.Level, t time.Time, caller zapcore.EntryCaller, msg string, fields ...zapcore.Field) {
+	if level > zapcore.ErrorLevel {
+		if t.IsZero() {
+			t = time.Now()
+		}
+		ent := zapcore.Entry{Level: level, Time: t, Message: msg}
+		if zapAdapter.Caller {
+			ent.Caller = caller
+		}
+		if ce := zapAdapter.logger.Core().Check(ent, nil); ce != nil {
+			ce.Write(fields...)
+		}
+		return
+	}
+	ce := zapAdapter.logger.Check(level, msg)
+	if ce == nil {
+		return
+	}
+	if !t.IsZero() {
+		ce.Time = t
+	}
+	if caller.Defined && ce.Caller.Defined {
+		ce.Caller = caller
+	}
+	ce.Write(fields...)
+}
+
+// kvFields 将key,value交替的参数转换为zap的字段, 键不是字符串时用fmt.Sprint转换, 缺少值的键记为<no-value>
+func kvFields(keysAndValues []interface{}) []zapcore.Field {
+	fields := make([]zapcore.Field, 0, (len(keysAndValues)+1)/2)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key, ok := keysAndValues[i].(string)
+		if !ok {
+			key = fmt.Sprint(keysAndValues[i])
+		}
+		if i+1 >= len(keysAndValues) {
+			fields = append(fields, zap.String(key, "<no-value>"))
+			break
+		}
+		value := keysAndValues[i+1]
+		if err, ok := value.(error); ok {
+			fields = append(fields, zap.String(key, err.Error()))
+			continue
+		}
+		fields = append(fields, zap.Any(key, value))
+	}
+	return fields
+}
+
+// pcCaller 将runtime.Callers得到的pc转换为调用位置
+func pcCaller(pc uintptr) zapcore.EntryCaller {
+	if pc == 0 {
+		return zapcore.EntryCaller{}
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	return zapcore.NewEntryCaller(frame.PC, frame.File, frame.Line, true)
+}
+
+// enabled 判断level级别的日志是否会被写入
+func (zapAdapter *zapAdapter) enabled(level zapcore.Level) bool {
+	return zapAdapter.logger.Core().Enabled(level)
+}
@@ -0,0 +1,235 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	buf "go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// 队列满时的处理方式
+const (
+	OverflowBlock   = "block"   // 阻塞直到队列有空位
+	OverflowDrop    = "drop"    // 丢弃新的日志
+	OverflowDropLow = "droplow" // 只丢弃debug和info级别的日志, 其余的阻塞
+)
+
+const (
+	defaultAsyncQueueSize = 4096
+	defaultFlushInterval  = time.Second
+	asyncBatchBytes       = 256 * 1024
+)
+
+type asyncItem struct {
+	level    zapcore.Level
+	buf      *buf.Buffer
+	critical bool
+}
+
+// asyncQueue 有界队列加后台写协程, 日志在调用方协程中编码, 由后台协程按进入队列的顺序批量写入文件.
+// 普通日志进入队列前需要先从slots中取得一个名额, slots的容量比队列少reserved个, 这部分容量只有
+// 达到critical级别的重要日志能使用, 并且重要日志永远不会被丢弃.
+type asyncQueue struct {
+	out      zapcore.WriteSyncer
+	interval time.Duration
+	overflow string
+	critical zapcore.Level
+	drops    *dropCounter
+
+	ch    chan asyncItem
+	slots chan struct{}
+	flush chan chan struct{}
+	done  chan struct{}
+	quit  chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newAsyncQueue(out zapcore.WriteSyncer, size int, interval time.Duration, overflow string,
+	critical zapcore.Level, reserved int, drops *dropCounter) *asyncQueue {
+	if size <= 1 {
+		size = defaultAsyncQueueSize
+	}
+	if interval <= 0 {
+		interval = defaultFlushInterval
+	}
+	reserved = priorityReserved(size, reserved)
+	q := &asyncQueue{
+		out:      out,
+		interval: interval,
+		overflow: overflow,
+		critical: critical,
+		drops:    drops,
+		ch:       make(chan asyncItem, size),
+		slots:    make(chan struct{}, size-reserved),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+		quit:     make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// push 将编码好的日志放入队列, 队列满时按overflow处理
+func (q *asyncQueue) push(level zapcore.Level, b *buf.Buffer) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	item := asyncItem{level: level, buf: b, critical: level >= q.critical}
+	if q.closed {
+		q.writeDirect(item)
+		return
+	}
+	if !item.critical {
+		switch {
+		case q.overflow == OverflowDrop,
+			q.overflow == OverflowDropLow && level <= zapcore.InfoLevel:
+			select {
+			case q.slots <- struct{}{}:
+			default:
+				q.drops.inc(level)
+				b.Free()
+				return
+			}
+		default:
+			q.slots <- struct{}{}
+		}
+	}
+	q.ch <- item
+}
+
+// writeDirect 队列关闭之后, 仍在使用旧logger写的日志直接写入文件
+func (q *asyncQueue) writeDirect(item asyncItem) {
+	if _, err := q.out.Write(item.buf.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "log: async write failed: %v\n", err)
+	}
+	item.buf.Free()
+}
+
+// sync 等待队列中的日志全部写入文件后再刷盘
+func (q *asyncQueue) sync() error {
+	done := make(chan struct{})
+	select {
+	case q.flush <- done:
+		<-done
+	case <-q.done:
+	}
+	return q.out.Sync()
+}
+
+// close 写完队列中的日志后停止后台协程. 等待正在入队的日志完成后才关闭, 之后的日志直接写入文件
+func (q *asyncQueue) close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	q.mu.Unlock()
+	close(q.quit)
+	<-q.done
+}
+
+func (q *asyncQueue) run() {
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+	defer close(q.done)
+
+	var batch bytes.Buffer
+	for {
+		select {
+		case item := <-q.ch:
+			q.add(&batch, item)
+		case <-ticker.C:
+			q.write(&batch)
+		case done := <-q.flush:
+			q.drain(&batch)
+			close(done)
+		case <-q.quit:
+			q.drain(&batch)
+			return
+		}
+	}
+}
+
+// drain 写入队列中现有的全部日志
+func (q *asyncQueue) drain(batch *bytes.Buffer) {
+	for {
+		select {
+		case item := <-q.ch:
+			q.add(batch, item)
+		default:
+			q.write(batch)
+			return
+		}
+	}
+}
+
+func (q *asyncQueue) add(batch *bytes.Buffer, item asyncItem) {
+	if !item.critical {
+		<-q.slots
+	}
+	batch.Write(item.buf.Bytes())
+	item.buf.Free()
+	if batch.Len() >= asyncBatchBytes {
+		q.write(batch)
+	}
+}
+
+func (q *asyncQueue) write(batch *bytes.Buffer) {
+	if batch.Len() == 0 {
+		return
+	}
+	if _, err := q.out.Write(batch.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "log: async write failed: %v\n", err)
+	}
+	batch.Reset()
+}
+
+// asyncCore 与zapcore.NewCore创建的core行为一致, 只是写文件的动作交给asyncQueue完成
+type asyncCore struct {
+	zapcore.LevelEnabler
+	enc zapcore.Encoder
+	q   *asyncQueue
+}
+
+func newAsyncCore(enc zapcore.Encoder, q *asyncQueue, enab zapcore.LevelEnabler) zapcore.Core {
+	return &asyncCore{LevelEnabler: enab, enc: enc, q: q}
+}
+
+func (c *asyncCore) With(fields []zapcore.Field) zapcore.Core {
+	enc := c.enc.Clone()
+	for i := range fields {
+		fields[i].AddTo(enc)
+	}
+	return &asyncCore{LevelEnabler: c.LevelEnabler, enc: enc, q: c.q}
+}
+
+func (c *asyncCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *asyncCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	b, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	c.q.push(ent.Level, b)
+	if ent.Level > zapcore.ErrorLevel {
+		// panic和fatal之后进程可能退出, 需要立即落盘
+		return c.Sync()
+	}
+	return nil
+}
+
+func (c *asyncCore) Sync() error {
+	return c.q.sync()
+}
@@ -0,0 +1,132 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	buf "go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+var testBufferPool = buf.NewPool()
+
+func testBuffer(s string) *buf.Buffer {
+	b := testBufferPool.Get()
+	b.AppendString(s)
+	return b
+}
+
+// bufferSyncer 记录写入的内容, first在第一次Write时关闭, 之后的Write等待release
+type bufferSyncer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	first   chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (w *bufferSyncer) Write(p []byte) (int, error) {
+	if w.first != nil {
+		w.once.Do(func() { close(w.first) })
+		<-w.release
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *bufferSyncer) Sync() error {
+	return nil
+}
+
+func (w *bufferSyncer) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func TestAsyncQueueOrder(t *testing.T) {
+	out := &bufferSyncer{}
+	var drops dropCounter
+	q := newAsyncQueue(out, 16, time.Hour, OverflowBlock, zapcore.ErrorLevel, 4, &drops)
+	defer q.close()
+
+	var want strings.Builder
+	for i := 0; i < 200; i++ {
+		level := zapcore.InfoLevel
+		if i%3 == 0 {
+			level = zapcore.ErrorLevel
+		}
+		line := fmt.Sprintf("%d\n", i)
+		want.WriteString(line)
+		q.push(level, testBuffer(line))
+	}
+	q.sync()
+	if out.String() != want.String() {
+		t.Fatalf("entries are written out of order:\n%s", out.String())
+	}
+}
+
+func TestAsyncQueueReserved(t *testing.T) {
+	out := &bufferSyncer{first: make(chan struct{}), release: make(chan struct{})}
+	var drops dropCounter
+	q := newAsyncQueue(out, 8, time.Millisecond, OverflowDrop, zapcore.ErrorLevel, 2, &drops)
+
+	// 第一条日志写入时后台协程被阻塞, 之后的日志都留在队列中
+	q.push(zapcore.InfoLevel, testBuffer("first\n"))
+	<-out.first
+	for i := 0; i < 7; i++ {
+		q.push(zapcore.InfoLevel, testBuffer("info\n"))
+	}
+	if n := drops.snapshot()["info"]; n != 1 {
+		t.Fatalf("dropped %d info entries, want 1", n)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.push(zapcore.ErrorLevel, testBuffer("error\n"))
+		q.push(zapcore.ErrorLevel, testBuffer("error\n"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("error entries cannot use the reserved capacity")
+	}
+	close(out.release)
+	q.close()
+	if n := strings.Count(out.String(), "error"); n != 2 {
+		t.Fatalf("wrote %d error entries, want 2", n)
+	}
+}
+
+func TestInitClosesPreviousLogger(t *testing.T) {
+	dir := tempDir(t)
+	Init(filepath.Join(dir, "a.log"), InfoLevel, true, false, SetAsync(64, time.Second, OverflowBlock))
+	old := logger
+	Info("before")
+	Init(filepath.Join(dir, "b.log"), InfoLevel, true, false)
+	defer func() { logger = nil }()
+
+	select {
+	case <-old.adapters[FileTypeLog].async.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("background writer of the previous logger is still running")
+	}
+	// 关闭之后仍在使用旧logger的调用直接写入文件
+	old.adapters[FileTypeLog].Info("after")
+	old.adapters[FileTypeLog].logger.Sync()
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("before")) || !bytes.Contains(data, []byte("after")) {
+		t.Fatalf("previous log file is missing entries:\n%s", data)
+	}
+}
@@ -0,0 +1,312 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// 审计日志中每条日志携带的字段
+const (
+	auditSeqKey  = "seq"  // 序号, 从1开始连续递增
+	auditPrevKey = "prev" // 上一条日志(整行, 不含换行符)的sha256
+)
+
+// auditLink 每个审计日志文件的第一行, 记录上一个文件最后一条日志的序号和sha256, 将切割后的文件串成一条链
+type auditLink struct {
+	Seq  uint64 `json:"link_seq"`
+	Prev string `json:"link_prev"`
+}
+
+// auditChain 审计日志的哈希链状态. 第一次写审计日志时才从已有的文件中恢复, 不写审计日志的进程不需要读取这些文件
+type auditChain struct {
+	mu     sync.Mutex
+	path   string
+	keys   KeyProvider
+	loaded bool
+	seq    uint64
+	last   string
+}
+
+func newAuditChain(path string, keys KeyProvider) *auditChain {
+	return &auditChain{path: path, keys: keys}
+}
+
+// load 从已有的审计日志中恢复哈希链, 保证进程重启后链条不断. 通常只需要读取最新文件的末尾, 调用时需要持有锁
+func (c *auditChain) load() {
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+	files, err := rotationSet(c.path)
+	if err != nil {
+		return
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		line, err := lastLine(files[i], c.keys)
+		if err != nil || len(line) == 0 {
+			continue
+		}
+		var link auditLink
+		if json.Unmarshal(line, &link) == nil && isAuditLink(line) {
+			c.seq, c.last = link.Seq, link.Prev
+			return
+		}
+		var ent map[string]interface{}
+		if json.Unmarshal(line, &ent) == nil {
+			if seq, ok := ent[auditSeqKey].(float64); ok {
+				c.seq = uint64(seq)
+				c.last = auditHash(line)
+				return
+			}
+		}
+	}
+}
+
+// header 新文件的第一行. 由rollingWriter在auditCore.Write持有锁期间调用, 所以不需要再加锁
+func (c *auditChain) header() []byte {
+	b, _ := json.Marshal(auditLink{Seq: c.seq, Prev: c.last})
+	return append(b, '\n')
+}
+
+func auditHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+func isAuditLink(line []byte) bool {
+	return bytes.HasPrefix(line, []byte(`{"link_seq":`))
+}
+
+// lastLine 读取文件的最后一个非空行. 未压缩的明文文件从后向前按块读取, 加密文件只解密最后一个数据块;
+// 被压缩的备份文件只能从头读取
+func lastLine(path string, keys KeyProvider) ([]byte, error) {
+	if strings.HasSuffix(path, compressSuffix) {
+		return scanLastLine(path, keys)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var tail []byte
+	if keys != nil {
+		tail, err = lastChunk(f, keys)
+	} else {
+		tail, err = readTail(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tail = bytes.TrimRight(tail, "\n")
+	return append([]byte(nil), tail[bytes.LastIndexByte(tail, '\n')+1:]...), nil
+}
+
+// readTail 从文件末尾向前按块读取, 直到包含完整的最后一个非空行
+func readTail(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var tail []byte
+	for off := info.Size(); off > 0; {
+		n := int64(64 * 1024)
+		if n > off {
+			n = off
+		}
+		off -= n
+		block := make([]byte, n, n+int64(len(tail)))
+		if _, err := f.ReadAt(block, off); err != nil {
+			return nil, err
+		}
+		tail = append(block, tail...)
+		if bytes.IndexByte(bytes.TrimRight(tail, "\n"), '\n') >= 0 {
+			break
+		}
+		if len(tail) > 64*megabyte {
+			return nil, fmt.Errorf("%s: last line is too long", f.Name())
+		}
+	}
+	return tail, nil
+}
+
+// scanLastLine 从头读取文件, 返回最后一个非空行
+func scanLastLine(path string, keys KeyProvider) ([]byte, error) {
+	r, err := openLog(path, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var last []byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*megabyte)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	return last, scanner.Err()
+}
+
+// auditCore 同步写审计日志: 每条日志加上序号和上一条日志的sha256后再编码, 编码和写入都在锁内完成,
+// 保证文件中的顺序与哈希链一致. 审计日志不使用异步写入.
+type auditCore struct {
+	zapcore.LevelEnabler
+	enc   zapcore.Encoder
+	out   zapcore.WriteSyncer
+	chain *auditChain
+}
+
+func (c *auditCore) With(fields []zapcore.Field) zapcore.Core {
+	enc := c.enc.Clone()
+	for i := range fields {
+		fields[i].AddTo(enc)
+	}
+	return &auditCore{LevelEnabler: c.LevelEnabler, enc: enc, out: c.out, chain: c.chain}
+}
+
+func (c *auditCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *auditCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	c.chain.mu.Lock()
+	defer c.chain.mu.Unlock()
+	c.chain.load()
+
+	seq := c.chain.seq + 1
+	all := make([]zapcore.Field, 0, len(fields)+2)
+	all = append(all, fields...)
+	all = append(all, zap.Uint64(auditSeqKey, seq), zap.String(auditPrevKey, c.chain.last))
+	b, err := c.enc.EncodeEntry(ent, all)
+	if err != nil {
+		return err
+	}
+	defer b.Free()
+	if _, err := c.out.Write(b.Bytes()); err != nil {
+		return err
+	}
+	c.chain.seq = seq
+	c.chain.last = auditHash(bytes.TrimRight(b.Bytes(), "\n"))
+	return nil
+}
+
+func (c *auditCore) Sync() error {
+	return c.out.Sync()
+}
+
+// AuditError 审计日志校验失败的位置和原因
+type AuditError struct {
+	File   string
+	Line   int
+	Reason string
+}
+
+func (e *AuditError) Error() string {
+	return fmt.Sprintf("audit log %s:%d: %s", e.File, e.Line, e.Reason)
+}
+
+// VerifyAudit 校验path对应的审计日志及其所有备份文件, 能发现被删除,调换顺序或者修改过的行.
+// 因为保留个数和时间的限制被删除的最早的备份文件不影响校验, 以现存最早文件的第一行作为起点.
+// 校验通过返回nil, 否则返回*AuditError.
+func VerifyAudit(path string) error {
+	return verifyAudit(path, nil)
+}
+
+// VerifyEncryptedAudit 与VerifyAudit相同, 用于开启了SetEncryption的审计日志
+func VerifyEncryptedAudit(path string, keys KeyProvider) error {
+	return verifyAudit(path, keys)
+}
+
+func verifyAudit(path string, keys KeyProvider) error {
+	files, err := rotationSet(path)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("audit log %s not found", path)
+	}
+
+	var seq uint64
+	var last string
+	anchored := false
+	for _, file := range files {
+		r, err := openLog(file, keys)
+		if err != nil {
+			return err
+		}
+		err = verifyAuditFile(file, r, &seq, &last, &anchored)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyAuditFile(file string, r io.Reader, seq *uint64, last *string, anchored *bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*megabyte)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		if isAuditLink(line) {
+			var link auditLink
+			if err := json.Unmarshal(line, &link); err != nil {
+				return &AuditError{File: file, Line: lineNo, Reason: "malformed file link"}
+			}
+			if lineNo != 1 {
+				return &AuditError{File: file, Line: lineNo, Reason: "file link in the middle of a file"}
+			}
+			if *anchored && (link.Seq != *seq || link.Prev != *last) {
+				return &AuditError{File: file, Line: lineNo, Reason: fmt.Sprintf(
+					"file link to seq %d does not match the end of the previous file (seq %d)", link.Seq, *seq)}
+			}
+			*seq, *last, *anchored = link.Seq, link.Prev, true
+			continue
+		}
+
+		var ent struct {
+			Seq  *uint64 `json:"seq"`
+			Prev *string `json:"prev"`
+		}
+		if err := json.Unmarshal(line, &ent); err != nil || ent.Seq == nil || ent.Prev == nil {
+			return &AuditError{File: file, Line: lineNo, Reason: "malformed entry"}
+		}
+		if !*anchored {
+			// 没有文件头时以第一条日志作为起点
+			*seq, *last, *anchored = *ent.Seq-1, *ent.Prev, true
+		}
+		if *ent.Seq != *seq+1 {
+			return &AuditError{File: file, Line: lineNo, Reason: fmt.Sprintf(
+				"expected seq %d, got %d: entries were deleted or reordered", *seq+1, *ent.Seq)}
+		}
+		if *ent.Prev != *last {
+			return &AuditError{File: file, Line: lineNo, Reason: "hash of the previous entry does not match: entries were modified"}
+		}
+		*seq = *ent.Seq
+		*last = auditHash(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return &AuditError{File: file, Line: lineNo, Reason: err.Error()}
+	}
+	return nil
+}
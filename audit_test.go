@@ -0,0 +1,145 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeAudit 写n条审计日志, 返回审计日志的路径. pad不为0时每条日志带pad字节的填充, 用来触发切割
+func writeAudit(t *testing.T, n, pad int) string {
+	t.Helper()
+	path := filepath.Join(tempDir(t), "app.log")
+	Init(path, InfoLevel, true, false, SetCompress(false), SetMaxFileSize(1))
+	padding := strings.Repeat("x", pad)
+	for i := 0; i < n; i++ {
+		AuditLogInfow("transfer", "i", i, "pad", padding)
+	}
+	logger.close()
+	logger = nil
+	return path + ".Audit"
+}
+
+func auditError(t *testing.T, err error) *AuditError {
+	t.Helper()
+	ae, ok := err.(*AuditError)
+	if !ok {
+		t.Fatalf("expected *AuditError, got %v", err)
+	}
+	return ae
+}
+
+func TestAuditVerify(t *testing.T) {
+	path := writeAudit(t, 10, 0)
+	if err := VerifyAudit(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditTamperedLine(t *testing.T) {
+	path := writeAudit(t, 10, 0)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte(`"i":4`), []byte(`"i":5`), 1)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ae := auditError(t, VerifyAudit(path))
+	if !strings.Contains(ae.Reason, "modified") || ae.Line != 7 {
+		t.Fatalf("unexpected error %v", ae)
+	}
+}
+
+func TestAuditDeletedLine(t *testing.T) {
+	path := writeAudit(t, 10, 0)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	data = bytes.Join(append(lines[:5:5], lines[6:]...), nil)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ae := auditError(t, VerifyAudit(path))
+	if !strings.Contains(ae.Reason, "deleted or reordered") {
+		t.Fatalf("unexpected error %v", ae)
+	}
+}
+
+func TestAuditRotation(t *testing.T) {
+	path := writeAudit(t, 1500, 1024)
+	files, err := rotationSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("audit log is not rotated: %v", files)
+	}
+	if err := VerifyAudit(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// 删除第一个文件的最后一条日志, 下一个文件开头的链接不再匹配
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.TrimRight(data, "\n")
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	if err := ioutil.WriteFile(files[0], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ae := auditError(t, VerifyAudit(path))
+	if ae.File != files[1] || ae.Line != 1 {
+		t.Fatalf("unexpected error %v", ae)
+	}
+}
+
+func TestAuditRestart(t *testing.T) {
+	for _, keys := range []KeyProvider{nil, testKeys} {
+		path := filepath.Join(tempDir(t), "app.log")
+		opts := []LogOption{SetCompress(false)}
+		if keys != nil {
+			opts = append(opts, SetEncryption(keys))
+		}
+		// 最后一行比读取末尾时的块大, 需要向前读取多块
+		padding := strings.Repeat("x", 150*1024)
+		for run := 0; run < 3; run++ {
+			Init(path, InfoLevel, true, false, opts...)
+			for i := 0; i < 2; i++ {
+				AuditLogInfow("transfer", "run", run, "i", i, "pad", padding)
+			}
+			logger.close()
+			logger = nil
+		}
+		if err := verifyAudit(path+".Audit", keys); err != nil {
+			t.Fatalf("encrypted=%v: chain is broken after restarts: %v", keys != nil, err)
+		}
+	}
+}
+
+func TestAuditLastLine(t *testing.T) {
+	path := filepath.Join(tempDir(t), "app.log")
+	if err := ioutil.WriteFile(path, []byte("first\nsecond\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := lastLine(path, nil); err != nil || string(line) != "second" {
+		t.Fatalf("lastLine = %q, %v", line, err)
+	}
+
+	header, chunks := encryptChunks(t, []string{"a\n", "b\nc\n"}, true)
+	data := append(header, bytes.Join(chunks, nil)...)
+	// 没有写完的数据块被忽略
+	data = append(data, 0, 0, 1, 0, 'x')
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := lastLine(path, testKeys); err != nil || string(line) != "c" {
+		t.Fatalf("encrypted lastLine = %q, %v", line, err)
+	}
+}
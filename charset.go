@@ -0,0 +1,90 @@
+package log
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// 无效字符的处理方式: 包括编码器遇到的非法UTF-8字节, 以及目标字符集中不存在的字符.
+// 未指定时为InvalidEscape, 与json编码器对非法UTF-8的处理一致, 不会丢失信息
+const (
+	InvalidReplace = "replace" // 非法UTF-8替换为U+FFFD, 目标字符集中不存在的字符替换为?
+	InvalidSkip    = "skip"    // 直接丢弃
+	InvalidEscape  = "escape"  // 输出为\uXXXX形式的转义, 非法UTF-8输出为\ufffd
+)
+
+// charsetWriter 将编码器输出的UTF-8内容转码为其它字符集后再写入
+type charsetWriter struct {
+	zapcore.WriteSyncer
+	enc     encoding.Encoding
+	invalid string
+}
+
+// newCharsetWriter charset为golang.org/x/text/encoding/htmlindex支持的名字, 比如gbk, gb18030, big5
+func newCharsetWriter(ws zapcore.WriteSyncer, charset, invalid string) (*charsetWriter, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q: %v", charset, err)
+	}
+	return &charsetWriter{WriteSyncer: ws, enc: enc, invalid: invalid}, nil
+}
+
+func (w *charsetWriter) Write(p []byte) (int, error) {
+	if _, err := w.WriteSyncer.Write(w.encode(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// encode 转码p, 遇到目标字符集中不存在的字符时按invalid处理后继续
+func (w *charsetWriter) encode(p []byte) []byte {
+	t := w.enc.NewEncoder()
+	out := make([]byte, 0, len(p)+len(p)/4)
+	var buf [4096]byte
+	for len(p) > 0 {
+		nDst, nSrc, err := t.Transform(buf[:], p, true)
+		out = append(out, buf[:nDst]...)
+		p = p[nSrc:]
+		if err == nil || err == transform.ErrShortDst {
+			continue
+		}
+		r, size := utf8.DecodeRune(p)
+		if size == 0 {
+			break
+		}
+		out = append(out, invalidRune(r, w.invalid)...)
+		p = p[size:]
+		t.Reset()
+	}
+	return out
+}
+
+// invalidRune 目标字符集中不存在的字符按策略输出, 结果只包含ASCII字符, 任何字符集都能表示
+func invalidRune(r rune, invalid string) string {
+	switch invalid {
+	case InvalidReplace:
+		return "?"
+	case InvalidSkip:
+		return ""
+	default:
+		if r > 0xFFFF {
+			return fmt.Sprintf(`\U%08x`, r)
+		}
+		return fmt.Sprintf(`\u%04x`, r)
+	}
+}
+
+// isUTF8Charset 判断charset是否就是UTF-8, 这种情况不需要转码
+func isUTF8Charset(charset string) bool {
+	switch strings.ToLower(charset) {
+	case "", "utf8", "utf-8":
+		return true
+	}
+	return false
+}
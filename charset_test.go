@@ -0,0 +1,81 @@
+package log
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func TestCharsetWriter(t *testing.T) {
+	// 😀不在GBK字符集中
+	tests := []struct {
+		invalid string
+		want    string
+	}{
+		{"", `中文\U0001f600!`},
+		{InvalidEscape, `中文\U0001f600!`},
+		{InvalidReplace, `中文?!`},
+		{InvalidSkip, `中文!`},
+	}
+	for _, tt := range tests {
+		var out bufferSyncer
+		w, err := newCharsetWriter(&out, "gbk", tt.invalid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("中文😀!")); err != nil {
+			t.Fatal(err)
+		}
+		got, err := simplifiedchinese.GBK.NewDecoder().String(out.buf.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("invalid=%q: got %s, want %s", tt.invalid, got, tt.want)
+		}
+	}
+	if _, err := newCharsetWriter(&bufferSyncer{}, "no-such-charset", ""); err == nil {
+		t.Fatal("unsupported charset is accepted")
+	}
+}
+
+func TestCSVInvalidUTF8(t *testing.T) {
+	tests := []struct {
+		invalid string
+		want    string
+	}{
+		{"", `"a\ufffdb"`},
+		{InvalidEscape, `"a\ufffdb"`},
+		{InvalidReplace, "\"a\ufffdb\""},
+		{InvalidSkip, `"ab"`},
+	}
+	for _, tt := range tests {
+		enc := NewCSVEncoder(zapcore.EncoderConfig{}).(*csvEncoder)
+		enc.invalid = tt.invalid
+		if got := encodeCSV(t, enc, "a\xffb"); got != tt.want {
+			t.Errorf("invalid=%q: got %s, want %s", tt.invalid, got, tt.want)
+		}
+	}
+}
+
+func TestSetCharset(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "app.log")
+	Init(path, InfoLevel, false, false, SetLogType("csv"), SetCharset(FileTypeLog, "gbk", ""))
+	defer func() { logger.close(); logger = nil }()
+
+	Infow("中文", zap.String("k", "😀"))
+	Sync()
+	line := readLines(t, path+".csv", "")[0]
+	got, err := simplifiedchinese.GBK.NewDecoder().String(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, `"中文","k:\U0001f600"`) {
+		t.Fatalf("gbk log = %s", got)
+	}
+}
@@ -0,0 +1,98 @@
+// logtool 日志文件的命令行工具
+//
+// 使用方法:
+//
+//	logtool verify-audit [-key-file keys.txt] /path/to/file.log.Audit
+//
+// 审计日志开启了SetEncryption时用-key-file指定密钥文件, 每行为"密钥ID 十六进制密钥", #开头的行为注释.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/terryliu/log/v2"
+)
+
+const usage = "usage: logtool verify-audit [-key-file <path>] <path>"
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run 执行args对应的命令, 返回进程的退出码: 0成功, 1校验失败, 2参数错误
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) < 1 {
+		fmt.Fprintln(stderr, usage)
+		return 2
+	}
+	switch args[0] {
+	case "verify-audit":
+		fs := flag.NewFlagSet("verify-audit", flag.ContinueOnError)
+		fs.SetOutput(stderr)
+		keyFile := fs.String("key-file", "", "file with the keys of an encrypted audit log")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+			fmt.Fprintln(stderr, usage)
+			return 2
+		}
+		var err error
+		if *keyFile == "" {
+			err = log.VerifyAudit(fs.Arg(0))
+		} else {
+			var keys log.KeyProvider
+			if keys, err = readKeys(*keyFile); err != nil {
+				fmt.Fprintln(stderr, err)
+				return 2
+			}
+			err = log.VerifyEncryptedAudit(fs.Arg(0), keys)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		fmt.Fprintln(stdout, "ok")
+		return 0
+	default:
+		fmt.Fprintln(stderr, usage)
+		return 2
+	}
+}
+
+// readKeys 读取密钥文件, 每行为"密钥ID 十六进制密钥"
+func readKeys(path string) (log.KeyProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := log.StaticKeys{Keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"<key id> <hex key>\"", path, lineNo)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key: %v", path, lineNo, err)
+		}
+		keys.Keys[fields[0]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys.Keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return keys, nil
+}
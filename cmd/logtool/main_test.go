@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/terryliu/log/v2"
+)
+
+func writeAudit(t *testing.T, n int, opts ...log.LogOption) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "logtool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "app.log")
+	log.Init(path, log.InfoLevel, true, false, append([]log.LogOption{log.SetCompress(false)}, opts...)...)
+	for i := 0; i < n; i++ {
+		log.AuditLogInfow("login", "user", "alice", "i", i)
+	}
+	log.Close()
+	return path + ".Audit"
+}
+
+func TestVerifyAudit(t *testing.T) {
+	path := writeAudit(t, 5)
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"verify-audit", path}, &stdout, &stderr); code != 0 || stdout.String() != "ok\n" {
+		t.Fatalf("exit code %d, stdout %q, stderr %q", code, stdout.String(), stderr.String())
+	}
+}
+
+func TestVerifyAuditTampered(t *testing.T) {
+	path := writeAudit(t, 5)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte("alice"), []byte("mallory"), 1)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"verify-audit", path}, &stdout, &stderr); code != 1 || !strings.Contains(stderr.String(), "modified") {
+		t.Fatalf("exit code %d, stderr %q", code, stderr.String())
+	}
+}
+
+func TestUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"verify-audit"}, &stdout, &stderr); code != 2 || !strings.Contains(stderr.String(), "usage") {
+		t.Fatalf("exit code %d, stderr %q", code, stderr.String())
+	}
+}
+
+func TestVerifyEncryptedAudit(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	path := writeAudit(t, 5, log.SetEncryption(log.StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": key}}))
+	keyFile := filepath.Join(filepath.Dir(path), "keys.txt")
+	if err := ioutil.WriteFile(keyFile, []byte("# audit keys\nk1 "+hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"verify-audit", "-key-file", keyFile, path}, &stdout, &stderr); code != 0 || stdout.String() != "ok\n" {
+		t.Fatalf("exit code %d, stdout %q, stderr %q", code, stdout.String(), stderr.String())
+	}
+	// 没有密钥时无法解析加密的文件
+	stderr.Reset()
+	if code := run([]string{"verify-audit", path}, &stdout, &stderr); code != 1 {
+		t.Fatalf("exit code %d without keys, stderr %q", code, stderr.String())
+	}
+	if err := ioutil.WriteFile(keyFile, []byte("k1 not-hex\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stderr.Reset()
+	if code := run([]string{"verify-audit", "-key-file", keyFile, path}, &stdout, &stderr); code != 2 || !strings.Contains(stderr.String(), "invalid key") {
+		t.Fatalf("exit code %d, stderr %q", code, stderr.String())
+	}
+}
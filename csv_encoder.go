@@ -4,7 +4,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"reflect"
+	"strings"
 	"sync"
 	"time"
 	"unicode/utf8"
@@ -34,6 +34,9 @@ func putCsvEncoder(enc *csvEncoder) {
 	enc.EncoderConfig = nil
 	enc.buf = nil
 	enc.spaced = false
+	enc.safe = false
+	enc.invalid = ""
+	enc.traceKeys = nil
 	enc.openNamespaces = 0
 	enc.reflectBuf = nil
 	enc.reflectEnc = nil
@@ -44,7 +47,10 @@ func putCsvEncoder(enc *csvEncoder) {
 type csvEncoder struct {
 	*zapcore.EncoderConfig
 	buf            *buf.Buffer
-	spaced         bool // include spaces after colons and commas
+	spaced         bool     // include spaces after colons and commas
+	safe           bool     // neutralize cells that spreadsheets would evaluate as formulas
+	invalid        string   // how invalid UTF-8 is written: InvalidReplace, InvalidSkip or InvalidEscape (default)
+	traceKeys      []string // fields written as dedicated columns right after the message, see SetTraceColumns
 	openNamespaces int
 
 	// for encoding generic values by reflection
@@ -61,6 +67,15 @@ func NewCSVEncoder(cfg zapcore.EncoderConfig) zapcore.Encoder {
 	}
 }
 
+// NewSafeCSVEncoder creates a csvEncoder that protects against CSV (formula) injection:
+// string cells starting with =, +, -, @, tab or carriage return are prefixed with a
+// single quote so spreadsheet programs display them as text, as recommended by OWASP.
+func NewSafeCSVEncoder(cfg zapcore.EncoderConfig) zapcore.Encoder {
+	enc := NewCSVEncoder(cfg).(*csvEncoder)
+	enc.safe = true
+	return enc
+}
+
 func (enc *csvEncoder) Clone() zapcore.Encoder {
 	clone := enc.clone()
 	clone.buf.Write(enc.buf.Bytes())
@@ -70,6 +85,9 @@ func (enc *csvEncoder) clone() *csvEncoder {
 	clone := getCsvEncoder()
 	clone.EncoderConfig = enc.EncoderConfig
 	clone.spaced = enc.spaced
+	clone.safe = enc.safe
+	clone.invalid = enc.invalid
+	clone.traceKeys = enc.traceKeys
 	clone.openNamespaces = enc.openNamespaces
 	clone.buf = _pool.Get()
 	return clone
@@ -101,6 +119,9 @@ func (enc *csvEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*
 	final.addElementSeparator()
 	final.AddString("MSG", ent.Message)
 
+	if len(final.traceKeys) > 0 {
+		fields = final.addTraceColumns(fields)
+	}
 	for _, field := range fields {
 		final.AddField(field)
 	}
@@ -109,6 +130,33 @@ func (enc *csvEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*
 	putCsvEncoder(final)
 	return ret, nil
 }
+
+// addTraceColumns writes one column per trace key, empty when the entry has no such
+// field, so the columns stay at fixed positions. It returns the remaining fields.
+func (enc *csvEncoder) addTraceColumns(fields []zapcore.Field) []zapcore.Field {
+	values := make([]string, len(enc.traceKeys))
+	rest := make([]zapcore.Field, 0, len(fields))
+	for _, f := range fields {
+		matched := false
+		if f.Type == zapcore.StringType {
+			for i, key := range enc.traceKeys {
+				if f.Key == key {
+					values[i] = f.String
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			rest = append(rest, f)
+		}
+	}
+	for _, v := range values {
+		enc.AppendString(v)
+	}
+	return rest
+}
+
 func (enc *csvEncoder) AppendBool(b bool) {
 	enc.addElementSeparator()
 	enc.buf.AppendBool(b)
@@ -117,6 +165,7 @@ func (enc *csvEncoder) AppendBool(b bool) {
 func (enc *csvEncoder) AppendByteString(bytes []byte) {
 	enc.addElementSeparator()
 	enc.buf.AppendByte('"')
+	enc.guardFormulaBytes(bytes)
 	enc.safeAddByteString(bytes)
 	enc.buf.AppendByte('"')
 }
@@ -170,6 +219,7 @@ func (enc *csvEncoder) AppendInt8(i int8) {
 func (enc *csvEncoder) AppendString(s string) {
 	enc.addElementSeparator()
 	enc.buf.AppendByte('"')
+	enc.guardFormula(s)
 	enc.safeAddString(s)
 	enc.buf.AppendByte('"')
 }
@@ -226,6 +276,7 @@ func (enc *csvEncoder) AppendObject(marshaler zapcore.ObjectMarshaler) error {
 	enc.addElementSeparator()
 	enc.buf.AppendByte('"')
 	objBytes := fmt.Sprintf("%+v", marshaler)
+	enc.guardFormula(objBytes)
 	enc.buf.Write([]byte(objBytes))
 	enc.buf.AppendByte('"')
 	return nil
@@ -233,20 +284,30 @@ func (enc *csvEncoder) AppendObject(marshaler zapcore.ObjectMarshaler) error {
 
 func (enc *csvEncoder) AppendReflected(value interface{}) error {
 	// Since CSV does not support reflection like JSON, we can only
-	// convert the value to a string. This may need to be customized based on
-	// the actual requirements.
+	// convert the value to a string. Structs honor the `log` struct tags.
 	enc.addElementSeparator()
-	v := reflect.ValueOf(value)
-	str, ok := v.Interface().(string)
-	if !ok {
-		str = fmt.Sprintf("%v", value)
-	}
 	enc.buf.AppendByte('"')
-	enc.buf.AppendString(str)
+	str := reflectedString(value)
+	enc.guardFormula(str)
+	enc.safeAddString(str)
 	enc.buf.AppendByte('"')
 	return nil
 }
 
+// reflectedString converts a reflected value to the string written in a CSV cell.
+func reflectedString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.RawMessage:
+		return string(v)
+	}
+	if tagged := newTagged(value); tagged != nil {
+		return fmt.Sprint(tagged)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
 func (enc *csvEncoder) AppendArray(arr zapcore.ArrayMarshaler) error {
 	enc.addElementSeparator()
 	enc.buf.AppendByte('"')
@@ -278,6 +339,7 @@ func (enc *csvEncoder) AddBinary(key string, val []byte) {
 func (enc *csvEncoder) AddByteString(key string, val []byte) {
 	enc.addElementSeparator()
 	enc.buf.AppendByte('"')
+	enc.guardFormulaBytes(val)
 	enc.safeAddByteString(val)
 	enc.buf.AppendByte('"')
 }
@@ -401,10 +463,9 @@ func (enc *csvEncoder) AddInt64(key string, val int64) {
 	enc.buf.AppendInt(val)
 }
 
-// AddReflected adds a reflected field to the log entry. csvEncoder does not support reflection.
+// AddReflected adds a reflected field to the log entry as a string, see AppendReflected.
 func (enc *csvEncoder) AddReflected(key string, obj interface{}) error {
-	// csvEncoder does not support reflection, so we simply ignore this call.
-	return nil
+	return enc.AppendReflected(obj)
 }
 
 // AddString adds a string field to the log entry.
@@ -412,6 +473,7 @@ func (enc *csvEncoder) AddString(key string, val string) {
 	// enc.addKey(key)
 	// enc.addElementSeparator()
 	enc.buf.AppendByte('"')
+	enc.guardFormula(val)
 	enc.safeAddString(val)
 	enc.buf.AppendByte('"')
 }
@@ -434,18 +496,51 @@ func (enc *csvEncoder) truncate() {
 	enc.buf.Reset()
 }
 
-// AddField adds a field to the log entry.
+// AddField adds a field to the log entry as a "key:value" cell.
 func (enc *csvEncoder) AddField(field zapcore.Field) {
+	if field.Type == zapcore.SkipType || field.Type == zapcore.NamespaceType {
+		return
+	}
 	enc.addElementSeparator()
 	enc.buf.AppendByte('"')
+	value := fieldCellString(field)
 	if field.Key != "" {
+		enc.guardFormula(field.Key)
 		enc.safeAddString(field.Key)
 		enc.buf.AppendByte(':')
+	} else {
+		enc.guardFormula(value)
 	}
-	enc.safeAddString(field.String)
+	enc.safeAddString(value)
 	enc.buf.AppendByte('"')
 }
 
+// fieldCellString converts the value of a field to the string written in a CSV cell.
+func fieldCellString(field zapcore.Field) string {
+	switch field.Type {
+	case zapcore.ReflectType:
+		return reflectedString(field.Interface)
+	case zapcore.ObjectMarshalerType, zapcore.ArrayMarshalerType:
+		return fmt.Sprintf("%+v", field.Interface)
+	case zapcore.BinaryType:
+		return base64.StdEncoding.EncodeToString(field.Interface.([]byte))
+	case zapcore.ByteStringType:
+		return string(field.Interface.([]byte))
+	case zapcore.TimeType:
+		if loc, ok := field.Interface.(*time.Location); ok {
+			return time.Unix(0, field.Integer).In(loc).Format(time.RFC3339Nano)
+		}
+		return time.Unix(0, field.Integer).Format(time.RFC3339Nano)
+	case zapcore.Complex128Type:
+		c := field.Interface.(complex128)
+		return fmt.Sprintf("%v+%vi", real(c), imag(c))
+	case zapcore.Complex64Type:
+		c := field.Interface.(complex64)
+		return fmt.Sprintf("%v+%vi", real(c), imag(c))
+	}
+	return fieldString(field)
+}
+
 // Close implements the Encoder interface.
 func (enc *csvEncoder) Close() error {
 	return nil
@@ -471,6 +566,23 @@ func (enc *csvEncoder) addElementSeparator() {
 	}
 }
 
+// formulaPrefixes are the leading characters that make spreadsheets evaluate a cell.
+const formulaPrefixes = "=+-@\t\r"
+
+// guardFormula prefixes the cell with a single quote if s would be evaluated as a formula.
+func (enc *csvEncoder) guardFormula(s string) {
+	if enc.safe && len(s) > 0 && strings.IndexByte(formulaPrefixes, s[0]) >= 0 {
+		enc.buf.AppendByte('\'')
+	}
+}
+
+// guardFormulaBytes is the []byte equivalent of guardFormula.
+func (enc *csvEncoder) guardFormulaBytes(s []byte) {
+	if enc.safe && len(s) > 0 && strings.IndexByte(formulaPrefixes, s[0]) >= 0 {
+		enc.buf.AppendByte('\'')
+	}
+}
+
 // safeAddString JSON-escapes a string and appends it to the internal buffer.
 func (enc *csvEncoder) safeAddString(s string) {
 	for i := 0; i < len(s); {
@@ -535,7 +647,13 @@ func (enc *csvEncoder) tryAddRuneSelf(b byte) bool {
 
 func (enc *csvEncoder) tryAddRuneError(r rune, size int) bool {
 	if r == utf8.RuneError && size == 1 {
-		enc.buf.AppendString(`\ufffd`)
+		switch enc.invalid {
+		case InvalidReplace:
+			enc.buf.AppendString(string(utf8.RuneError))
+		case InvalidSkip:
+		default:
+			enc.buf.AppendString(`\ufffd`)
+		}
 		return true
 	}
 	return false
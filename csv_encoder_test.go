@@ -0,0 +1,136 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type csvPoint struct {
+	X, Y int
+}
+
+func (p csvPoint) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddInt("x", p.X)
+	enc.AddInt("y", p.Y)
+	return nil
+}
+
+// encodeCSV 编码一条不带级别和时间的csv日志, 返回去掉换行符的结果
+func encodeCSV(t *testing.T, enc zapcore.Encoder, msg string, fields ...zapcore.Field) string {
+	t.Helper()
+	line, err := enc.EncodeEntry(zapcore.Entry{Message: msg}, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer line.Free()
+	return strings.TrimSuffix(line.String(), "\n")
+}
+
+func TestCSVAddField(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		field zapcore.Field
+		want  string
+	}{
+		{zap.String("s", "v"), `"s:v"`},
+		{zap.Int("n", -5), `"n:-5"`},
+		{zap.Uint64("u", 7), `"u:7"`},
+		{zap.Bool("b", true), `"b:true"`},
+		{zap.Float64("f", 1.5), `"f:1.5"`},
+		{zap.Duration("d", time.Second), `"d:1s"`},
+		{zap.Time("t", ts), `"t:2020-01-02T03:04:05Z"`},
+		{zap.Binary("bin", []byte("hi")), `"bin:aGk="`},
+		{zap.ByteString("bs", []byte("hi")), `"bs:hi"`},
+		{zap.Complex128("c", 1+2i), `"c:1+2i"`},
+		{zap.Error(errors.New("boom")), `"error:boom"`},
+		{zap.Object("p", csvPoint{1, 2}), `"p:{X:1 Y:2}"`},
+		{zap.Any("m", map[string]int{"a": 1}), `"m:map[a:1]"`},
+		{zap.Any("secret", tagSecret{User: "u", Token: "s3cret"}), `"secret:{User:u Token:******}"`},
+		{zap.Skip(), ``},
+	}
+	for _, tt := range tests {
+		got := strings.TrimPrefix(encodeCSV(t, NewCSVEncoder(zapcore.EncoderConfig{}), "m", tt.field), `"m"`)
+		got = strings.TrimPrefix(got, ",")
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.field.Key, got, tt.want)
+		}
+	}
+}
+
+func TestCSVSafe(t *testing.T) {
+	for _, prefix := range []string{"=", "+", "-", "@", "\t", "\r"} {
+		enc := NewSafeCSVEncoder(zapcore.EncoderConfig{})
+		got := encodeCSV(t, enc, prefix+"msg", zap.String("", prefix+"cell"), zap.String(prefix+"key", "v"))
+		for _, cell := range []string{"msg", "cell", "key"} {
+			if strings.Contains(got, `"`+escapeCSVTest(prefix)+cell) || !strings.Contains(got, `'`+escapeCSVTest(prefix)+cell) {
+				t.Errorf("%q: %s is not neutralized in %s", prefix, cell, got)
+			}
+		}
+
+		got = encodeCSV(t, NewCSVEncoder(zapcore.EncoderConfig{}), prefix+"msg")
+		if got != `"`+escapeCSVTest(prefix)+`msg"` {
+			t.Errorf("%q: unsafe encoder changed the message: %s", prefix, got)
+		}
+	}
+	if got := encodeCSV(t, NewSafeCSVEncoder(zapcore.EncoderConfig{}), "a=b", zap.Int("n", -1)); got != `"a=b","n:-1"` {
+		t.Errorf("cells that do not start with a formula character are changed: %s", got)
+	}
+}
+
+// escapeCSVTest 返回csv编码器输出的形式, 制表符和回车被替换为空格
+func escapeCSVTest(s string) string {
+	if s == "\t" || s == "\r" {
+		return " "
+	}
+	return s
+}
+
+func TestCSVBOM(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "app.log")
+	Init(path, InfoLevel, false, false, SetLogType("csv"), SetBOM(true), SetCompress(false))
+	defer func() { logger.close(); logger = nil }()
+	w := logger.adapters[FileTypeLog].writer
+	w.mu.Lock()
+	w.max = 300
+	w.mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 4; j++ {
+			Infow("bom test", "i", i, "j", j)
+		}
+		Sync()
+		// 备份文件名精确到毫秒, 避免两次切割使用同一个文件名
+		time.Sleep(5 * time.Millisecond)
+	}
+	// 重启后追加到已有的文件, 不再写入BOM
+	logger.close()
+	Init(path, InfoLevel, false, false, SetLogType("csv"), SetBOM(true), SetCompress(false))
+	Infow("after restart")
+	Sync()
+
+	files, err := filepath.Glob(filepath.Join(dir, "app.log*.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 3 {
+		t.Fatalf("got %d files, want the log to be rotated", len(files))
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, utf8BOM) || bytes.Count(data, utf8BOM) != 1 {
+			t.Errorf("%s has %d BOMs, want exactly one at the start", filepath.Base(file), bytes.Count(data, utf8BOM))
+		}
+	}
+}
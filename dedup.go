@@ -0,0 +1,152 @@
+package log
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// dedupEntry 一条正在被抑制的日志
+type dedupEntry struct {
+	ent         zapcore.Entry
+	core        zapcore.Core
+	count       int
+	first, last time.Time // 被抑制的重复日志的起止时间
+	expires     time.Time // 窗口结束的时间
+}
+
+// dedupState 记录窗口期内出现过的日志, 同一个logger通过With派生的core共享同一个状态.
+// 由一个后台协程定期清理窗口已经结束的日志, 清理的间隔为窗口的1/4
+type dedupState struct {
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[string]*dedupEntry
+	quit   chan struct{}
+	once   sync.Once
+}
+
+const dedupMinSweep = 10 * time.Millisecond
+
+// dedupCore 在窗口期内合并级别,消息,调用位置和字段(包括With添加的字段)都相同的日志: 第一条正常输出, 之后的只计数;
+// 窗口结束时输出一条"message repeated N times between T1 and T2"的汇总日志. 字段不同的日志不会被合并.
+type dedupCore struct {
+	zapcore.Core
+	state  *dedupState
+	fields string // With添加的字段
+}
+
+func newDedupCore(core zapcore.Core, window time.Duration) *dedupCore {
+	c := &dedupCore{
+		Core:  core,
+		state: &dedupState{window: window, seen: make(map[string]*dedupEntry), quit: make(chan struct{})},
+	}
+	go c.state.sweep()
+	return c
+}
+
+func (c *dedupCore) With(fields []zapcore.Field) zapcore.Core {
+	return &dedupCore{Core: c.Core.With(fields), state: c.state, fields: c.fields + fieldsKey(fields)}
+}
+
+// fieldsKey 将字段编码为去重key的一部分
+func fieldsKey(fields []zapcore.Field) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	return fmt.Sprint(enc.Fields)
+}
+
+func (c *dedupCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// Write 调用位置在Check之后才会填充到Entry中, 所以去重只能在Write中进行
+func (c *dedupCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	key := ent.Level.String() + "\x00" + ent.Message + "\x00" + ent.Caller.String() + "\x00" + c.fields + "\x00" + fieldsKey(fields)
+
+	c.state.mu.Lock()
+	if e, ok := c.state.seen[key]; ok {
+		if e.count == 0 {
+			e.first = ent.Time
+		}
+		e.count++
+		e.last = ent.Time
+		c.state.mu.Unlock()
+		return nil
+	}
+	c.state.seen[key] = &dedupEntry{ent: ent, core: c.Core, expires: time.Now().Add(c.state.window)}
+	c.state.mu.Unlock()
+
+	return writeCore(c.Core, ent, fields)
+}
+
+// Sync 先输出所有未结束窗口的汇总日志
+func (c *dedupCore) Sync() error {
+	c.state.flush(time.Time{})
+	return c.Core.Sync()
+}
+
+// close 停止后台的清理协程
+func (c *dedupCore) close() {
+	c.state.once.Do(func() { close(c.state.quit) })
+}
+
+func (s *dedupState) sweep() {
+	interval := s.window / 4
+	if interval < dedupMinSweep {
+		interval = dedupMinSweep
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.flush(now)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// flush 结束在now之前到期的窗口, now为零值时结束所有窗口, 有被抑制的日志时输出汇总
+func (s *dedupState) flush(now time.Time) {
+	var expired []*dedupEntry
+	s.mu.Lock()
+	for key, e := range s.seen {
+		if now.IsZero() || !now.Before(e.expires) {
+			expired = append(expired, e)
+			delete(s.seen, key)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, e := range expired {
+		if e.count == 0 {
+			continue
+		}
+		ent := e.ent
+		ent.Time = time.Now()
+		ent.Message = fmt.Sprintf("message repeated %d times between %s and %s",
+			e.count, e.first.Format(time.RFC3339Nano), e.last.Format(time.RFC3339Nano))
+		writeCore(e.core, ent, []zapcore.Field{zap.String("repeated_msg", e.ent.Message)})
+	}
+}
+
+// writeCore 经过内部core的Check再写入, 以免跳过内部core在Check阶段的过滤(比如采样)
+func writeCore(core zapcore.Core, ent zapcore.Entry, fields []zapcore.Field) error {
+	if ce := core.Check(ent, nil); ce != nil {
+		ce.Write(fields...)
+	}
+	return nil
+}
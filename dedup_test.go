@@ -0,0 +1,88 @@
+package log
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func writeDedup(c *dedupCore, msg string) {
+	ent := zapcore.Entry{Level: zapcore.InfoLevel, Time: time.Now(), Message: msg}
+	c.Write(ent, nil)
+}
+
+func messages(logs *observer.ObservedLogs) []string {
+	var msgs []string
+	for _, e := range logs.All() {
+		msgs = append(msgs, e.Message)
+	}
+	return msgs
+}
+
+func TestDedupSyncStartsNewWindow(t *testing.T) {
+	inner, logs := observer.New(zapcore.DebugLevel)
+	c := newDedupCore(inner, time.Hour)
+	defer c.close()
+
+	writeDedup(c, "a")
+	writeDedup(c, "a")
+	c.Sync()
+	writeDedup(c, "a")
+	writeDedup(c, "a")
+	writeDedup(c, "a")
+
+	msgs := messages(logs)
+	if len(msgs) != 3 || msgs[0] != "a" || !strings.HasPrefix(msgs[1], "message repeated 1 times") || msgs[2] != "a" {
+		t.Fatalf("unexpected entries %q", msgs)
+	}
+	c.Sync()
+	if msgs := messages(logs); !strings.HasPrefix(msgs[len(msgs)-1], "message repeated 2 times") {
+		t.Fatalf("unexpected entries %q", msgs)
+	}
+}
+
+func TestDedupSweep(t *testing.T) {
+	inner, logs := observer.New(zapcore.DebugLevel)
+	c := newDedupCore(inner, 50*time.Millisecond)
+	defer c.close()
+
+	writeDedup(c, "a")
+	writeDedup(c, "a")
+	deadline := time.Now().Add(5 * time.Second)
+	for logs.Len() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("window is not flushed after it ends")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	writeDedup(c, "a")
+	if msgs := messages(logs); len(msgs) != 3 || msgs[2] != "a" {
+		t.Fatalf("entry after the window is suppressed: %q", msgs)
+	}
+}
+
+func TestDedupFields(t *testing.T) {
+	inner, logs := observer.New(zapcore.DebugLevel)
+	c := newDedupCore(inner, time.Hour)
+	defer c.close()
+
+	ent := zapcore.Entry{Level: zapcore.InfoLevel, Time: time.Now(), Message: "request failed"}
+	c.Write(ent, []zapcore.Field{zap.String("user", "a")})
+	c.Write(ent, []zapcore.Field{zap.String("user", "b")})
+	c.Write(ent, []zapcore.Field{zap.String("user", "a")})
+	c.With([]zapcore.Field{zap.Int("shard", 1)}).Write(ent, []zapcore.Field{zap.String("user", "a")})
+	c.With([]zapcore.Field{zap.Int("shard", 2)}).Write(ent, []zapcore.Field{zap.String("user", "a")})
+
+	if n := logs.Len(); n != 4 {
+		t.Fatalf("wrote %d entries, want 4: entries with different fields are merged", n)
+	}
+	c.Sync()
+	msgs := messages(logs)
+	if len(msgs) != 5 || !strings.HasPrefix(msgs[4], "message repeated 1 times") {
+		t.Fatalf("unexpected entries %q", msgs)
+	}
+}
@@ -0,0 +1,343 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// 加密日志文件的格式:
+//
+//	文件头: encMagic | 密钥ID长度(1字节) | 密钥ID | salt(16字节)
+//	数据块: 长度(4字节, 大端, 不含自身) | 密文
+//
+// 每个文件用HKDF-SHA256从密钥和salt派生出自己的密钥, 数据块的nonce为块序号, 所以同一个密钥下
+// 不会因为随机nonce的数量受到GCM的2^32次限制. 每次写入加密为一个数据块, AES-GCM的附加数据为块序号和
+// 结束标记: 切割或关闭时写入一个标记为结束的空数据块, 调换,删除数据块, 把数据块挪到其它文件, 或者在块边界
+// 截断文件都无法通过解密校验.
+const (
+	encMagic     = "LOGENC1\n"
+	encSaltSize  = 16
+	encNonceSize = 12
+	encTagSize   = 16
+	encMaxChunk  = 64 * megabyte
+
+	// encOverhead 每个数据块比明文多出的字节数
+	encOverhead = 4 + encTagSize
+)
+
+// ErrTruncated 加密日志文件在结束块之前就结束了: 文件被截断, 或者是正在写入以及进程崩溃时留下的文件
+var ErrTruncated = errors.New("log: encrypted log ends without the final chunk")
+
+// KeyProvider 提供加密日志文件的密钥. 每个新文件使用CurrentKey返回的密钥, 并把密钥ID记录在文件头中,
+// 解密时用Key按ID取回密钥, 所以轮换密钥时旧的密钥需要保留到对应的文件被删除为止.
+type KeyProvider interface {
+	// CurrentKey 返回加密新文件使用的密钥ID和密钥, 密钥长度为16,24或32字节(AES-128,192,256)
+	CurrentKey() (id string, key []byte, err error)
+	// Key 按密钥ID返回密钥
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys 固定的密钥集合, Current为加密新文件使用的密钥ID
+type StaticKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("log: unknown key id %q", id)
+	}
+	return key, nil
+}
+
+// newAEAD 用HKDF从密钥和文件的salt派生出文件密钥
+func newAEAD(key, salt []byte) (cipher.AEAD, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, aes.KeySizeError(len(key))
+	}
+	block, err := aes.NewCipher(hkdf(key, salt, []byte("log file key"), len(key)))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// hkdf RFC 5869中的HKDF-SHA256, 返回n字节(不超过32)的密钥
+func hkdf(secret, salt, info []byte, n int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:n]
+}
+
+// chunkNonce 数据块的nonce: 块序号
+func chunkNonce(seq uint64) []byte {
+	nonce := make([]byte, encNonceSize)
+	binary.BigEndian.PutUint64(nonce[encNonceSize-8:], seq)
+	return nonce
+}
+
+// chunkAAD 数据块的附加数据: 块序号加结束标记
+func chunkAAD(seq uint64, last bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, seq)
+	if last {
+		aad[8] = 1
+	}
+	return aad
+}
+
+// fileCipher 加密当前文件的状态, 由rollingWriter在持有锁时使用
+type fileCipher struct {
+	keys KeyProvider
+	aead cipher.AEAD
+	seq  uint64
+}
+
+func newFileCipher(keys KeyProvider) *fileCipher {
+	return &fileCipher{keys: keys}
+}
+
+// begin 开始一个新文件: 取当前密钥, 生成新的salt, 返回文件头
+func (c *fileCipher) begin() ([]byte, error) {
+	id, key, err := c.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > 255 {
+		return nil, fmt.Errorf("log: key id %q is too long", id)
+	}
+	salt := make([]byte, encSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	c.aead, c.seq = aead, 0
+
+	header := make([]byte, 0, len(encMagic)+1+len(id)+encSaltSize)
+	header = append(header, encMagic...)
+	header = append(header, byte(len(id)))
+	header = append(header, id...)
+	return append(header, salt...), nil
+}
+
+// seal 把p加密为一个数据块
+func (c *fileCipher) seal(p []byte) ([]byte, error) {
+	return c.sealChunk(p, false)
+}
+
+// finish 返回文件的结束块, 之后需要用begin开始新的文件
+func (c *fileCipher) finish() ([]byte, error) {
+	out, err := c.sealChunk(nil, true)
+	c.aead = nil
+	return out, err
+}
+
+func (c *fileCipher) sealChunk(p []byte, last bool) ([]byte, error) {
+	if c.aead == nil {
+		return nil, errors.New("log: encrypted file has no header")
+	}
+	out := make([]byte, 4, len(p)+encOverhead)
+	binary.BigEndian.PutUint32(out, uint32(len(p)+encTagSize))
+	out = c.aead.Seal(out, chunkNonce(c.seq), p, chunkAAD(c.seq, last))
+	c.seq++
+	return out, nil
+}
+
+// decryptReader 按块解密加密日志文件
+type decryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	seq     uint64
+	partial bool // 为true时允许文件没有结束块
+	buf     []byte
+	err     error
+}
+
+// NewDecryptReader 读取加密日志文件的文件头, 返回解密后的明文内容. 任何数据块被修改,调换或删除时Read返回错误;
+// 文件没有结束块时读完所有数据块后返回ErrTruncated, 正在写入的文件和进程崩溃时留下的文件也是如此.
+func NewDecryptReader(r io.Reader, keys KeyProvider) (io.Reader, error) {
+	return newDecryptReader(r, keys, false)
+}
+
+func newDecryptReader(r io.Reader, keys KeyProvider, partial bool) (*decryptReader, error) {
+	magic := make([]byte, len(encMagic)+1)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, fmt.Errorf("log: read encrypted header: %v", err)
+	}
+	if !bytes.Equal(magic[:len(encMagic)], []byte(encMagic)) {
+		return nil, errors.New("log: not an encrypted log file")
+	}
+	rest := make([]byte, int(magic[len(encMagic)])+encSaltSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("log: read encrypted header: %v", err)
+	}
+	id := string(rest[:len(rest)-encSaltSize])
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key, rest[len(rest)-encSaltSize:])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: r, aead: aead, partial: partial}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.buf, d.err = d.next()
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// next 读取并解密下一个数据块, 读到结束块时返回io.EOF
+func (d *decryptReader) next() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(d.r, size[:]); err != nil {
+		if err == io.EOF {
+			if d.partial {
+				return nil, io.EOF
+			}
+			return nil, ErrTruncated
+		}
+		return nil, fmt.Errorf("log: encrypted chunk %d: %v", d.seq, err)
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < encTagSize || n > encMaxChunk {
+		return nil, fmt.Errorf("log: encrypted chunk %d: invalid size %d", d.seq, n)
+	}
+	chunk := make([]byte, n)
+	if _, err := io.ReadFull(d.r, chunk); err != nil {
+		return nil, fmt.Errorf("log: encrypted chunk %d: %v", d.seq, io.ErrUnexpectedEOF)
+	}
+	nonce := chunkNonce(d.seq)
+	plain, err := d.aead.Open(nil, nonce, chunk, chunkAAD(d.seq, false))
+	if err != nil {
+		if _, lastErr := d.aead.Open(nil, nonce, chunk, chunkAAD(d.seq, true)); lastErr != nil {
+			return nil, fmt.Errorf("log: encrypted chunk %d: %v", d.seq, err)
+		}
+		return nil, d.end()
+	}
+	d.seq++
+	return plain, nil
+}
+
+// end 读到结束块之后文件中不能再有数据
+func (d *decryptReader) end() error {
+	var extra [1]byte
+	if n, _ := io.ReadFull(d.r, extra[:]); n > 0 {
+		return fmt.Errorf("log: encrypted chunk %d: data after the final chunk", d.seq+1)
+	}
+	return io.EOF
+}
+
+// lastChunk 返回加密文件最后一个数据块的明文. 前面的数据块只读取长度后跳过, 不解密;
+// 没有写完的数据块和结束块都被忽略
+func lastChunk(f *os.File, keys KeyProvider) ([]byte, error) {
+	r := bufio.NewReader(f)
+	d, err := newDecryptReader(r, keys, true)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.Name(), err)
+	}
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	off -= int64(r.Buffered())
+
+	var lastOff int64
+	var lastSize uint32
+	var lastSeq uint64
+	for seq := uint64(0); ; seq++ {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			break
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n < encTagSize || n > encMaxChunk {
+			return nil, fmt.Errorf("%s: encrypted chunk %d: invalid size %d", f.Name(), seq, n)
+		}
+		if _, err := r.Discard(int(n)); err != nil {
+			break
+		}
+		// 结束块没有内容
+		if n > encTagSize {
+			lastOff, lastSize, lastSeq = off+4, n, seq
+		}
+		off += 4 + int64(n)
+	}
+	if lastSize == 0 {
+		return nil, nil
+	}
+	chunk := make([]byte, lastSize)
+	if _, err := f.ReadAt(chunk, lastOff); err != nil {
+		return nil, err
+	}
+	plain, err := d.aead.Open(nil, chunkNonce(lastSeq), chunk, chunkAAD(lastSeq, false))
+	if err != nil {
+		return nil, fmt.Errorf("%s: encrypted chunk %d: %v", f.Name(), lastSeq, err)
+	}
+	return plain, nil
+}
+
+// OpenEncryptedLog 打开加密的日志文件或者被lumberjack压缩过的备份文件, 返回解密后的内容.
+// 与NewDecryptReader相同, 文件没有结束块时返回ErrTruncated
+func OpenEncryptedLog(path string, keys KeyProvider) (io.ReadCloser, error) {
+	return openEncryptedLog(path, keys, false)
+}
+
+func openEncryptedLog(path string, keys KeyProvider, partial bool) (io.ReadCloser, error) {
+	f, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newDecryptReader(f, keys, partial)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &decryptFile{Reader: r, Closer: f}, nil
+}
+
+type decryptFile struct {
+	io.Reader
+	io.Closer
+}
+
+// openLog 按是否加密打开日志文件, keys为nil时为明文文件. 当前文件和崩溃时留下的文件没有结束块,
+// 完整性由审计日志的哈希链和清单文件校验, 所以这里不要求结束块
+func openLog(path string, keys KeyProvider) (io.ReadCloser, error) {
+	if keys == nil {
+		return openLogFile(path)
+	}
+	return openEncryptedLog(path, keys, true)
+}
@@ -0,0 +1,122 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var testKeys = StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{7}, 32)}}
+
+// encryptChunks 加密lines, 每行一个数据块, finished为true时写入结束块
+func encryptChunks(t *testing.T, lines []string, finished bool) (header []byte, chunks [][]byte) {
+	t.Helper()
+	c := newFileCipher(testKeys)
+	header, err := c.begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		chunk, err := c.seal([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if finished {
+		chunk, err := c.finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return header, chunks
+}
+
+func decryptAll(header []byte, chunks [][]byte) (string, error) {
+	data := append([]byte(nil), header...)
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+	r, err := NewDecryptReader(bytes.NewReader(data), testKeys)
+	if err != nil {
+		return "", err
+	}
+	plain, err := ioutil.ReadAll(r)
+	return string(plain), err
+}
+
+func TestDecryptReader(t *testing.T) {
+	lines := []string{"a\n", "b\n", "c\n"}
+	header, chunks := encryptChunks(t, lines, true)
+	if got, err := decryptAll(header, chunks); err != nil || got != "a\nb\nc\n" {
+		t.Fatalf("decrypt = %q, %v", got, err)
+	}
+
+	cases := map[string][][]byte{
+		"truncated at a chunk boundary": chunks[:2],
+		"final chunk only removed":      chunks[:3],
+		"chunks swapped":                {chunks[1], chunks[0], chunks[2], chunks[3]},
+		"chunk removed":                 {chunks[0], chunks[2], chunks[3]},
+		"data after the final chunk":    {chunks[0], chunks[1], chunks[2], chunks[3], chunks[2]},
+	}
+	for name, modified := range cases {
+		if _, err := decryptAll(header, modified); err == nil {
+			t.Errorf("%s: decrypt succeeded", name)
+		}
+	}
+	if _, err := decryptAll(header, chunks[:3]); err != ErrTruncated {
+		t.Errorf("missing final chunk: err = %v, want ErrTruncated", err)
+	}
+
+	// 同一个密钥的另一个文件使用不同的派生密钥, 数据块不能挪过去
+	other, _ := encryptChunks(t, lines, true)
+	if _, err := decryptAll(other, chunks); err == nil {
+		t.Error("chunks of another file are accepted")
+	}
+}
+
+func TestRollingWriterEncryptedRotation(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "enc.log")
+	rw := newRollingWriter(&lumberjack.Logger{Filename: path, MaxSize: 1})
+	rw.setCipher(newFileCipher(testKeys))
+
+	line := strings.Repeat("x", 1000) + "\n"
+	for i := 0; i < 1500; i++ {
+		if _, err := rw.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rw.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := rotationSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("expected a rotation, got files %v", files)
+	}
+	total := 0
+	for _, file := range files {
+		r, err := OpenEncryptedLog(file, testKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		total += strings.Count(string(data), line)
+	}
+	if total != 1500 {
+		t.Fatalf("read %d lines, want 1500", total)
+	}
+}
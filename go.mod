@@ -3,7 +3,12 @@ module github.com/terryliu/log/v2
 go 1.13
 
 require (
+	github.com/go-logr/logr v1.2.4
+	go.opentelemetry.io/otel/trace v1.0.0
 	go.uber.org/zap v1.13.0
+	golang.org/x/text v0.3.8
+	google.golang.org/grpc v1.43.0
+	google.golang.org/protobuf v1.25.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
 
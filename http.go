@@ -0,0 +1,447 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultRequestIDHeader 默认的请求ID请求头
+const DefaultRequestIDHeader = "X-Request-ID"
+
+// 请求和响应内容在Extras中的键
+const (
+	RequestKeyRequestBody  = "request_body"
+	RequestKeyResponseBody = "response_body"
+)
+
+type requestIDKey struct{}
+
+// RequestIDFromContext 返回HTTPMiddleware保存在context中的请求ID
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// ContextWithRequestID 把请求ID保存到context中
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+type httpConfig struct {
+	requestIDHeader string
+	trusted         []*net.IPNet
+	requestBody     int
+	responseBody    int
+	skips           []func(*http.Request) bool
+}
+
+type HTTPOption interface {
+	apply(*httpConfig)
+}
+
+type httpOptionFunc func(*httpConfig)
+
+func (f httpOptionFunc) apply(c *httpConfig) {
+	f(c)
+}
+
+// WithRequestIDHeader 设置请求ID的请求头, 默认为X-Request-ID. 请求中没有该请求头时会生成一个,
+// 并写到响应头中
+func WithRequestIDHeader(header string) HTTPOption {
+	return httpOptionFunc(func(c *httpConfig) {
+		c.requestIDHeader = header
+	})
+}
+
+// WithTrustedProxies 设置可信的代理, 支持IP和CIDR. 只有直接连接的地址是可信代理时才会使用
+// X-Forwarded-For和X-Real-IP, 并从右往左跳过可信代理取第一个地址作为客户端IP. 无法解析的地址会被忽略
+func WithTrustedProxies(proxies ...string) HTTPOption {
+	return httpOptionFunc(func(c *httpConfig) {
+		for _, p := range proxies {
+			if !strings.Contains(p, "/") {
+				if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+					p += "/32"
+				} else {
+					p += "/128"
+				}
+			}
+			if _, n, err := net.ParseCIDR(p); err == nil {
+				c.trusted = append(c.trusted, n)
+			}
+		}
+	})
+}
+
+// WithRequestBody 记录请求内容, 最多max个字节
+func WithRequestBody(max int) HTTPOption {
+	return httpOptionFunc(func(c *httpConfig) {
+		c.requestBody = max
+	})
+}
+
+// WithResponseBody 记录响应内容, 最多max个字节
+func WithResponseBody(max int) HTTPOption {
+	return httpOptionFunc(func(c *httpConfig) {
+		c.responseBody = max
+	})
+}
+
+// WithSkip skip返回true的请求不记录日志
+func WithSkip(skip func(*http.Request) bool) HTTPOption {
+	return httpOptionFunc(func(c *httpConfig) {
+		c.skips = append(c.skips, skip)
+	})
+}
+
+// WithSkipPaths 不记录这些路径的请求, 比如健康检查: WithSkipPaths("/health", "/ping")
+func WithSkipPaths(paths ...string) HTTPOption {
+	set := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		set[p] = true
+	}
+	return WithSkip(func(r *http.Request) bool {
+		return set[r.URL.Path]
+	})
+}
+
+// HTTPMiddleware 记录每个请求的访问日志到Request日志中, 包括方法,路径,状态码,响应大小,耗时,客户端IP和请求ID.
+// 请求ID会保存在请求的context中, 可以用RequestIDFromContext取出.
+// 使用方法: http.ListenAndServe(":8080", log.HTTPMiddleware(mux, log.WithSkipPaths("/health")))
+func HTTPMiddleware(next http.Handler, opts ...HTTPOption) http.Handler {
+	c := &httpConfig{requestIDHeader: DefaultRequestIDHeader}
+	for _, opt := range opts {
+		opt.apply(c)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, skip := range c.skips {
+			if skip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		start := time.Now()
+		id := r.Header.Get(c.requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+			w.Header().Set(c.requestIDHeader, id)
+		}
+		r = r.WithContext(ContextWithRequestID(r.Context(), id))
+
+		var body *countingBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingBody{ReadCloser: r.Body, max: c.requestBody}
+			r.Body = body
+		}
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK, max: c.responseBody}
+
+		completed := false
+		defer func() {
+			if !completed && !rw.wroteHeader {
+				// handler发生了panic, net/http会断开连接
+				rw.status = http.StatusInternalServerError
+			}
+			entry := RequestEntry{
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Query:     r.URL.RawQuery,
+				Status:    rw.status,
+				Latency:   time.Since(start),
+				ClientIP:  c.clientIP(r),
+				UserAgent: r.UserAgent(),
+				RequestID: id,
+				BytesIn:   r.ContentLength,
+				BytesOut:  rw.size,
+			}
+			if body != nil && body.size > entry.BytesIn {
+				entry.BytesIn = body.size
+			}
+			if entry.BytesIn < 0 {
+				entry.BytesIn = 0
+			}
+			entry.Extras = map[string]interface{}{RequestKeyProto: r.Proto}
+			if referer := r.Referer(); referer != "" {
+				entry.Extras[RequestKeyReferer] = referer
+			}
+			if user, _, ok := r.BasicAuth(); ok {
+				entry.Extras[RequestKeyUser] = user
+			}
+			if c.requestBody > 0 && body != nil {
+				entry.Extras[RequestKeyRequestBody] = body.buf.String()
+			}
+			if c.responseBody > 0 {
+				entry.Extras[RequestKeyResponseBody] = rw.buf.String()
+			}
+			LogRequestContext(r.Context(), entry)
+		}()
+		next.ServeHTTP(rw.wrap(), r)
+		completed = true
+	})
+}
+
+// clientIP 取客户端IP, 只信任来自可信代理的X-Forwarded-For和X-Real-IP
+func (c *httpConfig) clientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if !c.isTrusted(remote) {
+		return remote
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop != "" && !c.isTrusted(hop) {
+				return hop
+			}
+		}
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	return remote
+}
+
+func (c *httpConfig) isTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// countingBody 统计请求内容的大小, 并保留前max个字节
+type countingBody struct {
+	io.ReadCloser
+	max  int
+	size int64
+	buf  bytes.Buffer
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	if rest := b.max - b.buf.Len(); rest > 0 {
+		if rest > n {
+			rest = n
+		}
+		b.buf.Write(p[:rest])
+	}
+	return n, err
+}
+
+// responseRecorder 记录状态码和响应大小, 并保留响应内容的前max个字节
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	size        int64
+	max         int
+	buf         bytes.Buffer
+	wroteHeader bool
+}
+
+// wrap handler常用类型断言判断是否支持Flush,Hijack等, 所以返回的ResponseWriter只实现
+// 原来的ResponseWriter实现了的http.Flusher, http.Hijacker, http.Pusher和io.ReaderFrom
+func (w *responseRecorder) wrap() http.ResponseWriter {
+	const (
+		flusher = 1 << iota
+		hijacker
+		pusher
+		readerFrom
+	)
+	kind := 0
+	if _, ok := w.ResponseWriter.(http.Flusher); ok {
+		kind |= flusher
+	}
+	if _, ok := w.ResponseWriter.(http.Hijacker); ok {
+		kind |= hijacker
+	}
+	if _, ok := w.ResponseWriter.(http.Pusher); ok {
+		kind |= pusher
+	}
+	if _, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		kind |= readerFrom
+	}
+	switch kind {
+	case flusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+		}{w, w}
+	case hijacker:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+		}{w, w}
+	case flusher | hijacker:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{w, w, w}
+	case pusher:
+		return struct {
+			http.ResponseWriter
+			http.Pusher
+		}{w, w}
+	case flusher | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Pusher
+		}{w, w, w}
+	case hijacker | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.Pusher
+		}{w, w, w}
+	case flusher | hijacker | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, w, w, w}
+	case readerFrom:
+		return struct {
+			http.ResponseWriter
+			io.ReaderFrom
+		}{w, w}
+	case flusher | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+		}{w, w, w}
+	case hijacker | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{w, w, w}
+	case flusher | hijacker | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, w, w, w}
+	case pusher | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Pusher
+			io.ReaderFrom
+		}{w, w, w}
+	case flusher | pusher | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Pusher
+			io.ReaderFrom
+		}{w, w, w, w}
+	case hijacker | pusher | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{w, w, w, w}
+	case flusher | hijacker | pusher | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{w, w, w, w, w}
+	}
+	return struct{ http.ResponseWriter }{w}
+}
+
+// WriteHeader 1xx(101除外)是中间响应, 之后还会有最终的状态码, 所以不记录
+func (w *responseRecorder) WriteHeader(status int) {
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	w.capture(p[:n])
+	return n, err
+}
+
+// capture 保留响应内容的前max个字节
+func (w *responseRecorder) capture(p []byte) {
+	if rest := w.max - w.buf.Len(); rest > 0 {
+		if rest > len(p) {
+			rest = len(p)
+		}
+		w.buf.Write(p[:rest])
+	}
+}
+
+func (w *responseRecorder) Flush() {
+	w.wroteHeader = true
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (w *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (w *responseRecorder) Push(target string, opts *http.PushOptions) error {
+	return w.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+// ReadFrom 保留了底层的ReadFrom(比如用sendfile发送文件), 只在需要记录响应内容时才复制一份
+func (w *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	w.wroteHeader = true
+	if w.max > 0 {
+		src = io.TeeReader(src, recorderCapture{w})
+	}
+	n, err := w.ResponseWriter.(io.ReaderFrom).ReadFrom(src)
+	w.size += n
+	return n, err
+}
+
+// recorderCapture 把ReadFrom读出的内容交给capture
+type recorderCapture struct {
+	w *responseRecorder
+}
+
+func (c recorderCapture) Write(p []byte) (int, error) {
+	c.w.capture(p)
+	return len(p), nil
+}
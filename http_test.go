@@ -0,0 +1,181 @@
+package log
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// initRequestLog 初始化json格式的Request日志, 返回日志文件的路径
+func initRequestLog(t *testing.T) string {
+	t.Helper()
+	dir := tempDir(t)
+	Init(filepath.Join(dir, "app.log"), InfoLevel, true, false, SetRequestType("json"))
+	t.Cleanup(func() { logger.close(); logger = nil })
+	return filepath.Join(dir, "app.log.Request")
+}
+
+// requestEntries 返回Request日志中路径为path的请求
+func requestEntries(t *testing.T, file, path string) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	for _, line := range readLines(t, file, `"path":"`+path+`"`) {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("%v: %s", err, line)
+		}
+		entries = append(entries, m)
+	}
+	return entries
+}
+
+func TestHTTPMiddlewareClientIP(t *testing.T) {
+	file := initRequestLog(t)
+	h := HTTPMiddleware(http.NotFoundHandler(), WithTrustedProxies("10.0.0.0/8", "::1"))
+
+	cases := []struct {
+		path, remote, xff, realIP, want string
+	}{
+		{"/untrusted", "203.0.113.1:1234", "198.51.100.1", "", "203.0.113.1"},
+		{"/xff", "10.0.0.1:1234", "198.51.100.1, 198.51.100.2, 10.0.0.2", "", "198.51.100.2"},
+		{"/all-trusted", "10.0.0.1:1234", "10.0.0.3", "", "10.0.0.1"},
+		{"/real-ip", "[::1]:1234", "", "198.51.100.3", "198.51.100.3"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.path, nil)
+		r.RemoteAddr = c.remote
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if c.realIP != "" {
+			r.Header.Set("X-Real-IP", c.realIP)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	for _, c := range cases {
+		entries := requestEntries(t, file, c.path)
+		if len(entries) != 1 || entries[0][RequestKeyClientIP] != c.want {
+			t.Errorf("%s: client ip = %v, want %s", c.path, entries, c.want)
+		}
+	}
+}
+
+func TestHTTPMiddlewareBody(t *testing.T) {
+	file := initRequestLog(t)
+	h := HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "response body")
+	}), WithRequestBody(4), WithResponseBody(8))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/body", strings.NewReader("request body")))
+	e := requestEntries(t, file, "/body")[0]
+	if e[RequestKeyRequestBody] != "requ" || e[RequestKeyResponseBody] != "response" {
+		t.Errorf("bodies = %q, %q", e[RequestKeyRequestBody], e[RequestKeyResponseBody])
+	}
+	// 统计的大小不受保留字节数的限制
+	if e[RequestKeyBytesIn] != 12.0 || e[RequestKeyBytesOut] != 13.0 || e[RequestKeyStatus] != 201.0 {
+		t.Errorf("entry = %v", e)
+	}
+}
+
+func TestHTTPMiddlewareSkip(t *testing.T) {
+	file := initRequestLog(t)
+	called := 0
+	h := HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called++
+	}), WithSkipPaths("/health"), WithSkip(func(r *http.Request) bool { return r.Method == "OPTIONS" }))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("OPTIONS", "/skipped", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/logged", nil))
+	if called != 3 {
+		t.Fatalf("handler called %d times, want 3", called)
+	}
+	if n := len(requestEntries(t, file, "/health")) + len(requestEntries(t, file, "/skipped")); n != 0 {
+		t.Errorf("skipped requests logged %d times", n)
+	}
+	if n := len(requestEntries(t, file, "/logged")); n != 1 {
+		t.Errorf("request logged %d times, want 1", n)
+	}
+}
+
+func TestHTTPMiddlewareInterfaces(t *testing.T) {
+	initRequestLog(t)
+	var flusher, hijacker, pusher, readerFrom bool
+	h := HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, flusher = w.(http.Flusher)
+		_, hijacker = w.(http.Hijacker)
+		_, pusher = w.(http.Pusher)
+		_, readerFrom = w.(io.ReaderFrom)
+	}))
+
+	// httptest.ResponseRecorder只实现了http.Flusher
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !flusher || hijacker || pusher || readerFrom {
+		t.Errorf("recorder: flusher %v, hijacker %v, pusher %v, readerFrom %v", flusher, hijacker, pusher, readerFrom)
+	}
+
+	// HTTP/1.1的连接不支持http.Pusher
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !flusher || !hijacker || pusher || !readerFrom {
+		t.Errorf("http/1.1: flusher %v, hijacker %v, pusher %v, readerFrom %v", flusher, hijacker, pusher, readerFrom)
+	}
+}
+
+func TestHTTPMiddlewareReadFrom(t *testing.T) {
+	file := initRequestLog(t)
+	h := HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(io.ReaderFrom).ReadFrom(strings.NewReader("copied body"))
+	}), WithResponseBody(6))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "copied body" {
+		t.Fatalf("body = %q", body)
+	}
+	e := requestEntries(t, file, "/copy")[0]
+	if e[RequestKeyBytesOut] != 11.0 || e[RequestKeyResponseBody] != "copied" {
+		t.Errorf("entry = %v", e)
+	}
+}
+
+func TestHTTPMiddlewareInformational(t *testing.T) {
+	file := initRequestLog(t)
+	h := HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/early-hints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if e := requestEntries(t, file, "/early-hints")[0]; e[RequestKeyStatus] != 202.0 {
+		t.Errorf("logged status %v, want 202", e[RequestKeyStatus])
+	}
+}
@@ -0,0 +1,221 @@
+package log
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// truncatedKey 日志中有内容被截断或者字段被丢弃时加上该字段
+const truncatedKey = "_truncated"
+
+// sizeLimits 日志大小的限制, 为0表示不限制
+type sizeLimits struct {
+	message int // 消息的最大字节数
+	field   int // 每个字段值的最大字节数
+	fields  int // 最多字段个数
+	entry   int // 整条日志(消息加所有字段的键和值)的最大字节数
+}
+
+func (l sizeLimits) enabled() bool {
+	return l.message > 0 || l.field > 0 || l.fields > 0 || l.entry > 0
+}
+
+// limitCore 按sizeLimits截断日志, 在编码之前处理, 所以json和csv格式的结果一致.
+// With添加的字段同样受限制, 并计入之后每条日志的字段个数和大小
+type limitCore struct {
+	zapcore.Core
+	limits    sizeLimits
+	used      int  // With添加的字段个数
+	usedSize  int  // With添加的字段的键和值的字节数
+	truncated bool // With添加的字段中已经有截断标记
+}
+
+func (c *limitCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	_, fields, size, truncated := c.limits.apply(zapcore.Entry{}, fields, c.used, c.usedSize)
+	clone.used += len(fields)
+	clone.usedSize += size
+	if truncated && !c.truncated {
+		fields = append(fields[:len(fields):len(fields)], zap.Bool(truncatedKey, true))
+		clone.truncated = true
+	}
+	clone.Core = c.Core.With(fields)
+	return &clone
+}
+
+func (c *limitCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *limitCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent, fields, _, truncated := c.limits.apply(ent, fields, c.used, c.usedSize)
+	if truncated && !c.truncated {
+		fields = append(fields[:len(fields):len(fields)], zap.Bool(truncatedKey, true))
+	}
+	return writeCore(c.Core, ent, fields)
+}
+
+// apply 依次应用字段个数,字段值,消息和整条日志的限制, used和usedSize为With添加的字段已经占用的个数和字节数.
+// 返回处理后的日志, 字段的键和值的总字节数(没有字段值和整条日志的限制时为0), 以及是否有内容被截断
+func (l sizeLimits) apply(ent zapcore.Entry, fields []zapcore.Field, used, usedSize int) (zapcore.Entry, []zapcore.Field, int, bool) {
+	truncated := false
+	if l.fields > 0 {
+		max := l.fields - used
+		if max < 0 {
+			max = 0
+		}
+		if len(fields) > max {
+			fields = fields[:max:max]
+			truncated = true
+		}
+	}
+	msgKeep := len(ent.Message)
+	if l.message > 0 && msgKeep > l.message {
+		msgKeep = l.message
+	}
+
+	// 没有字段值和整条日志的限制时不需要计算字段值的大小
+	var size int
+	if l.field > 0 || l.entry > 0 {
+		var out []zapcore.Field
+		out, size = l.limitFields(fields, msgKeep, usedSize, &msgKeep)
+		if out != nil {
+			fields = out
+			truncated = true
+		}
+	}
+	if msgKeep < len(ent.Message) {
+		ent.Message = truncateString(ent.Message, msgKeep)
+		truncated = true
+	}
+	return ent, fields, size, truncated
+}
+
+// limitFields 应用字段值和整条日志的限制, 整条日志超出限制时可能减少消息保留的字节数msgKeep.
+// 只有字符串类的值和对象,数组等编码后可能很长的值才会被截断, 数字,布尔值等只计入整条日志的大小;
+// 对象和数组按json编码后计算大小, 截断后仍然是编码后的内容. 没有字段被截断时返回的切片为nil
+func (l sizeLimits) limitFields(fields []zapcore.Field, msgLen, usedSize int, msgKeep *int) ([]zapcore.Field, int) {
+	// keep记录每个值保留的字节数, 最后再统一截断, 这样标记中的字节数总是相对原始值
+	values := make([]string, len(fields))
+	sizes := make([]int, len(fields))
+	keep := make([]int, len(fields))
+	total := msgLen + usedSize
+	for i, f := range fields {
+		sizes[i], keep[i] = fieldSize(f, &values[i])
+		if keep[i] >= 0 && l.field > 0 && keep[i] > l.field {
+			keep[i] = l.field
+		}
+		total += len(f.Key) + sizes[i]
+		if keep[i] >= 0 {
+			total -= sizes[i] - keep[i]
+		}
+	}
+	if l.entry > 0 {
+		if excess := total - l.entry; excess > 0 {
+			*msgKeep = shrink(*msgKeep, keep, excess)
+		}
+	}
+
+	var out []zapcore.Field
+	size := 0
+	for i, f := range fields {
+		size += len(f.Key) + sizes[i]
+		if keep[i] < 0 || keep[i] >= sizes[i] {
+			continue
+		}
+		if out == nil {
+			out = make([]zapcore.Field, len(fields), len(fields)+1)
+			copy(out, fields)
+		}
+		value := truncateString(fieldValue(f, values[i]), keep[i])
+		out[i] = zap.String(f.Key, value)
+		size += len(value) - sizes[i]
+	}
+	return out, size
+}
+
+// fieldSize 返回字段值的字节数, 以及可以截断时的初始保留字节数(不能截断时为-1).
+// 字符串和字节数组直接取长度; 需要格式化或编码才能知道长度的值, 结果保存在value中, 以免截断时再计算一次
+func fieldSize(f zapcore.Field, value *string) (int, int) {
+	switch f.Type {
+	case zapcore.StringType:
+		return len(f.String), len(f.String)
+	case zapcore.ByteStringType:
+		n := len(f.Interface.([]byte))
+		return n, n
+	case zapcore.BinaryType:
+		n := base64.StdEncoding.EncodedLen(len(f.Interface.([]byte)))
+		return n, n
+	case zapcore.StringerType, zapcore.ErrorType:
+		*value = fieldString(f)
+		return len(*value), len(*value)
+	case zapcore.ReflectType, zapcore.ObjectMarshalerType, zapcore.ArrayMarshalerType:
+		*value = encodedValue(f)
+		return len(*value), len(*value)
+	}
+	return len(fieldString(f)), -1
+}
+
+// fieldValue 返回被截断的字段值的完整内容
+func fieldValue(f zapcore.Field, value string) string {
+	switch f.Type {
+	case zapcore.StringType:
+		return f.String
+	case zapcore.ByteStringType:
+		return string(f.Interface.([]byte))
+	case zapcore.BinaryType:
+		return base64.StdEncoding.EncodeToString(f.Interface.([]byte))
+	}
+	return value
+}
+
+// shrink 整条日志超出限制时, 从保留最长的值开始减少保留的字节数, 最后才截断消息. 截断标记本身不计入大小
+func shrink(msgKeep int, keep []int, excess int) int {
+	order := make([]int, 0, len(keep))
+	for i := range keep {
+		if keep[i] > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return keep[order[a]] > keep[order[b]] })
+	for _, i := range order {
+		if excess <= 0 {
+			break
+		}
+		n := excess
+		if n > keep[i] {
+			n = keep[i]
+		}
+		keep[i] -= n
+		excess -= n
+	}
+	if excess > 0 {
+		msgKeep -= excess
+		if msgKeep < 0 {
+			msgKeep = 0
+		}
+	}
+	return msgKeep
+}
+
+// truncateString 只保留s的前max个字节(不会切断UTF-8字符), 后面加上"…(truncated N bytes)"标记, N为去掉的字节数
+func truncateString(s string, max int) string {
+	if max < 0 {
+		max = 0
+	}
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return fmt.Sprintf("%s…(truncated %d bytes)", s[:max], len(s)-max)
+}
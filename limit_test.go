@@ -0,0 +1,121 @@
+package log
+
+import (
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// countingStringer 记录String被调用的次数
+type countingStringer struct {
+	calls *int
+}
+
+func (s countingStringer) String() string {
+	*s.calls++
+	return "value"
+}
+
+func writeLimited(t *testing.T, limits sizeLimits, msg string, fields ...zapcore.Field) observer.LoggedEntry {
+	t.Helper()
+	inner, logs := observer.New(zapcore.DebugLevel)
+	c := &limitCore{Core: inner, limits: limits}
+	c.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: msg}, fields)
+	if logs.Len() != 1 {
+		t.Fatalf("wrote %d entries", logs.Len())
+	}
+	return logs.All()[0]
+}
+
+func TestLimitField(t *testing.T) {
+	e := writeLimited(t, sizeLimits{field: 5}, "m", zap.String("s", "0123456789"), zap.Int("n", 1234567890))
+	m := e.ContextMap()
+	if m["s"] != "01234…(truncated 5 bytes)" {
+		t.Errorf("s = %q", m["s"])
+	}
+	if m["n"] != int64(1234567890) {
+		t.Errorf("numbers are truncated: %v", m["n"])
+	}
+	if m[truncatedKey] != true {
+		t.Errorf("missing %s: %v", truncatedKey, m)
+	}
+
+	e = writeLimited(t, sizeLimits{field: 5}, "m", zap.String("s", "short"))
+	if _, ok := e.ContextMap()[truncatedKey]; ok {
+		t.Errorf("%s added without truncation", truncatedKey)
+	}
+}
+
+func TestLimitMessage(t *testing.T) {
+	e := writeLimited(t, sizeLimits{message: 4}, "中文消息")
+	// 不会切断UTF-8字符
+	if e.Message != "中…(truncated 9 bytes)" {
+		t.Errorf("message = %q", e.Message)
+	}
+}
+
+func TestLimitEntry(t *testing.T) {
+	// 键也计入大小; 先截断最长的字段值, 最后才截断消息
+	e := writeLimited(t, sizeLimits{entry: 30}, "message", zap.String("a", strings.Repeat("a", 20)), zap.String("b", "bbbb"))
+	m := e.ContextMap()
+	if e.Message != "message" || m["b"] != "bbbb" || m["a"] != strings.Repeat("a", 17)+"…(truncated 3 bytes)" {
+		t.Errorf("entry = %q %v", e.Message, m)
+	}
+
+	e = writeLimited(t, sizeLimits{entry: 3}, "message", zap.String("k", "v"))
+	if m := e.ContextMap(); m["k"] != "…(truncated 1 bytes)" || e.Message != "me…(truncated 5 bytes)" {
+		t.Errorf("entry = %q %v", e.Message, m)
+	}
+}
+
+func TestLimitFields(t *testing.T) {
+	e := writeLimited(t, sizeLimits{fields: 2}, "m", zap.Int("a", 1), zap.Int("b", 2), zap.Int("c", 3))
+	m := e.ContextMap()
+	if _, ok := m["c"]; ok || len(m) != 3 || m[truncatedKey] != true {
+		t.Errorf("fields = %v", m)
+	}
+}
+
+func TestLimitEncodedValue(t *testing.T) {
+	e := writeLimited(t, sizeLimits{field: 10}, "m",
+		zap.Object("p", csvPoint{X: 100, Y: 200}),
+		zap.Any("secret", tagSecret{User: "user", Token: "s3cret"}))
+	m := e.ContextMap()
+	if m["p"] != `{"x":100,"…(truncated 7 bytes)` {
+		t.Errorf("object = %q, want the truncated json encoding", m["p"])
+	}
+	if v := m["secret"].(string); !strings.HasPrefix(v, `{"User":"u`) || strings.Contains(v, "s3cret") {
+		t.Errorf("reflected value = %q, want the truncated json encoding with tags applied", v)
+	}
+}
+
+func TestLimitWith(t *testing.T) {
+	inner, logs := observer.New(zapcore.DebugLevel)
+	var c zapcore.Core = &limitCore{Core: inner, limits: sizeLimits{field: 5, fields: 2}}
+	c = c.With([]zapcore.Field{zap.String("ctx", "0123456789")})
+	c.Write(zapcore.Entry{Message: "m"}, []zapcore.Field{zap.String("long", "0123456789"), zap.Int("dropped", 1)})
+
+	ctx := logs.All()[0].Context
+	var keys []string
+	for _, f := range ctx {
+		keys = append(keys, f.Key)
+	}
+	// With的字段计入字段个数, 截断标记只出现一次
+	if strings.Join(keys, ",") != "ctx,"+truncatedKey+",long" {
+		t.Fatalf("fields = %v", keys)
+	}
+	if ctx[0].String != "01234…(truncated 5 bytes)" || ctx[2].String != "01234…(truncated 5 bytes)" {
+		t.Fatalf("fields = %v", ctx)
+	}
+}
+
+func TestLimitFastPath(t *testing.T) {
+	var calls int
+	writeLimited(t, sizeLimits{message: 10, fields: 5}, "m", zap.Stringer("s", countingStringer{&calls}))
+	if calls != 0 {
+		t.Fatalf("String called %d times without field or entry limits", calls)
+	}
+}
@@ -1,7 +1,11 @@
 package log
 
 import (
+	"crypto/ed25519"
 	"fmt"
+	"time"
+
+	"go.uber.org/zap/zapcore"
 )
 
 const (
@@ -10,6 +14,7 @@ const (
 	WarnLevel  = "warn"
 	ErrorLevel = "error"
 	PanicLevel = "panic"
+	FatalLevel = "fatal" // 只用于LogDepth, 写入PANIC级别的日志文件
 )
 const (
 	FileTypeLog = iota
@@ -18,14 +23,19 @@ const (
 	InfoLevelLog
 	WarnLevelLog
 	ErrorLevelLog
-	PanicLevelLog
+	PanicLevelLog // 没有单独的文件, panic级别的日志写在ERROR文件或主日志中
+	FileTypeAudit // 新的日志类型加在最后, 以免改变已有常量的值
+	FileTypeOutbound
+	FileTypeSQL
+
+	fileTypeCount
 )
 
 var logger *Log
 
 // Log 默认会使用zap作为日志输出引擎. Log集成了日志切割的功能。默认文件大小1024M，自动压缩
 // 最大有3个文件备份，备份保存时间7天。默认不会打印日志被调用的文文件名和位置;
-// 输出:日志默认会被分成两类文件：.log, .log.Request;可以通过SetLogType和SetRequestType函数修改两类文件的存储格式
+// 输出:日志默认会被分成两类文件：.log, .log.Request; 审计日志单独写在.log.Audit; 对外的请求写在.log.Outbound; WrapDriver记录的SQL写在.log.SQL;可以通过SetLogType和SetRequestType函数修改两类文件的存储格式, SetOutboundType修改.log.Outbound的格式
 // debug,info,warn,error,panic都会打印在xxx.log. 所有的请求都会打在xxx.log.Request
 // Adapter:经过比对现在流行的日志库：zap, logrus, zerolog; logrus 虽说格式化，插件化良好，但是
 // 其内部实现锁竞争太过剧烈，性能不好. zap 性能好，格式一般， zerolog性能没有zap好， 相比
@@ -37,6 +47,9 @@ type Log struct {
 	NeedRequestLog bool // 是否需要独立的Request日志
 	NeedLevelsLog  bool // 是否需要各个等级的日志分开打印
 	adapters       []*zapAdapter
+	redactor       *redactor // 所有日志共用的脱敏规则
+	traceKeys      traceKeys // trace关联字段的键名
+	traceColumns   bool      // csv格式时trace字段是否写在固定的列中
 }
 
 type LogOption interface {
@@ -52,76 +65,254 @@ func (f logOptionFunc) apply(log *Log) {
 // contentType=json;csv
 func SetLogType(contentType string) LogOption {
 	return logOptionFunc(func(log *Log) {
-		for k, _ := range log.adapters {
-			if k != FileTypeRequest {
-				log.adapters[k].setLogType(contentType)
+		for k, adapter := range log.adapters {
+			if k == FileTypeLog || (k >= DebugLevelLog && k < PanicLevelLog) {
+				adapter.setLogType(contentType)
 			}
 		}
 	})
 }
 
-// contentType=json;csv
+// contentType=json;csv;common;combined;w3c, 后三种为经典的访问日志格式, 由LogRequest和HTTPMiddleware的字段生成.
+// 只影响Request日志, Outbound日志的格式用SetOutboundType设置
 func SetRequestType(contentType string) LogOption {
 	return logOptionFunc(func(log *Log) {
-		for k, _ := range log.adapters {
-			if k == FileTypeRequest {
-				log.adapters[k].setLogType(contentType)
-			}
-		}
+		log.adapters[FileTypeRequest].setLogType(contentType)
+	})
+}
+
+// SetOutboundType 设置Outbound日志的格式, 取值与SetRequestType相同, 访问日志格式由LogOutbound和Transport的字段生成
+func SetOutboundType(contentType string) LogOption {
+	return logOptionFunc(func(log *Log) {
+		log.adapters[FileTypeOutbound].setLogType(contentType)
 	})
 }
 
 func SetMaxFileSize(size int) LogOption {
 	return logOptionFunc(func(log *Log) {
-		for i, _ := range log.adapters {
-			log.adapters[i].setMaxFileSize(size)
+		for _, adapter := range log.files() {
+			adapter.setMaxFileSize(size)
 		}
 	})
 }
 
 func SetMaxBackups(n int) LogOption {
 	return logOptionFunc(func(log *Log) {
-		for i, _ := range log.adapters {
-			log.adapters[i].setMaxBackups(n)
+		for _, adapter := range log.files() {
+			adapter.setMaxBackups(n)
 		}
 	})
 }
 
 func SetMaxAge(age int) LogOption {
 	return logOptionFunc(func(log *Log) {
-		for i, _ := range log.adapters {
-			log.adapters[i].setMaxAge(age)
+		for _, adapter := range log.files() {
+			adapter.setMaxAge(age)
 		}
 	})
 }
 
 func SetCompress(compress bool) LogOption {
 	return logOptionFunc(func(log *Log) {
-		for i, _ := range log.adapters {
-			log.adapters[i].setCompress(compress)
+		for _, adapter := range log.files() {
+			adapter.setCompress(compress)
 		}
 	})
 }
 
 func SetCaller(caller bool) LogOption {
 	return logOptionFunc(func(log *Log) {
-		for i, _ := range log.adapters {
-			log.adapters[i].setCaller(caller)
+		for _, adapter := range log.files() {
+			adapter.setCaller(caller)
 		}
 	})
 }
 func SetCallerDeep(callerDeep int) LogOption {
 	return logOptionFunc(func(log *Log) {
-		for i, _ := range log.adapters {
-			log.adapters[i].setCallerDeep(callerDeep)
+		for _, adapter := range log.files() {
+			adapter.setCallerDeep(callerDeep)
+		}
+	})
+}
+
+// SetCSVSafe 开启csv的安全模式: 以=,+,-,@开头的单元格会加上单引号前缀, 防止用Excel打开时被当作公式执行
+func SetCSVSafe(safe bool) LogOption {
+	return logOptionFunc(func(log *Log) {
+		for _, adapter := range log.files() {
+			adapter.setCSVSafe(safe)
+		}
+	})
+}
+
+// SetBOM 在每个csv文件(包括切割后的新文件)开头写入UTF-8 BOM, 这样Excel能正确显示中文
+func SetBOM(bom bool) LogOption {
+	return logOptionFunc(func(log *Log) {
+		for _, adapter := range log.files() {
+			adapter.setBOM(bom)
+		}
+	})
+}
+
+// SetCharset 将fileType类型日志的输出由UTF-8转码为charset(如gbk, gb18030, big5等golang.org/x/text支持的字符集),
+// invalid为无效字符的处理方式: InvalidReplace, InvalidSkip或InvalidEscape, 为空时为InvalidEscape. 比如SetCharset(FileTypeRequest, "gbk", InvalidReplace)
+func SetCharset(fileType int, charset, invalid string) LogOption {
+	return logOptionFunc(func(log *Log) {
+		if fileType >= 0 && fileType < len(log.adapters) && log.adapters[fileType] != nil {
+			log.adapters[fileType].setCharset(charset, invalid)
+		}
+	})
+}
+
+// SetAsync 开启异步写文件: 日志先进入长度为queueSize的队列, 由后台协程每隔flushInterval批量写入.
+// overflow为队列满时的处理方式: OverflowBlock阻塞, OverflowDrop丢弃, OverflowDropLow只丢弃debug和info.
+// 调用Sync会等待队列中的日志全部写入文件.
+func SetAsync(queueSize int, flushInterval time.Duration, overflow string) LogOption {
+	return logOptionFunc(func(log *Log) {
+		for _, adapter := range log.files() {
+			adapter.setAsync(queueSize, flushInterval, overflow)
 		}
 	})
 }
 
-// Init init logger
+// SetPriority 设置fileType类型日志的优先级策略: 不低于level级别的日志为重要日志, 异步队列中为其保留reserved的容量,
+// 队列满时重要日志只会阻塞等待, 不会被丢弃. 默认error,panic,fatal为重要日志; 对FileTypeRequest设置InfoLevel可以保证请求日志不丢.
+func SetPriority(fileType int, level string, reserved int) LogOption {
+	return logOptionFunc(func(log *Log) {
+		if fileType >= 0 && fileType < len(log.adapters) && log.adapters[fileType] != nil {
+			log.adapters[fileType].setPriority(level, reserved)
+		}
+	})
+}
+
+// SetSampling 对fileType类型的日志按级别和消息采样: 每个tick周期内相同的消息先保留first条,
+// 之后每thereafter条保留一条. 重要日志(见SetPriority)不参与采样.
+func SetSampling(fileType int, tick time.Duration, first, thereafter int) LogOption {
+	return logOptionFunc(func(log *Log) {
+		if fileType >= 0 && fileType < len(log.adapters) && log.adapters[fileType] != nil {
+			log.adapters[fileType].setSampling(tick, first, thereafter)
+		}
+	})
+}
+
+// SetKeySampling 与SetSampling相同, 但相同消息会再按字段key的值分别计数, 比如按route字段让每个接口各自采样.
+// 没有key字段的日志不参与采样
+func SetKeySampling(fileType int, key string, tick time.Duration, first, thereafter int) LogOption {
+	return logOptionFunc(func(log *Log) {
+		if fileType >= 0 && fileType < len(log.adapters) && log.adapters[fileType] != nil {
+			log.adapters[fileType].addKeySampler(newKeySampler(key, tick, first, thereafter))
+		}
+	})
+}
+
+// SetStatusSampling 按字段key中的状态码类别采样, rates的键为类别(2表示2xx), 值为保留比例.
+// 比如map[int]float64{2: 0.01}保留1%的2xx请求, 未配置的类别(如5xx)全部保留.
+func SetStatusSampling(fileType int, key string, rates map[int]float64) LogOption {
+	return logOptionFunc(func(log *Log) {
+		if fileType >= 0 && fileType < len(log.adapters) && log.adapters[fileType] != nil {
+			log.adapters[fileType].setStatusSampler(newStatusSampler(key, rates))
+		}
+	})
+}
+
+// SetDedup 合并fileType类型日志中window时间内重复出现的日志(级别,消息,调用位置和字段都相同),
+// 窗口结束时输出一条"message repeated N times between T1 and T2"的汇总. 比如SetDedup(ErrorLevelLog, time.Minute)
+func SetDedup(fileType int, window time.Duration) LogOption {
+	return logOptionFunc(func(log *Log) {
+		if fileType >= 0 && fileType < len(log.adapters) && log.adapters[fileType] != nil {
+			log.adapters[fileType].setDedup(window)
+		}
+	})
+}
+
+// AddSink 为fileType类型的日志增加一个远程Sink, 日志以json格式异步批量发送给Sink.
+// 发送队列满时按SetAsync的overflow处理, 未设置时只丢弃debug和info级别的日志, 重要日志(见SetPriority)阻塞等待
+func AddSink(fileType int, sink Sink) LogOption {
+	return logOptionFunc(func(log *Log) {
+		if fileType >= 0 && fileType < len(log.adapters) && log.adapters[fileType] != nil {
+			log.adapters[fileType].addSink(sink)
+		}
+	})
+}
+
+// SetSpillQueue 为远程Sink启用磁盘溢出队列. Sink不可用期间的日志会写入dir下的段文件,
+// Sink恢复后按顺序重放. maxBytes为每个Sink队列的容量上限(字节), maxAge为段文件的最长保留时间,
+// 超出限制时最旧的段文件会被删除. 重放的日志在进程崩溃后可能重复发送一次(at-least-once).
+func SetSpillQueue(dir string, maxBytes int64, maxAge time.Duration) LogOption {
+	return logOptionFunc(func(log *Log) {
+		for _, adapter := range log.files() {
+			adapter.setSpillQueue(dir, maxBytes, maxAge)
+		}
+	})
+}
+
+// SetEncryption 加密所有日志文件(包括lumberjack压缩后的备份文件): 文件内容按块使用AES-GCM加密,
+// 每个文件使用keys当前的密钥, 并在文件头记录密钥ID. 用OpenEncryptedLog或NewDecryptReader读取加密的日志.
+//
+// 已有的加密文件无法继续追加(上次的块序号和结束块无从得知), 所以开启后每次启动都会先切割出一个新文件,
+// MaxBackups需要把重启的次数算进去. 切割和Close时在文件末尾写入结束块, 没有结束块的文件读取时返回ErrTruncated.
+func SetEncryption(keys KeyProvider) LogOption {
+	return logOptionFunc(func(log *Log) {
+		for _, adapter := range log.files() {
+			adapter.setEncryption(keys)
+		}
+	})
+}
+
+// SetManifestKey 每次切割后为日志文件生成签名的清单文件(日志文件名加.manifest), 列出所有备份文件的sha256,
+// 大小, 首尾时间和日志条数. 审计时用Verify(dir, pub)校验备份文件写入后没有被修改过, pub为事先保存的公钥.
+func SetManifestKey(key ed25519.PrivateKey) LogOption {
+	return logOptionFunc(func(log *Log) {
+		for _, adapter := range log.files() {
+			adapter.setManifestKey(key)
+		}
+	})
+}
+
+// SetMaxMessageBytes 限制消息的最大字节数, 超出的部分替换为"…(truncated N bytes)", 并加上_truncated字段
+func SetMaxMessageBytes(n int) LogOption {
+	return logOptionFunc(func(log *Log) {
+		for _, adapter := range log.files() {
+			adapter.setMaxMessageBytes(n)
+		}
+	})
+}
+
+// SetMaxFieldBytes 限制每个字段值(字符串,错误,结构体等)的最大字节数, 截断方式与SetMaxMessageBytes相同
+func SetMaxFieldBytes(n int) LogOption {
+	return logOptionFunc(func(log *Log) {
+		for _, adapter := range log.files() {
+			adapter.setMaxFieldBytes(n)
+		}
+	})
+}
+
+// SetMaxFields 限制每条日志的字段个数, 多出的字段被丢弃, 并加上_truncated字段
+func SetMaxFields(n int) LogOption {
+	return logOptionFunc(func(log *Log) {
+		for _, adapter := range log.files() {
+			adapter.setMaxFields(n)
+		}
+	})
+}
+
+// SetMaxEntryBytes 限制每条日志(消息加字段的键和值)的最大字节数, 超出时从最长的字段值开始截断, 最后截断消息
+func SetMaxEntryBytes(n int) LogOption {
+	return logOptionFunc(func(log *Log) {
+		for _, adapter := range log.files() {
+			adapter.setMaxEntryBytes(n)
+		}
+	})
+}
+
+// Init init logger. 重复调用时, 之前的logger在新的logger创建后关闭, 其后台协程也随之停止
 func Init(path, level string, needRequestLog, needLevelsLog bool, options ...LogOption) {
-	logger = &Log{Path: path, Level: level}
-	logger.createFiles(level, needRequestLog, needLevelsLog, options...)
+	old := logger
+	l := &Log{Path: path, Level: level}
+	l.createFiles(level, needRequestLog, needLevelsLog, options...)
+	logger = l
+	if old != nil {
+		old.close()
+	}
 }
 
 // Sync flushes buffer, if any
@@ -130,11 +321,45 @@ func Sync() {
 		return
 	}
 
-	for _, v := range logger.adapters {
+	for _, v := range logger.files() {
 		v.logger.Sync()
 	}
 }
 
+// Close 写完缓存的日志, 停止后台协程, 并结束加密的日志文件. 之后的日志同步写入文件, 加密时写入一个新文件
+func Close() {
+	if logger == nil {
+		return
+	}
+	logger.close()
+}
+
+// close 关闭所有的adapter
+func (l *Log) close() {
+	for _, v := range l.files() {
+		v.close()
+	}
+}
+
+// files 返回所有的adapter, 不包括没有adapter的PanicLevelLog
+func (l *Log) files() []*zapAdapter {
+	files := make([]*zapAdapter, 0, len(l.adapters))
+	for _, adapter := range l.adapters {
+		if adapter != nil {
+			files = append(files, adapter)
+		}
+	}
+	return files
+}
+
+// DropStats 返回fileType类型日志被丢弃的条数, 按级别统计, 包括异步队列溢出和采样丢弃的日志
+func DropStats(fileType int) map[string]uint64 {
+	if logger == nil || fileType < 0 || fileType >= len(logger.adapters) || logger.adapters[fileType] == nil {
+		return nil
+	}
+	return logger.adapters[fileType].drops.snapshot()
+}
+
 //
 // func (l *Log) maxFileSize(fileType int) int {
 // 	if fileType==FileTypeLog || fileType==FileTypeRequest {
@@ -145,10 +370,14 @@ func Sync() {
 //
 
 func (l *Log) createFiles(level string, needRequestLog, needLevelsLog bool, options ...LogOption) {
-	adapters := make([]*zapAdapter, 6)
+	adapters := make([]*zapAdapter, fileTypeCount)
 	// adapters := make(map[string]*zapAdapter, 2)
 	adapters[FileTypeLog] = NewZapAdapter(fmt.Sprintf("%s", l.Path), level, "json")
 	adapters[FileTypeRequest] = NewZapAdapter(fmt.Sprintf("%s.Request", l.Path), InfoLevel, "csv")
+	adapters[FileTypeAudit] = NewZapAdapter(fmt.Sprintf("%s.Audit", l.Path), InfoLevel, "json")
+	adapters[FileTypeAudit].audit = true
+	adapters[FileTypeOutbound] = NewZapAdapter(fmt.Sprintf("%s.Outbound", l.Path), InfoLevel, "csv")
+	adapters[FileTypeSQL] = NewZapAdapter(fmt.Sprintf("%s.SQL", l.Path), InfoLevel, "csv")
 	adapters[DebugLevelLog] = NewZapAdapter(fmt.Sprintf("%s.DEBUG", l.Path), DebugLevel, "json")
 	adapters[InfoLevelLog] = NewZapAdapter(fmt.Sprintf("%s.INFO", l.Path), InfoLevel, "json")
 	adapters[WarnLevelLog] = NewZapAdapter(fmt.Sprintf("%s.WARN", l.Path), WarnLevel, "json")
@@ -156,14 +385,26 @@ func (l *Log) createFiles(level string, needRequestLog, needLevelsLog bool, opti
 	l.NeedRequestLog = needRequestLog
 	l.NeedLevelsLog = needLevelsLog
 	l.adapters = adapters
+	l.redactor = newRedactor()
+	for _, adapter := range l.files() {
+		adapter.redactor = l.redactor
+	}
+	l.traceKeys = defaultTraceKeys
 
 	// options为回调函数,用来作为log对象的中间件进行调用
 	for _, opt := range options {
 		// 将log对象作为参数传入回调函数中
 		opt.apply(l)
 	}
+	if l.traceColumns {
+		for k, adapter := range adapters {
+			if k == FileTypeLog || k == FileTypeRequest || k == FileTypeOutbound || (k >= DebugLevelLog && k < PanicLevelLog) {
+				adapter.setTraceColumns(l.traceKeys.list())
+			}
+		}
+	}
 
-	for _, adapter := range adapters {
+	for _, adapter := range l.files() {
 		adapter.Init()
 	}
 
@@ -180,12 +421,28 @@ func needLevelsLog(selfLevel int) int {
 		}
 		return selfLevel
 	}
-	if selfLevel >= DebugLevelLog {
+	if selfLevel >= DebugLevelLog && selfLevel <= PanicLevelLog {
 		return FileTypeLog
 	}
 	return FileTypeRequest
 }
 
+// levelAdapter 返回level级别的日志应该写入的adapter, 调用前需要判断logger不为nil
+func levelAdapter(level zapcore.Level) *zapAdapter {
+	selfLevel := PanicLevelLog
+	switch {
+	case level <= zapcore.DebugLevel:
+		selfLevel = DebugLevelLog
+	case level == zapcore.InfoLevel:
+		selfLevel = InfoLevelLog
+	case level == zapcore.WarnLevel:
+		selfLevel = WarnLevelLog
+	case level == zapcore.ErrorLevel:
+		selfLevel = ErrorLevelLog
+	}
+	return logger.adapters[needLevelsLog(selfLevel)]
+}
+
 // Debug 使用方法：log.Debug("test")
 func Debug(args ...interface{}) {
 	if logger == nil {
@@ -227,6 +484,7 @@ func Infof(template string, args ...interface{}) {
 	logger.adapters[needLevelsLog(InfoLevelLog)].Infof(template, args...)
 }
 
+// Infow 不会记录trace_id等关联字段, 需要时使用Ctx(ctx).Infow
 func Infow(msg string, keysAndValues ...interface{}) {
 	if logger == nil {
 		return
@@ -235,15 +493,33 @@ func Infow(msg string, keysAndValues ...interface{}) {
 	logger.adapters[needLevelsLog(InfoLevelLog)].Infow(msg, keysAndValues...)
 }
 
+// Output 与标准库log.Output相同, calldepth为1时记录的是Output调用方的位置, 以info级别记录
 func Output(calldepth int, s string) error {
-	Info(s)
+	stdOutput(zapcore.InfoLevel, callerAt(calldepth), s)
 	return nil
 }
+
+// LogDepth 以level级别写一条日志, depth为0时记录的是LogDepth调用方的位置, 用于封装本包或桥接其它日志库时
+// 记录正确的调用位置. panic和fatal级别的日志写入后会Sync, 但不会panic或退出程序, 由调用方决定
+func LogDepth(depth int, level, msg string, keysAndValues ...interface{}) {
+	if logger == nil {
+		return
+	}
+	l := parseLevel(level)
+	levelAdapter(l).logEntry(l, time.Time{}, callerAt(depth+1), msg, kvFields(keysAndValues)...)
+	if l > zapcore.ErrorLevel {
+		Sync()
+	}
+}
+
+// Println 与标准库log.Println相同, 以info级别记录
 func Println(v ...interface{}) {
-	Info(v)
+	stdOutput(zapcore.InfoLevel, callerAt(1), fmt.Sprintln(v...))
 }
+
+// Printf 与标准库log.Printf相同, 以info级别记录
 func Printf(format string, v ...interface{}) {
-	Infof(format, v)
+	stdOutput(zapcore.InfoLevel, callerAt(1), fmt.Sprintf(format, v...))
 }
 
 func Warn(args ...interface{}) {
@@ -347,7 +623,11 @@ func RequestLogInfo(keysAndValues ...interface{}) {
 	if logger == nil || !logger.NeedRequestLog {
 		return
 	}
-	logger.adapters[needLevelsLog(FileTypeRequest)].Info(keysAndValues...)
+	args := keysAndValues
+	if rules := logger.redactor.rules.Load().([]*redactRule); len(rules) > 0 {
+		args = logger.redactor.pairs(rules, args)
+	}
+	logger.adapters[needLevelsLog(FileTypeRequest)].Info(args...)
 }
 func RequestLogInfof(template string, args ...interface{}) {
 	if logger == nil || !logger.NeedRequestLog {
@@ -355,9 +635,31 @@ func RequestLogInfof(template string, args ...interface{}) {
 	}
 	logger.adapters[needLevelsLog(FileTypeRequest)].Infof(template, args...)
 }
+
+// RequestLogInfow 不会记录trace_id等关联字段, 需要时使用Ctx(ctx).RequestLogInfow
 func RequestLogInfow(template string, keysAndValues ...interface{}) {
 	if logger == nil || !logger.NeedRequestLog {
 		return
 	}
 	logger.adapters[needLevelsLog(FileTypeRequest)].Infow(template, keysAndValues...)
 }
+
+// AuditLogInfo 写审计日志, 每条审计日志都带有序号和上一条日志的sha256, 可以用VerifyAudit校验
+func AuditLogInfo(args ...interface{}) {
+	if logger == nil {
+		return
+	}
+	logger.adapters[FileTypeAudit].Info(args...)
+}
+func AuditLogInfof(template string, args ...interface{}) {
+	if logger == nil {
+		return
+	}
+	logger.adapters[FileTypeAudit].Infof(template, args...)
+}
+func AuditLogInfow(msg string, keysAndValues ...interface{}) {
+	if logger == nil {
+		return
+	}
+	logger.adapters[FileTypeAudit].Infow(msg, keysAndValues...)
+}
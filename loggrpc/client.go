@@ -0,0 +1,137 @@
+package loggrpc
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryClientInterceptor 记录客户端的一元调用到Outbound日志, 并把context中的请求ID写入metadata
+func UnaryClientInterceptor(opts ...Option) grpc.UnaryClientInterceptor {
+	c := newConfig(opts)
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		if c.skips[method] {
+			return invoker(ctx, method, req, reply, cc, callOpts...)
+		}
+		ctx, cl, p := c.clientCall(ctx, method, false)
+		cl.send(req)
+		err := invoker(ctx, method, req, reply, cc, append(callOpts, grpc.Peer(p))...)
+		if err == nil {
+			cl.recv(reply)
+		}
+		cl.setPeer(p)
+		c.finish(cl, err, true)
+		return err
+	}
+}
+
+// StreamClientInterceptor 记录客户端的流式调用, 在流结束时写一条日志: RecvMsg返回错误或io.EOF,
+// 服务端不是流式时(包括CloseAndRecv)收到响应, 或者ctx被取消. 既不读完也不取消ctx的流与grpc中一样会泄漏, 也不会被记录
+func StreamClientInterceptor(opts ...Option) grpc.StreamClientInterceptor {
+	c := newConfig(opts)
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if c.skips[method] {
+			return streamer(ctx, desc, cc, method, callOpts...)
+		}
+		ctx, cl, p := c.clientCall(ctx, method, true)
+		cs, err := streamer(ctx, desc, cc, method, append(callOpts, grpc.Peer(p))...)
+		if err != nil {
+			cl.setPeer(p)
+			c.finish(cl, err, true)
+			return nil, err
+		}
+		s := &clientStream{ClientStream: cs, conf: c, call: cl, peer: p, single: !desc.ServerStreams, done: make(chan struct{})}
+		go s.watch(ctx)
+		return s, nil
+	}
+}
+
+func (c *config) clientCall(ctx context.Context, method string, stream bool) (context.Context, *call, *peer.Peer) {
+	ctx, id := c.outgoingRequestID(ctx)
+	return ctx, &call{ctx: ctx, method: method, start: time.Now(), stream: stream, requestID: id}, &peer.Peer{}
+}
+
+func (cl *call) setPeer(p *peer.Peer) {
+	if p.Addr != nil {
+		cl.peer = p.Addr.String()
+	}
+}
+
+// clientStream 统计消息并在流结束时写日志. 调用方可以在不同的协程中收发消息, ctx被取消时也在单独的协程中结束,
+// 所以统计和结束都在锁内进行
+type clientStream struct {
+	grpc.ClientStream
+	conf   *config
+	call   *call
+	peer   *peer.Peer
+	single bool // 服务端只返回一条消息
+
+	mu       sync.Mutex
+	finished bool
+	done     chan struct{}
+}
+
+func (s *clientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		s.mu.Lock()
+		s.call.send(m)
+		s.mu.Unlock()
+	} else if err != io.EOF {
+		s.finish(err)
+	}
+	return err
+}
+
+func (s *clientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch err {
+	case nil:
+		s.mu.Lock()
+		s.call.recv(m)
+		s.mu.Unlock()
+		if s.single {
+			s.finish(nil)
+		}
+	case io.EOF:
+		s.finish(nil)
+	default:
+		s.finish(err)
+	}
+	return err
+}
+
+// watch 调用方取消ctx而没有读到流结束时, 按ctx的错误结束. grpc.Peer选项此时可能正由grpc的协程填充,
+// 所以从流的context中取对端地址
+func (s *clientStream) watch(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		p, ok := peer.FromContext(s.ClientStream.Context())
+		if !ok {
+			p = &peer.Peer{}
+		}
+		s.end(status.FromContextError(ctx.Err()).Err(), p)
+	case <-s.done:
+	}
+}
+
+func (s *clientStream) finish(err error) {
+	s.end(err, s.peer)
+}
+
+func (s *clientStream) end(err error, p *peer.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return
+	}
+	s.finished = true
+	close(s.done)
+	s.call.setPeer(p)
+	s.conf.finish(s.call, err, true)
+}
@@ -0,0 +1,217 @@
+package loggrpc
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/terryliu/log/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type testServer struct {
+	testpb.UnimplementedTestServiceServer
+}
+
+// UnaryCall 请求中有ResponseStatus时返回该状态码
+func (testServer) UnaryCall(ctx context.Context, req *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	if st := req.GetResponseStatus(); st != nil {
+		return nil, status.Error(codes.Code(st.Code), st.Message)
+	}
+	return &testpb.SimpleResponse{}, nil
+}
+
+func (testServer) StreamingOutputCall(req *testpb.StreamingOutputCallRequest, stream testpb.TestService_StreamingOutputCallServer) error {
+	for range req.ResponseParameters {
+		if err := stream.Send(&testpb.StreamingOutputCallResponse{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (testServer) StreamingInputCall(stream testpb.TestService_StreamingInputCallServer) error {
+	for {
+		if _, err := stream.Recv(); err == io.EOF {
+			return stream.SendAndClose(&testpb.StreamingInputCallResponse{})
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (testServer) FullDuplexCall(stream testpb.TestService_FullDuplexCallServer) error {
+	for {
+		if _, err := stream.Recv(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := stream.Send(&testpb.StreamingOutputCallResponse{}); err != nil {
+			return err
+		}
+	}
+}
+
+// clientInterceptors 客户端的拦截器
+var clientInterceptors = []grpc.DialOption{
+	grpc.WithUnaryInterceptor(UnaryClientInterceptor()),
+	grpc.WithStreamInterceptor(StreamClientInterceptor()),
+}
+
+// startTest 启动bufconn上的测试服务和客户端, 日志写在临时目录中
+func startTest(t *testing.T, serverOpts []grpc.ServerOption, dialOpts []grpc.DialOption, logOpts ...log.LogOption) (testpb.TestServiceClient, string) {
+	dir, err := ioutil.TempDir("", "loggrpc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Init(filepath.Join(dir, "app.log"), log.InfoLevel, true, false, logOpts...)
+
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer(serverOpts...)
+	testpb.RegisterTestServiceServer(s, testServer{})
+	go s.Serve(lis)
+
+	conn, err := grpc.Dial("bufnet", append([]grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithInsecure(),
+	}, dialOpts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		s.Stop()
+		log.Close()
+		os.RemoveAll(dir)
+	})
+	return testpb.NewTestServiceClient(conn), dir
+}
+
+// waitOutbound 等待method的Outbound日志, 返回这一行
+func waitOutbound(t *testing.T, dir, method string) string {
+	t.Helper()
+	return waitLog(t, filepath.Join(dir, "app.log.Outbound*"), method)
+}
+
+// waitLog 等待文件名匹配pattern的日志中出现包含s的一行, 返回这一行
+func waitLog(t *testing.T, pattern, s string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		log.Sync()
+		files, _ := filepath.Glob(pattern)
+		for _, file := range files {
+			data, _ := ioutil.ReadFile(file)
+			for _, line := range strings.Split(string(data), "\n") {
+				if strings.Contains(line, s) {
+					return line
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no log containing %s in %s", s, pattern)
+	return ""
+}
+
+// checkFields 检查日志行中包含所有的字段
+func checkFields(t *testing.T, line string, fields ...string) {
+	t.Helper()
+	for _, f := range fields {
+		if !strings.Contains(line, `"`+f+`"`) {
+			t.Errorf("missing %s in %s", f, line)
+		}
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	client, dir := startTest(t, nil, clientInterceptors)
+	ctx := context.Background()
+
+	if _, err := client.UnaryCall(ctx, &testpb.SimpleRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	checkFields(t, waitOutbound(t, dir, "/grpc.testing.TestService/UnaryCall"),
+		"grpc_code:OK", "msgs_in:1", "msgs_out:1", "stream:false")
+
+	in, err := client.StreamingInputCall(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := in.Send(&testpb.StreamingInputCallRequest{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := in.CloseAndRecv(); err != nil {
+		t.Fatal(err)
+	}
+	checkFields(t, waitOutbound(t, dir, "/grpc.testing.TestService/StreamingInputCall"),
+		"grpc_code:OK", "msgs_in:1", "msgs_out:3", "stream:true")
+
+	out, err := client.StreamingOutputCall(ctx, &testpb.StreamingOutputCallRequest{
+		ResponseParameters: []*testpb.ResponseParameters{{}, {}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := out.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkFields(t, waitOutbound(t, dir, "/grpc.testing.TestService/StreamingOutputCall"),
+		"grpc_code:OK", "msgs_in:2", "msgs_out:1", "stream:true")
+
+	bidi, err := client.FullDuplexCall(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := bidi.Send(&testpb.StreamingOutputCallRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bidi.Recv(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bidi.CloseSend()
+	if _, err := bidi.Recv(); err != io.EOF {
+		t.Fatalf("Recv after CloseSend = %v, want io.EOF", err)
+	}
+	checkFields(t, waitOutbound(t, dir, "/grpc.testing.TestService/FullDuplexCall"),
+		"grpc_code:OK", "msgs_in:2", "msgs_out:2", "stream:true")
+}
+
+func TestClientInterceptorBidiCanceled(t *testing.T) {
+	client, dir := startTest(t, nil, clientInterceptors)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream, err := client.FullDuplexCall(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&testpb.StreamingOutputCallRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	// 调用方放弃了流, 没有读到流结束
+	cancel()
+	checkFields(t, waitOutbound(t, dir, "/grpc.testing.TestService/FullDuplexCall"),
+		"grpc_code:Canceled", "msgs_in:1", "msgs_out:1")
+}
@@ -0,0 +1,108 @@
+package loggrpc
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/terryliu/log/v2"
+	"google.golang.org/grpc/grpclog"
+)
+
+// gRPC内部日志的标记, 可以用来过滤, 或者通过AddSink等方式单独处理
+const (
+	KeyComponent  = "component"
+	ComponentGRPC = "grpc"
+)
+
+// loggerV2 把gRPC的内部日志写入主日志, 按级别选择文件的方式与log.Info等函数一致
+type loggerV2 struct {
+	verbosity int
+}
+
+// NewLoggerV2 返回写入本包日志的grpclog.LoggerV2, 需要在log.Init之后, 创建gRPC的服务端或客户端之前设置.
+// verbosity为gRPC日志的详细程度, 对应GRPC_GO_LOG_VERBOSITY_LEVEL, V(l)在l不大于verbosity时返回true.
+// Fatal级别的日志写入并Sync之后退出程序. 使用方法: grpclog.SetLoggerV2(loggrpc.NewLoggerV2(0))
+func NewLoggerV2(verbosity int) grpclog.LoggerV2 {
+	return &loggerV2{verbosity: verbosity}
+}
+
+// 非Depth的方法由grpclog.Info等函数调用, depth为2时记录的是调用grpclog.Info的位置.
+// Depth的方法由gRPC的内部函数调用, depth是相对于该内部函数的调用方, 所以要再加上2层
+
+func (l *loggerV2) Info(args ...interface{}) {
+	log.LogDepth(2, log.InfoLevel, fmt.Sprint(args...), KeyComponent, ComponentGRPC)
+}
+
+func (l *loggerV2) Infoln(args ...interface{}) {
+	log.LogDepth(2, log.InfoLevel, sprintln(args), KeyComponent, ComponentGRPC)
+}
+
+func (l *loggerV2) Infof(format string, args ...interface{}) {
+	log.LogDepth(2, log.InfoLevel, fmt.Sprintf(format, args...), KeyComponent, ComponentGRPC)
+}
+
+func (l *loggerV2) InfoDepth(depth int, args ...interface{}) {
+	log.LogDepth(depth+2, log.InfoLevel, fmt.Sprint(args...), KeyComponent, ComponentGRPC)
+}
+
+func (l *loggerV2) Warning(args ...interface{}) {
+	log.LogDepth(2, log.WarnLevel, fmt.Sprint(args...), KeyComponent, ComponentGRPC)
+}
+
+func (l *loggerV2) Warningln(args ...interface{}) {
+	log.LogDepth(2, log.WarnLevel, sprintln(args), KeyComponent, ComponentGRPC)
+}
+
+func (l *loggerV2) Warningf(format string, args ...interface{}) {
+	log.LogDepth(2, log.WarnLevel, fmt.Sprintf(format, args...), KeyComponent, ComponentGRPC)
+}
+
+func (l *loggerV2) WarningDepth(depth int, args ...interface{}) {
+	log.LogDepth(depth+2, log.WarnLevel, fmt.Sprint(args...), KeyComponent, ComponentGRPC)
+}
+
+func (l *loggerV2) Error(args ...interface{}) {
+	log.LogDepth(2, log.ErrorLevel, fmt.Sprint(args...), KeyComponent, ComponentGRPC)
+}
+
+func (l *loggerV2) Errorln(args ...interface{}) {
+	log.LogDepth(2, log.ErrorLevel, sprintln(args), KeyComponent, ComponentGRPC)
+}
+
+func (l *loggerV2) Errorf(format string, args ...interface{}) {
+	log.LogDepth(2, log.ErrorLevel, fmt.Sprintf(format, args...), KeyComponent, ComponentGRPC)
+}
+
+func (l *loggerV2) ErrorDepth(depth int, args ...interface{}) {
+	log.LogDepth(depth+2, log.ErrorLevel, fmt.Sprint(args...), KeyComponent, ComponentGRPC)
+}
+
+func (l *loggerV2) Fatal(args ...interface{}) {
+	log.LogDepth(2, log.FatalLevel, fmt.Sprint(args...), KeyComponent, ComponentGRPC)
+	os.Exit(1)
+}
+
+func (l *loggerV2) Fatalln(args ...interface{}) {
+	log.LogDepth(2, log.FatalLevel, sprintln(args), KeyComponent, ComponentGRPC)
+	os.Exit(1)
+}
+
+func (l *loggerV2) Fatalf(format string, args ...interface{}) {
+	log.LogDepth(2, log.FatalLevel, fmt.Sprintf(format, args...), KeyComponent, ComponentGRPC)
+	os.Exit(1)
+}
+
+func (l *loggerV2) FatalDepth(depth int, args ...interface{}) {
+	log.LogDepth(depth+2, log.FatalLevel, fmt.Sprint(args...), KeyComponent, ComponentGRPC)
+	os.Exit(1)
+}
+
+func (l *loggerV2) V(level int) bool {
+	return level <= l.verbosity
+}
+
+// sprintln 与fmt.Sprintln相同, 但去掉末尾的换行
+func sprintln(args []interface{}) string {
+	s := fmt.Sprintln(args...)
+	return s[:len(s)-1]
+}
@@ -0,0 +1,63 @@
+package loggrpc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/terryliu/log/v2"
+	"google.golang.org/grpc/grpclog"
+)
+
+// line 返回调用方的行号
+func line() int {
+	_, _, l, _ := runtime.Caller(1)
+	return l
+}
+
+func TestLoggerV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "loggrpc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	log.Init(path, log.InfoLevel, false, false, log.SetCaller(true))
+	defer log.Close()
+	grpclog.SetLoggerV2(NewLoggerV2(0))
+	defer grpclog.SetLoggerV2(grpclog.NewLoggerV2(ioutil.Discard, ioutil.Discard, ioutil.Discard))
+
+	// grpclog.Info等函数直接调用Info
+	grpclog.Warningf("grpclog %s", "warning")
+	warnCaller := fmt.Sprintf("grpclog_test.go:%d", line()-1)
+	// gRPC内部通过Component调用InfoDepth, depth是相对于内部函数的
+	grpclog.Component("transport").Info("component info")
+	infoCaller := fmt.Sprintf("grpclog_test.go:%d", line()-1)
+
+	for msg, want := range map[string]string{
+		"grpclog warning": `"level":"warn"`,
+		"component info":  `"level":"info"`,
+	} {
+		line := waitLog(t, path, msg)
+		for _, s := range []string{want, `"component":"grpc"`} {
+			if !strings.Contains(line, s) {
+				t.Errorf("missing %s in %s", s, line)
+			}
+		}
+	}
+	if line := waitLog(t, path, "grpclog warning"); !strings.Contains(line, warnCaller+`"`) {
+		t.Errorf("caller is not %s: %s", warnCaller, line)
+	}
+	if line := waitLog(t, path, "component info"); !strings.Contains(line, infoCaller+`"`) {
+		t.Errorf("caller is not %s: %s", infoCaller, line)
+	}
+
+	l2 := NewLoggerV2(1)
+	if !l2.V(1) || l2.V(2) {
+		t.Error("V does not follow the verbosity")
+	}
+}
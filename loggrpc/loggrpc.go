@@ -0,0 +1,246 @@
+// Package loggrpc 提供gRPC的请求日志拦截器, 服务端的请求写入Request日志, 客户端的请求写入Outbound日志,
+// 字段与log.HTTPMiddleware和log.Transport一致. status字段为gRPC状态码对应的HTTP状态码(见HTTPStatus),
+// 所以log.SetStatusSampling等按HTTP状态码的配置同样适用, gRPC状态码写在grpc_code字段中. 使用方法:
+//
+//	s := grpc.NewServer(
+//		grpc.UnaryInterceptor(loggrpc.UnaryServerInterceptor()),
+//		grpc.StreamInterceptor(loggrpc.StreamServerInterceptor()),
+//	)
+//	conn, err := grpc.Dial(addr,
+//		grpc.WithUnaryInterceptor(loggrpc.UnaryClientInterceptor()),
+//		grpc.WithStreamInterceptor(loggrpc.StreamClientInterceptor()),
+//	)
+package loggrpc
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/terryliu/log/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultRequestIDKey 默认传递请求ID的metadata键
+const DefaultRequestIDKey = "x-request-id"
+
+// 请求日志中gRPC特有的字段, 写在RequestEntry.Extras中
+const (
+	KeyCode     = "grpc_code"
+	KeyError    = "error"
+	KeyMsgsIn   = "msgs_in"
+	KeyMsgsOut  = "msgs_out"
+	KeyStream   = "stream"
+	requestVerb = "GRPC"
+)
+
+// 默认在主日志中以warn和error级别记录的状态码
+var (
+	DefaultWarnCodes  = []codes.Code{codes.DeadlineExceeded, codes.ResourceExhausted, codes.Unavailable}
+	DefaultErrorCodes = []codes.Code{codes.Unknown, codes.Internal, codes.DataLoss}
+)
+
+type config struct {
+	requestIDKey string
+	levels       map[codes.Code]string
+	skips        map[string]bool
+}
+
+type Option interface {
+	apply(*config)
+}
+
+type optionFunc func(*config)
+
+func (f optionFunc) apply(c *config) {
+	f(c)
+}
+
+// WithRequestIDKey 设置传递请求ID的metadata键, 默认为x-request-id
+func WithRequestIDKey(key string) Option {
+	return optionFunc(func(c *config) {
+		c.requestIDKey = strings.ToLower(key)
+	})
+}
+
+// WithWarnCodes 返回这些状态码的请求除了请求日志外, 还会以warn级别写入主日志. 会替换DefaultWarnCodes
+func WithWarnCodes(cs ...codes.Code) Option {
+	return optionFunc(func(c *config) {
+		c.setLevel(log.WarnLevel, cs)
+	})
+}
+
+// WithErrorCodes 返回这些状态码的请求除了请求日志外, 还会以error级别写入主日志. 会替换DefaultErrorCodes
+func WithErrorCodes(cs ...codes.Code) Option {
+	return optionFunc(func(c *config) {
+		c.setLevel(log.ErrorLevel, cs)
+	})
+}
+
+// WithSkipMethods 不记录这些方法的请求, 方法为完整的方法名, 如/grpc.health.v1.Health/Check
+func WithSkipMethods(methods ...string) Option {
+	return optionFunc(func(c *config) {
+		for _, m := range methods {
+			c.skips[m] = true
+		}
+	})
+}
+
+func (c *config) setLevel(level string, cs []codes.Code) {
+	for code, l := range c.levels {
+		if l == level {
+			delete(c.levels, code)
+		}
+	}
+	for _, code := range cs {
+		c.levels[code] = level
+	}
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		requestIDKey: DefaultRequestIDKey,
+		levels:       make(map[codes.Code]string),
+		skips:        make(map[string]bool),
+	}
+	c.setLevel(log.WarnLevel, DefaultWarnCodes)
+	c.setLevel(log.ErrorLevel, DefaultErrorCodes)
+	for _, opt := range opts {
+		opt.apply(c)
+	}
+	return c
+}
+
+// call 一次gRPC调用的统计
+type call struct {
+	ctx       context.Context // 调用的context, 用于关联OpenTelemetry的trace
+	method    string
+	start     time.Time
+	peer      string
+	requestID string
+	stream    bool
+	bytesIn   int64
+	bytesOut  int64
+	msgsIn    int64
+	msgsOut   int64
+}
+
+func (c *call) recv(m interface{}) {
+	c.msgsIn++
+	c.bytesIn += messageSize(m)
+}
+
+func (c *call) send(m interface{}) {
+	c.msgsOut++
+	c.bytesOut += messageSize(m)
+}
+
+// messageSize 返回protobuf消息序列化后的大小, 不是protobuf消息时返回0
+func messageSize(m interface{}) int64 {
+	if pm, ok := m.(proto.Message); ok {
+		return int64(proto.Size(pm))
+	}
+	return 0
+}
+
+// finish 写请求日志, 状态码在配置的级别中时再写一条主日志
+func (c *config) finish(cl *call, err error, outbound bool) {
+	st := status.Convert(err)
+	entry := log.RequestEntry{
+		Method:    requestVerb,
+		Path:      cl.method,
+		Status:    HTTPStatus(st.Code()),
+		Latency:   time.Since(cl.start),
+		ClientIP:  cl.peer,
+		RequestID: cl.requestID,
+		BytesIn:   cl.bytesIn,
+		BytesOut:  cl.bytesOut,
+		Extras: map[string]interface{}{
+			KeyCode:    st.Code().String(),
+			KeyMsgsIn:  cl.msgsIn,
+			KeyMsgsOut: cl.msgsOut,
+			KeyStream:  cl.stream,
+		},
+	}
+	if err != nil {
+		entry.Extras[KeyError] = st.Message()
+	}
+	if outbound {
+		log.LogOutboundContext(cl.ctx, entry)
+	} else {
+		log.LogRequestContext(cl.ctx, entry)
+	}
+
+	level, ok := c.levels[st.Code()]
+	if !ok {
+		return
+	}
+	msg := "grpc call failed: " + cl.method
+	kvs := []interface{}{
+		KeyCode, st.Code().String(),
+		KeyError, st.Message(),
+		log.RequestKeyLatency, float64(entry.Latency) / float64(time.Millisecond),
+		log.RequestKeyClientIP, cl.peer,
+		log.RequestKeyRequestID, cl.requestID,
+	}
+	if level == log.ErrorLevel {
+		log.Ctx(cl.ctx).Errorw(msg, kvs...)
+	} else {
+		log.Ctx(cl.ctx).Warnw(msg, kvs...)
+	}
+}
+
+// HTTPStatus 返回gRPC状态码对应的HTTP状态码, 与grpc-gateway的映射一致
+func HTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // Client Closed Request
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// metadataValue 取metadata中key的第一个值
+func metadataValue(md metadata.MD, key string) string {
+	if vs := md.Get(key); len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// outgoingRequestID 取context中的请求ID, 并写入发出请求的metadata
+func (c *config) outgoingRequestID(ctx context.Context) (context.Context, string) {
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		if id := metadataValue(md, c.requestIDKey); id != "" {
+			return ctx, id
+		}
+	}
+	id := log.RequestIDFromContext(ctx)
+	if id != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, c.requestIDKey, id)
+	}
+	return ctx, id
+}
@@ -0,0 +1,90 @@
+package loggrpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/terryliu/log/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// UnaryServerInterceptor 记录服务端的一元调用
+func UnaryServerInterceptor(opts ...Option) grpc.UnaryServerInterceptor {
+	c := newConfig(opts)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if c.skips[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		ctx, cl := c.serverCall(ctx, info.FullMethod, false)
+		cl.recv(req)
+		resp, err := handler(ctx, req)
+		if err == nil {
+			cl.send(resp)
+		}
+		c.finish(cl, err, false)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor 记录服务端的流式调用, 在流结束时写一条日志
+func StreamServerInterceptor(opts ...Option) grpc.StreamServerInterceptor {
+	c := newConfig(opts)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if c.skips[info.FullMethod] {
+			return handler(srv, ss)
+		}
+		ctx, cl := c.serverCall(ss.Context(), info.FullMethod, true)
+		err := handler(srv, &serverStream{ServerStream: ss, ctx: ctx, call: cl})
+		c.finish(cl, err, false)
+		return err
+	}
+}
+
+// serverCall 从metadata中取请求ID, 没有时生成一个, 并保存到context中供log.RequestIDFromContext使用
+func (c *config) serverCall(ctx context.Context, method string, stream bool) (context.Context, *call) {
+	cl := &call{method: method, start: time.Now(), stream: stream}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		cl.peer = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		cl.requestID = metadataValue(md, c.requestIDKey)
+	}
+	if cl.requestID == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err == nil {
+			cl.requestID = hex.EncodeToString(b)
+		}
+	}
+	cl.ctx = log.ContextWithRequestID(ctx, cl.requestID)
+	return cl.ctx, cl
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	call *call
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.call.send(m)
+	}
+	return err
+}
+
+func (s *serverStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.call.recv(m)
+	}
+	return err
+}
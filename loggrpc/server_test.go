@@ -0,0 +1,167 @@
+package loggrpc
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/terryliu/log/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// startServerTest 启动带服务端拦截器的测试服务
+func startServerTest(t *testing.T, opts []Option, logOpts ...log.LogOption) (testpb.TestServiceClient, string) {
+	t.Helper()
+	return startTest(t, []grpc.ServerOption{
+		grpc.UnaryInterceptor(UnaryServerInterceptor(opts...)),
+		grpc.StreamInterceptor(StreamServerInterceptor(opts...)),
+	}, nil, logOpts...)
+}
+
+// waitRequest 等待包含s的Request日志, 返回这一行
+func waitRequest(t *testing.T, dir, s string) string {
+	t.Helper()
+	return waitLog(t, filepath.Join(dir, "app.log.Request*"), s)
+}
+
+// callStatus 发起一次返回code的一元调用
+func callStatus(t *testing.T, client testpb.TestServiceClient, code codes.Code, msg string) {
+	t.Helper()
+	_, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{
+		ResponseStatus: &testpb.EchoStatus{Code: int32(code), Message: msg},
+	})
+	if status.Code(err) != code {
+		t.Fatalf("UnaryCall = %v, want %v", err, code)
+	}
+}
+
+func TestServerInterceptors(t *testing.T) {
+	client, dir := startServerTest(t, nil)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), DefaultRequestIDKey, "r-1")
+
+	if _, err := client.UnaryCall(ctx, &testpb.SimpleRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	checkFields(t, waitRequest(t, dir, "/grpc.testing.TestService/UnaryCall"),
+		"method:GRPC", "status:200", "grpc_code:OK", "request_id:r-1", "msgs_in:1", "msgs_out:1", "stream:false")
+
+	out, err := client.StreamingOutputCall(ctx, &testpb.StreamingOutputCallRequest{
+		ResponseParameters: []*testpb.ResponseParameters{{}, {}, {}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := out.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkFields(t, waitRequest(t, dir, "/grpc.testing.TestService/StreamingOutputCall"),
+		"status:200", "grpc_code:OK", "msgs_in:1", "msgs_out:3", "stream:true")
+}
+
+func TestServerStatus(t *testing.T) {
+	client, dir := startServerTest(t, nil)
+	callStatus(t, client, codes.NotFound, "no such user")
+	checkFields(t, waitRequest(t, dir, "no such user"), "status:404", "grpc_code:NotFound", "error:no such user")
+	callStatus(t, client, codes.Unavailable, "overloaded")
+	checkFields(t, waitRequest(t, dir, "overloaded"), "status:503", "grpc_code:Unavailable")
+}
+
+func TestServerStatusSampling(t *testing.T) {
+	// status是HTTP状态码, 所以按状态码类别采样也适用于gRPC请求
+	client, dir := startServerTest(t, nil,
+		log.SetStatusSampling(log.FileTypeRequest, log.RequestKeyStatus, map[int]float64{2: 0}))
+	for i := 0; i < 3; i++ {
+		if _, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	callStatus(t, client, codes.InvalidArgument, "bad request")
+	waitRequest(t, dir, "bad request")
+	if line := waitRequest(t, dir, "/grpc.testing.TestService/UnaryCall"); !strings.Contains(line, "bad request") {
+		t.Fatalf("successful call is not sampled out: %s", line)
+	}
+}
+
+func TestServerLevels(t *testing.T) {
+	client, dir := startServerTest(t, nil)
+	main := filepath.Join(dir, "app.log")
+	callStatus(t, client, codes.Unavailable, "default warn")
+	callStatus(t, client, codes.Internal, "default error")
+	callStatus(t, client, codes.NotFound, "not logged")
+	callStatus(t, client, codes.Canceled, "last")
+
+	if line := waitLog(t, main, "default warn"); !strings.Contains(line, `"level":"warn"`) {
+		t.Errorf("Unavailable: %s", line)
+	}
+	if line := waitLog(t, main, "default error"); !strings.Contains(line, `"level":"error"`) {
+		t.Errorf("Internal: %s", line)
+	}
+	waitRequest(t, dir, "last")
+	log.Sync()
+	if lines := readMain(t, main, "not logged"); len(lines) != 0 {
+		t.Errorf("NotFound is written to the main log: %v", lines)
+	}
+}
+
+func TestServerLevelOptions(t *testing.T) {
+	// WithWarnCodes和WithErrorCodes替换默认的状态码
+	client, dir := startServerTest(t, []Option{WithWarnCodes(codes.NotFound), WithErrorCodes(codes.Unavailable)})
+	main := filepath.Join(dir, "app.log")
+	callStatus(t, client, codes.NotFound, "custom warn")
+	callStatus(t, client, codes.Unavailable, "custom error")
+	callStatus(t, client, codes.Internal, "no longer error")
+
+	if line := waitLog(t, main, "custom warn"); !strings.Contains(line, `"level":"warn"`) {
+		t.Errorf("NotFound: %s", line)
+	}
+	if line := waitLog(t, main, "custom error"); !strings.Contains(line, `"level":"error"`) {
+		t.Errorf("Unavailable: %s", line)
+	}
+	waitRequest(t, dir, "no longer error")
+	if lines := readMain(t, main, "no longer error"); len(lines) != 0 {
+		t.Errorf("Internal is written to the main log: %v", lines)
+	}
+}
+
+func TestServerSkipMethods(t *testing.T) {
+	client, dir := startServerTest(t, []Option{WithSkipMethods("/grpc.testing.TestService/UnaryCall")})
+	if _, err := client.UnaryCall(context.Background(), &testpb.SimpleRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	in, err := client.StreamingInputCall(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.CloseAndRecv(); err != nil {
+		t.Fatal(err)
+	}
+	waitRequest(t, dir, "/grpc.testing.TestService/StreamingInputCall")
+	if lines := readMain(t, filepath.Join(dir, "app.log.Request.csv"), "UnaryCall"); len(lines) != 0 {
+		t.Errorf("skipped method is logged: %v", lines)
+	}
+}
+
+// readMain 返回文件中包含s的行, 文件不存在时返回nil
+func readMain(t *testing.T, file, s string) []string {
+	t.Helper()
+	log.Sync()
+	data, _ := ioutil.ReadFile(file)
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.Contains(line, s) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,120 @@
+package log
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// LogrKeyName logr的名字(WithName)在日志中的键, 多次WithName的名字用.连接
+const LogrKeyName = "logger"
+
+// logrSink 把logr的日志写入本包的日志文件, 按级别选择文件的方式与Debug,Info等函数一致.
+// V(0)到V(maxInfoV)按info级别记录, 更大的V级别按debug级别记录, Error按error级别记录
+type logrSink struct {
+	maxInfoV  int
+	callDepth int
+	name      string
+	values    []zapcore.Field
+}
+
+// NewLogrSink 返回写入本包日志的logr.LogSink, 需要在Init之后使用.
+// maxInfoV为按info级别记录的最大V级别, 比如为0时只有V(0)是info, V(1)及以上都是debug
+func NewLogrSink(maxInfoV int) logr.LogSink {
+	return &logrSink{maxInfoV: maxInfoV}
+}
+
+// NewLogr 返回写入本包日志的logr.Logger, 参数见NewLogrSink.
+// 使用方法: ctrl.SetLogger(log.NewLogr(0))
+func NewLogr(maxInfoV int) logr.Logger {
+	return logr.New(NewLogrSink(maxInfoV))
+}
+
+func (s *logrSink) Init(info logr.RuntimeInfo) {
+	s.callDepth += info.CallDepth
+}
+
+// level 将logr的V级别转换为zap的级别
+func (s *logrSink) level(v int) zapcore.Level {
+	if v <= s.maxInfoV {
+		return zapcore.InfoLevel
+	}
+	return zapcore.DebugLevel
+}
+
+func (s *logrSink) Enabled(v int) bool {
+	if logger == nil {
+		return false
+	}
+	level := s.level(v)
+	return levelAdapter(level).enabled(level)
+}
+
+func (s *logrSink) Info(v int, msg string, keysAndValues ...interface{}) {
+	if logger == nil {
+		return
+	}
+	s.write(s.level(v), msg, nil, keysAndValues)
+}
+
+func (s *logrSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	if logger == nil {
+		return
+	}
+	s.write(zapcore.ErrorLevel, msg, err, keysAndValues)
+}
+
+func (s *logrSink) write(level zapcore.Level, msg string, err error, keysAndValues []interface{}) {
+	fields := make([]zapcore.Field, 0, len(s.values)+len(keysAndValues)/2+2)
+	if s.name != "" {
+		fields = append(fields, zap.String(LogrKeyName, s.name))
+	}
+	fields = append(fields, s.values...)
+	fields = append(fields, logrFields(keysAndValues)...)
+	if err != nil {
+		fields = append(fields, zap.String("error", err.Error()))
+	}
+	// 跳过write, Info/Error和logr库自身的调用
+	caller := callerAt(2 + s.callDepth)
+	levelAdapter(level).logEntry(level, time.Time{}, caller, msg, fields...)
+}
+
+func (s *logrSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	clone := *s
+	clone.values = append(append([]zapcore.Field(nil), s.values...), logrFields(keysAndValues)...)
+	return &clone
+}
+
+func (s *logrSink) WithName(name string) logr.LogSink {
+	clone := *s
+	if clone.name == "" {
+		clone.name = name
+	} else {
+		clone.name = strings.Join([]string{s.name, name}, ".")
+	}
+	return &clone
+}
+
+func (s *logrSink) WithCallDepth(depth int) logr.LogSink {
+	clone := *s
+	clone.callDepth += depth
+	return &clone
+}
+
+// logrFields 将logr的键值对转换为zap的字段, 实现了logr.Marshaler的值按MarshalLog的结果记录
+func logrFields(keysAndValues []interface{}) []zapcore.Field {
+	kv := keysAndValues
+	for i := 1; i < len(kv); i += 2 {
+		if m, ok := kv[i].(logr.Marshaler); ok {
+			if &kv[0] == &keysAndValues[0] {
+				// 不修改调用方的切片
+				kv = append([]interface{}(nil), keysAndValues...)
+			}
+			kv[i] = m.MarshalLog()
+		}
+	}
+	return kvFields(kv)
+}
@@ -0,0 +1,101 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// logrUser 实现了logr.Marshaler
+type logrUser struct {
+	ID     int
+	Secret string
+}
+
+func (u logrUser) MarshalLog() interface{} {
+	return map[string]int{"id": u.ID}
+}
+
+func TestLogrLevels(t *testing.T) {
+	dir := tempDir(t)
+	Init(filepath.Join(dir, "app.log"), InfoLevel, false, false)
+	if l := NewLogr(1); !l.V(1).Enabled() || l.V(2).Enabled() {
+		t.Fatal("V(2) is enabled at info level with maxInfoV 1")
+	}
+	logger.close()
+
+	Init(filepath.Join(dir, "app.log"), DebugLevel, false, true)
+	defer func() { logger.close(); logger = nil }()
+	l := NewLogr(1)
+	l.V(0).Info("logr v0")
+	l.V(1).Info("logr v1")
+	l.V(2).Info("logr v2")
+	l.Error(errors.New("boom"), "logr error", "k", "v")
+
+	for file, msgs := range map[string][]string{
+		"app.log.INFO":  {"logr v0", "logr v1"},
+		"app.log.DEBUG": {"logr v2"},
+		"app.log.ERROR": {"logr error"},
+	} {
+		lines := readLines(t, filepath.Join(dir, file), "logr")
+		if len(lines) != len(msgs) {
+			t.Fatalf("%s: %v, want %v", file, lines, msgs)
+		}
+		for i, msg := range msgs {
+			if !strings.Contains(lines[i], `"msg":"`+msg+`"`) {
+				t.Errorf("%s: %s, want %s", file, lines[i], msg)
+			}
+		}
+	}
+	line := readLines(t, filepath.Join(dir, "app.log.ERROR"), "logr error")[0]
+	if !strings.Contains(line, `"k":"v"`) || !strings.Contains(line, `"error":"boom"`) {
+		t.Errorf("error entry: %s", line)
+	}
+}
+
+func TestLogrNameValues(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "app.log")
+	Init(path, InfoLevel, false, false, SetCaller(true))
+	defer func() { logger.close(); logger = nil }()
+
+	base := NewLogr(0).WithName("controller").WithValues("app", "demo")
+	l := base.WithName("reconciler").WithValues("user", logrUser{ID: 7, Secret: "s3cret"})
+	l.Info("logr named", "odd")
+	want := fmt.Sprintf(`logr_test.go:%d"`, line()-1)
+	base.Info("logr base")
+
+	got := readLines(t, path, "logr named")[0]
+	for _, s := range []string{`"logger":"controller.reconciler"`, `"app":"demo"`, `"user":{"id":7}`, `"odd":"<no-value>"`, want} {
+		if !strings.Contains(got, s) {
+			t.Errorf("missing %s in %s", s, got)
+		}
+	}
+	if strings.Contains(got, "s3cret") {
+		t.Errorf("MarshalLog is not used: %s", got)
+	}
+	// WithName和WithValues不影响原来的Logger
+	got = readLines(t, path, "logr base")[0]
+	if !strings.Contains(got, `"logger":"controller"`) || strings.Contains(got, `"user"`) {
+		t.Errorf("base logger changed: %s", got)
+	}
+}
+
+func TestLogrCallDepth(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "app.log")
+	Init(path, InfoLevel, false, false, SetCaller(true))
+	defer func() { logger.close(); logger = nil }()
+
+	// 封装logr的函数用WithCallDepth跳过自己
+	helper := func(msg string) {
+		NewLogr(0).WithCallDepth(1).Info(msg)
+	}
+	helper("logr helper")
+	want := fmt.Sprintf(`logr_test.go:%d"`, line()-1)
+	if got := readLines(t, path, "logr helper")[0]; !strings.Contains(got, want) {
+		t.Errorf("caller is not %s: %s", want, got)
+	}
+}
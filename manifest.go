@@ -0,0 +1,353 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestSuffix 清单文件名为日志文件名加上该后缀, 如/home/log/app.log.manifest
+const manifestSuffix = ".manifest"
+
+// ManifestArchive 清单中一个备份文件的信息. Name不含lumberjack压缩后的.gz后缀,
+// SHA256和Size按解压后的内容计算, 所以备份文件压缩前后都能校验.
+type ManifestArchive struct {
+	Name    string `json:"name"`
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+	First   string `json:"first_ts,omitempty"`
+	Last    string `json:"last_ts,omitempty"`
+	Entries int64  `json:"entries"`
+}
+
+// Manifest 一个日志文件所有备份文件的清单, 每次切割后重新生成
+type Manifest struct {
+	File     string            `json:"file"`
+	Created  time.Time         `json:"created"`
+	Archives []ManifestArchive `json:"archives"`
+}
+
+// signedManifest 清单文件的内容, Signature是对Manifest紧凑格式json的ed25519签名, PublicKey为签名用的公钥
+type signedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+	PublicKey string          `json:"public_key,omitempty"`
+}
+
+// manifestWriter 在切割后生成签名的清单. 已经统计过的备份文件不会再重复计算
+type manifestWriter struct {
+	mu    sync.Mutex
+	wg    sync.WaitGroup
+	path  string
+	key   ed25519.PrivateKey
+	keys  KeyProvider
+	known map[string]ManifestArchive
+}
+
+func newManifestWriter(path string, key ed25519.PrivateKey, keys KeyProvider) *manifestWriter {
+	m := &manifestWriter{path: path, key: key, keys: keys, known: make(map[string]ManifestArchive)}
+	// 沿用的统计结果会被重新签名, 所以旧清单的签名必须有效, 否则丢弃旧清单, 重新统计所有备份文件
+	old, err := readManifest(path+manifestSuffix, key.Public().(ed25519.PublicKey))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "log: discard manifest %s: %v\n", path+manifestSuffix, err)
+		}
+		return m
+	}
+	for _, a := range old.Archives {
+		m.known[a.Name] = a
+	}
+	return m
+}
+
+// rotated 由rollingWriter在切割后调用, 统计备份文件需要读取整个文件, 所以放在单独的协程中进行
+func (m *manifestWriter) rotated() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		if err := m.write(); err != nil {
+			fmt.Fprintf(os.Stderr, "log: write manifest for %s: %v\n", m.path, err)
+		}
+	}()
+}
+
+// wait 等待正在生成的清单写完
+func (m *manifestWriter) wait() {
+	m.wg.Wait()
+}
+
+func (m *manifestWriter) write() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files, err := rotationSet(m.path)
+	if err != nil {
+		return err
+	}
+	manifest := Manifest{File: filepath.Base(m.path), Created: time.Now(), Archives: []ManifestArchive{}}
+	known := make(map[string]ManifestArchive)
+	for _, file := range files {
+		if file == m.path {
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(file), compressSuffix)
+		a, ok := m.known[name]
+		if !ok {
+			if a, err = m.archive(file); err != nil {
+				return err
+			}
+		}
+		known[name] = a
+		manifest.Archives = append(manifest.Archives, a)
+	}
+	m.known = known
+	return writeManifest(m.path+manifestSuffix, &manifest, m.key)
+}
+
+// archive 统计一个备份文件: 内容的sha256和大小, 以及日志条数和首尾时间
+func (m *manifestWriter) archive(file string) (ManifestArchive, error) {
+	a := ManifestArchive{Name: strings.TrimSuffix(filepath.Base(file), compressSuffix)}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		// lumberjack刚刚压缩完并删除了原文件
+		file += compressSuffix
+	}
+	sum, size, err := archiveDigest(file)
+	if err != nil {
+		return a, err
+	}
+	a.SHA256, a.Size = sum, size
+
+	r, err := openLog(file, m.keys)
+	if err != nil {
+		return a, err
+	}
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*megabyte)
+	for scanner.Scan() {
+		ts := entryTime(scanner.Bytes())
+		if ts == "" {
+			continue
+		}
+		if a.Entries == 0 {
+			a.First = ts
+		}
+		a.Last = ts
+		a.Entries++
+	}
+	return a, scanner.Err()
+}
+
+// archiveDigest 计算备份文件解压后内容的sha256和大小
+func archiveDigest(file string) (string, int64, error) {
+	r, err := openLogFile(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// entryTime 取出一条日志的时间: json格式为ts字段, csv格式为第二列, 访问日志格式为[]中的时间或者前两列.
+// 不是日志的行(比如文件头和W3C的指令)返回空字符串
+func entryTime(line []byte) string {
+	line = bytes.TrimPrefix(line, utf8BOM)
+	if len(line) == 0 || line[0] == '#' {
+		return ""
+	}
+	if i := bytes.Index(line, []byte(" [")); i >= 0 && line[0] != '"' && line[0] != '{' {
+		if j := bytes.IndexByte(line[i:], ']'); j > 0 {
+			return string(line[i+2 : i+j])
+		}
+	}
+	if line[0] >= '0' && line[0] <= '9' {
+		if parts := bytes.SplitN(line, []byte(" "), 3); len(parts) == 3 {
+			return string(parts[0]) + " " + string(parts[1])
+		}
+	}
+	if line[0] == '{' {
+		var ent struct {
+			TS json.RawMessage `json:"ts"`
+		}
+		if json.Unmarshal(line, &ent) != nil || len(ent.TS) == 0 {
+			return ""
+		}
+		var ts string
+		if json.Unmarshal(ent.TS, &ts) == nil {
+			return ts
+		}
+		return string(ent.TS)
+	}
+	r := csv.NewReader(bytes.NewReader(line))
+	r.LazyQuotes = true
+	record, err := r.Read()
+	if err != nil || len(record) < 2 {
+		return ""
+	}
+	return record[1]
+}
+
+func writeManifest(path string, manifest *Manifest, key ed25519.PrivateKey) error {
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(signedManifest{
+		Manifest:  body,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, body)),
+		PublicKey: base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readSignedManifest(path string) (*signedManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sm signedManifest
+	if err := json.Unmarshal(data, &sm); err != nil {
+		return nil, err
+	}
+	return &sm, nil
+}
+
+// readManifest 读取清单文件并校验签名, 签名由pubs中任意一个公钥验证通过即可
+func readManifest(path string, pubs ...ed25519.PublicKey) (*Manifest, error) {
+	sm, err := readSignedManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := sm.verify(pubs); err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(sm.Manifest, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// Verify 校验dir下所有的清单文件: 签名必须是pub中某个公钥(轮换过签名密钥时传入新旧公钥)对应的私钥签发的,
+// 清单中每个备份文件的sha256和大小都必须一致. 清单中最早的若干备份文件因为保留个数和时间的限制被删除不算错误,
+// 但在现存的备份文件之间缺少文件会返回错误.
+//
+// 不传pub时使用清单文件中记录的公钥, 并要求dir下所有清单使用同一个公钥. 这只能证明备份文件与清单一致:
+// 能修改日志目录的人也可以用新的密钥重新生成所有清单, 所以审计时应当传入事先单独保存的公钥.
+func Verify(dir string, pub ...ed25519.PublicKey) error {
+	manifests, err := filepath.Glob(filepath.Join(dir, "*"+manifestSuffix))
+	if err != nil {
+		return err
+	}
+	if len(manifests) == 0 {
+		return fmt.Errorf("no manifest found in %s", dir)
+	}
+	sort.Strings(manifests)
+	var stored ed25519.PublicKey
+	for _, path := range manifests {
+		keys := pub
+		if len(keys) == 0 {
+			key, err := storedKey(path)
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			if stored != nil && !bytes.Equal(stored, key) {
+				return fmt.Errorf("%s: signed with a different key than %s", path, manifests[0])
+			}
+			stored = key
+			keys = []ed25519.PublicKey{key}
+		}
+		if err := verifyManifest(dir, path, keys); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// storedKey 返回清单文件中记录的公钥
+func storedKey(path string) (ed25519.PublicKey, error) {
+	sm, err := readSignedManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(sm.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("manifest has no valid public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// verify 校验签名. 清单文件是缩进过的, 签名针对的是紧凑格式
+func (sm *signedManifest) verify(pubs []ed25519.PublicKey) error {
+	var body bytes.Buffer
+	if err := json.Compact(&body, sm.Manifest); err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(sm.Signature)
+	if err != nil {
+		return errors.New("invalid signature")
+	}
+	for _, pub := range pubs {
+		if ed25519.Verify(pub, body.Bytes(), sig) {
+			return nil
+		}
+	}
+	return errors.New("invalid signature")
+}
+
+func verifyManifest(dir, path string, pubs []ed25519.PublicKey) error {
+	manifest, err := readManifest(path, pubs...)
+	if err != nil {
+		return err
+	}
+
+	present := false
+	for _, a := range manifest.Archives {
+		file := filepath.Join(dir, a.Name)
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			file += compressSuffix
+		}
+		sum, size, err := archiveDigest(file)
+		if os.IsNotExist(err) {
+			if present {
+				return fmt.Errorf("archive %s is missing", a.Name)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		present = true
+		if sum != a.SHA256 || size != a.Size {
+			return fmt.Errorf("archive %s was modified", a.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package log
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManifestWriterDiscardsForgedManifest(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "app.log")
+	backup := filepath.Join(dir, "app-2020-01-02T03-04-05.000.log")
+	if err := ioutil.WriteFile(backup, []byte(`{"ts":"2020-01-02T03:04:05.000Z","msg":"a"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, key, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+
+	// 用别的密钥签发的清单记录了伪造的哈希
+	forged := &Manifest{File: "app.log", Created: time.Now(), Archives: []ManifestArchive{
+		{Name: filepath.Base(backup), SHA256: "forged", Size: 1, Entries: 1},
+	}}
+	if err := writeManifest(path+manifestSuffix, forged, other); err != nil {
+		t.Fatal(err)
+	}
+	m := newManifestWriter(path, key, nil)
+	if len(m.known) != 0 {
+		t.Fatalf("hashes of a manifest with an invalid signature are reused: %v", m.known)
+	}
+	if err := m.write(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(dir, key.Public().(ed25519.PublicKey)); err != nil {
+		t.Fatalf("re-signed manifest does not verify: %v", err)
+	}
+
+	// 有效的清单沿用其中的统计结果
+	m = newManifestWriter(path, key, nil)
+	if a, ok := m.known[filepath.Base(backup)]; !ok || a.Entries != 1 {
+		t.Fatalf("valid manifest is not reused: %v", m.known)
+	}
+}
+
+// writeArchives 在dir中写入三个备份文件并生成签名的清单, 返回备份文件的路径(从旧到新)
+func writeArchives(t *testing.T, dir string, key ed25519.PrivateKey) []string {
+	t.Helper()
+	var backups []string
+	for i, ts := range []string{"2020-01-02T03-04-05.000", "2020-01-02T03-04-06.000", "2020-01-02T03-04-07.000"} {
+		backup := filepath.Join(dir, "app-"+ts+".log")
+		line := fmt.Sprintf(`{"ts":"2020-01-02T03:04:0%d.000Z","msg":"m%d"}`+"\n", 5+i, i)
+		if err := ioutil.WriteFile(backup, []byte(line), 0644); err != nil {
+			t.Fatal(err)
+		}
+		backups = append(backups, backup)
+	}
+	if err := newManifestWriter(filepath.Join(dir, "app.log"), key, nil).write(); err != nil {
+		t.Fatal(err)
+	}
+	return backups
+}
+
+func TestVerify(t *testing.T) {
+	dir := tempDir(t)
+	pub, key, _ := ed25519.GenerateKey(nil)
+	writeArchives(t, dir, key)
+	if err := Verify(dir, pub); err != nil {
+		t.Fatal(err)
+	}
+	// 不传公钥时使用清单中记录的公钥
+	if err := Verify(dir); err != nil {
+		t.Fatal(err)
+	}
+	other, _, _ := ed25519.GenerateKey(nil)
+	if err := Verify(dir, other); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Fatalf("Verify with another key = %v", err)
+	}
+	// 轮换签名密钥时传入新旧公钥
+	if err := Verify(dir, other, pub); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyTamperedArchive(t *testing.T) {
+	dir := tempDir(t)
+	pub, key, _ := ed25519.GenerateKey(nil)
+	backups := writeArchives(t, dir, key)
+	if err := ioutil.WriteFile(backups[1], []byte(`{"ts":"2020-01-02T03:04:06.000Z","msg":"forged"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(dir, pub); err == nil || !strings.Contains(err.Error(), "was modified") {
+		t.Fatalf("Verify = %v, want a modified archive", err)
+	}
+}
+
+func TestVerifyMissingArchive(t *testing.T) {
+	dir := tempDir(t)
+	pub, key, _ := ed25519.GenerateKey(nil)
+	backups := writeArchives(t, dir, key)
+
+	// 最早的备份文件按保留策略被删除不算错误
+	os.Remove(backups[0])
+	if err := Verify(dir, pub); err != nil {
+		t.Fatalf("Verify after the oldest archive expired: %v", err)
+	}
+	os.Remove(backups[2])
+	if err := Verify(dir, pub); err == nil || !strings.Contains(err.Error(), "is missing") {
+		t.Fatalf("Verify = %v, want a missing archive", err)
+	}
+}
+
+func TestVerifyStoredKeyMismatch(t *testing.T) {
+	dir := tempDir(t)
+	_, key, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+	writeArchives(t, dir, key)
+	forged := &Manifest{File: "other.log", Created: time.Now(), Archives: []ManifestArchive{}}
+	if err := writeManifest(filepath.Join(dir, "other.log"+manifestSuffix), forged, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(dir); err == nil || !strings.Contains(err.Error(), "different key") {
+		t.Fatalf("Verify = %v, want manifests signed with different keys to be rejected", err)
+	}
+}
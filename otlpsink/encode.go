@@ -0,0 +1,242 @@
+package otlpsink
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// 作为InstrumentationScope的名字
+const scopeName = "github.com/terryliu/log/v2"
+
+// OTLP protobuf的字段号, 见opentelemetry-proto中的logs/v1/logs.proto和common/v1/common.proto.
+// 日志的结构很小, 直接按字段号编码, 避免依赖生成的代码和更高版本的protobuf
+const (
+	fieldResourceLogs = 1 // ExportLogsServiceRequest.resource_logs
+
+	fieldResource  = 1 // ResourceLogs.resource
+	fieldScopeLogs = 2 // ResourceLogs.scope_logs
+
+	fieldResourceAttributes = 1 // Resource.attributes
+
+	fieldScope      = 1 // ScopeLogs.scope
+	fieldLogRecords = 2 // ScopeLogs.log_records
+
+	fieldScopeName = 1 // InstrumentationScope.name
+
+	fieldTimeUnixNano         = 1  // LogRecord.time_unix_nano
+	fieldSeverityNumber       = 2  // LogRecord.severity_number
+	fieldSeverityText         = 3  // LogRecord.severity_text
+	fieldBody                 = 5  // LogRecord.body
+	fieldAttributes           = 6  // LogRecord.attributes
+	fieldFlags                = 8  // LogRecord.flags
+	fieldTraceID              = 9  // LogRecord.trace_id
+	fieldSpanID               = 10 // LogRecord.span_id
+	fieldObservedTimeUnixNano = 11 // LogRecord.observed_time_unix_nano
+
+	fieldKey   = 1 // KeyValue.key
+	fieldValue = 2 // KeyValue.value
+
+	fieldStringValue = 1 // AnyValue.string_value
+	fieldBoolValue   = 2 // AnyValue.bool_value
+	fieldIntValue    = 3 // AnyValue.int_value
+	fieldDoubleValue = 4 // AnyValue.double_value
+	fieldArrayValue  = 5 // AnyValue.array_value
+	fieldKvlistValue = 6 // AnyValue.kvlist_value
+
+	fieldValues = 1 // ArrayValue.values, KeyValueList.values
+)
+
+// marshalProto 编码为ExportLogsServiceRequest
+func marshalProto(resource []keyValue, records []logRecord) []byte {
+	var res []byte
+	for _, kv := range resource {
+		res = appendMessage(res, fieldResourceAttributes, appendKeyValue(nil, kv))
+	}
+
+	var scopeLogs []byte
+	scopeLogs = appendMessage(scopeLogs, fieldScope, protowire.AppendString(
+		protowire.AppendTag(nil, fieldScopeName, protowire.BytesType), scopeName))
+	for _, r := range records {
+		scopeLogs = appendMessage(scopeLogs, fieldLogRecords, appendRecord(nil, r))
+	}
+
+	var resourceLogs []byte
+	resourceLogs = appendMessage(resourceLogs, fieldResource, res)
+	resourceLogs = appendMessage(resourceLogs, fieldScopeLogs, scopeLogs)
+	return appendMessage(nil, fieldResourceLogs, resourceLogs)
+}
+
+func appendRecord(b []byte, r logRecord) []byte {
+	if r.timeUnixNano != 0 {
+		b = protowire.AppendTag(b, fieldTimeUnixNano, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, r.timeUnixNano)
+	}
+	if r.severityNumber != 0 {
+		b = protowire.AppendTag(b, fieldSeverityNumber, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(r.severityNumber))
+	}
+	if r.severityText != "" {
+		b = protowire.AppendTag(b, fieldSeverityText, protowire.BytesType)
+		b = protowire.AppendString(b, r.severityText)
+	}
+	b = appendMessage(b, fieldBody, appendAnyValue(nil, r.body))
+	for _, kv := range r.attributes {
+		b = appendMessage(b, fieldAttributes, appendKeyValue(nil, kv))
+	}
+	if r.flags != 0 {
+		b = protowire.AppendTag(b, fieldFlags, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, r.flags)
+	}
+	if r.traceID != nil {
+		b = protowire.AppendTag(b, fieldTraceID, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.traceID)
+	}
+	if r.spanID != nil {
+		b = protowire.AppendTag(b, fieldSpanID, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.spanID)
+	}
+	b = protowire.AppendTag(b, fieldObservedTimeUnixNano, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, r.observedTimeUnixNano)
+}
+
+func appendKeyValue(b []byte, kv keyValue) []byte {
+	b = protowire.AppendTag(b, fieldKey, protowire.BytesType)
+	b = protowire.AppendString(b, kv.Key)
+	return appendMessage(b, fieldValue, appendAnyValue(nil, kv.Value))
+}
+
+func appendAnyValue(b []byte, v anyValue) []byte {
+	switch v.kind {
+	case "string":
+		b = protowire.AppendTag(b, fieldStringValue, protowire.BytesType)
+		b = protowire.AppendString(b, v.str)
+	case "bool":
+		b = protowire.AppendTag(b, fieldBoolValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v.bool))
+	case "int":
+		b = protowire.AppendTag(b, fieldIntValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v.int))
+	case "double":
+		b = protowire.AppendTag(b, fieldDoubleValue, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v.double))
+	case "array":
+		var values []byte
+		for _, e := range v.array {
+			values = appendMessage(values, fieldValues, appendAnyValue(nil, e))
+		}
+		b = appendMessage(b, fieldArrayValue, values)
+	case "kvlist":
+		var values []byte
+		for _, kv := range v.kvlist {
+			values = appendMessage(values, fieldValues, appendKeyValue(nil, kv))
+		}
+		b = appendMessage(b, fieldKvlistValue, values)
+	}
+	return b
+}
+
+// appendMessage 追加一个嵌入的消息, 空消息也会写入, 以区分空值和不存在
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// OTLP/JSON的结构. 与protobuf的标准json映射不同, trace_id和span_id为十六进制字符串,
+// 64位整数为字符串, 字段名为小驼峰
+type jsonRequest struct {
+	ResourceLogs []jsonResourceLogs `json:"resourceLogs"`
+}
+
+type jsonResourceLogs struct {
+	Resource  jsonResource    `json:"resource"`
+	ScopeLogs []jsonScopeLogs `json:"scopeLogs"`
+}
+
+type jsonResource struct {
+	Attributes []keyValue `json:"attributes,omitempty"`
+}
+
+type jsonScopeLogs struct {
+	Scope      jsonScope    `json:"scope"`
+	LogRecords []jsonRecord `json:"logRecords"`
+}
+
+type jsonScope struct {
+	Name string `json:"name"`
+}
+
+type jsonRecord struct {
+	TimeUnixNano         string     `json:"timeUnixNano,omitempty"`
+	ObservedTimeUnixNano string     `json:"observedTimeUnixNano"`
+	SeverityNumber       int32      `json:"severityNumber,omitempty"`
+	SeverityText         string     `json:"severityText,omitempty"`
+	Body                 anyValue   `json:"body"`
+	Attributes           []keyValue `json:"attributes,omitempty"`
+	Flags                uint32     `json:"flags,omitempty"`
+	TraceID              string     `json:"traceId,omitempty"`
+	SpanID               string     `json:"spanId,omitempty"`
+}
+
+// marshalJSON 编码为OTLP/JSON格式的ExportLogsServiceRequest
+func marshalJSON(resource []keyValue, records []logRecord) ([]byte, error) {
+	recs := make([]jsonRecord, len(records))
+	for i, r := range records {
+		recs[i] = jsonRecord{
+			ObservedTimeUnixNano: strconv.FormatUint(r.observedTimeUnixNano, 10),
+			SeverityNumber:       r.severityNumber,
+			SeverityText:         r.severityText,
+			Body:                 r.body,
+			Attributes:           r.attributes,
+			Flags:                r.flags,
+			TraceID:              hex.EncodeToString(r.traceID),
+			SpanID:               hex.EncodeToString(r.spanID),
+		}
+		if r.timeUnixNano != 0 {
+			recs[i].TimeUnixNano = strconv.FormatUint(r.timeUnixNano, 10)
+		}
+	}
+	return json.Marshal(jsonRequest{ResourceLogs: []jsonResourceLogs{{
+		Resource:  jsonResource{Attributes: resource},
+		ScopeLogs: []jsonScopeLogs{{Scope: jsonScope{Name: scopeName}, LogRecords: recs}},
+	}}})
+}
+
+func (kv keyValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}{kv.Key, kv.Value})
+}
+
+func (v anyValue) MarshalJSON() ([]byte, error) {
+	switch v.kind {
+	case "string":
+		return json.Marshal(map[string]string{"stringValue": v.str})
+	case "bool":
+		return json.Marshal(map[string]bool{"boolValue": v.bool})
+	case "int":
+		return json.Marshal(map[string]string{"intValue": strconv.FormatInt(v.int, 10)})
+	case "double":
+		if math.IsInf(v.double, 0) || math.IsNaN(v.double) {
+			return json.Marshal(map[string]string{"doubleValue": strconv.FormatFloat(v.double, 'g', -1, 64)})
+		}
+		return json.Marshal(map[string]float64{"doubleValue": v.double})
+	case "array":
+		values := v.array
+		if values == nil {
+			values = []anyValue{}
+		}
+		return json.Marshal(map[string]map[string][]anyValue{"arrayValue": {"values": values}})
+	case "kvlist":
+		values := v.kvlist
+		if values == nil {
+			values = []keyValue{}
+		}
+		return json.Marshal(map[string]map[string][]keyValue{"kvlistValue": {"values": values}})
+	}
+	return []byte("{}"), nil
+}
@@ -0,0 +1,356 @@
+// Package otlpsink 提供把日志以OpenTelemetry Logs数据模型通过OTLP/HTTP发送给collector的log.Sink,
+// 可以与本地切割的日志文件同时使用. 批量发送和磁盘溢出队列由log包的Sink机制负责(见log.AddSink和log.SetSpillQueue),
+// 这里负责格式转换和失败重试. 使用方法:
+//
+//	sink := otlpsink.New("http://localhost:4318",
+//		otlpsink.WithResource(map[string]interface{}{"service.name": "order"}),
+//	)
+//	log.Init("./app.log", log.InfoLevel, true, false, log.AddSink(log.FileTypeLog, sink))
+package otlpsink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/terryliu/log/v2"
+)
+
+// 编码方式, 对应OTLP/HTTP的application/x-protobuf和application/json
+const (
+	EncodingProtobuf = "protobuf"
+	EncodingJSON     = "json"
+)
+
+// 默认配置
+const (
+	DefaultName        = "otlp"
+	DefaultLogsPath    = "/v1/logs"
+	DefaultTimeout     = 10 * time.Second
+	DefaultMaxBatch    = 512
+	DefaultMaxAttempts = 5
+	DefaultBackoff     = 500 * time.Millisecond
+	DefaultMaxBackoff  = 5 * time.Second
+	DefaultMaxElapsed  = 15 * time.Second
+)
+
+type config struct {
+	name        string
+	encoding    string
+	headers     map[string]string
+	timeout     time.Duration
+	client      *http.Client
+	resource    []keyValue
+	traceKeys   [3]string // trace_id, span_id, trace_flags
+	maxBatch    int
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	maxElapsed  time.Duration
+	keepInvalid bool
+}
+
+type Option interface {
+	apply(*config)
+}
+
+type optionFunc func(*config)
+
+func (f optionFunc) apply(c *config) {
+	f(c)
+}
+
+// WithName 设置Sink的名字, 也是磁盘溢出队列的目录名, 默认为otlp. 同时发送给多个collector时需要设置不同的名字
+func WithName(name string) Option {
+	return optionFunc(func(c *config) {
+		c.name = name
+	})
+}
+
+// WithEncoding 设置编码方式, EncodingProtobuf(默认)或EncodingJSON
+func WithEncoding(encoding string) Option {
+	return optionFunc(func(c *config) {
+		c.encoding = encoding
+	})
+}
+
+// WithHeaders 设置每个请求附带的请求头, 比如认证信息
+func WithHeaders(headers map[string]string) Option {
+	return optionFunc(func(c *config) {
+		for k, v := range headers {
+			c.headers[k] = v
+		}
+	})
+}
+
+// WithTimeout 设置每次请求的超时时间, 默认为10秒
+func WithTimeout(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.timeout = d
+	})
+}
+
+// WithHTTPClient 使用自定义的http.Client, 比如需要配置TLS时. 设置后WithTimeout不再生效
+func WithHTTPClient(client *http.Client) Option {
+	return optionFunc(func(c *config) {
+		c.client = client
+	})
+}
+
+// WithResource 设置资源属性, 比如service.name, host.name, 每批日志都会带上
+func WithResource(attrs map[string]interface{}) Option {
+	return optionFunc(func(c *config) {
+		keys := make([]string, 0, len(attrs))
+		for k := range attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		c.resource = c.resource[:0]
+		for _, k := range keys {
+			c.resource = append(c.resource, keyValue{Key: k, Value: toAnyValue(attrs[k])})
+		}
+	})
+}
+
+// WithTraceKeys 设置日志中trace关联字段的键名, 这些字段会转换为LogRecord的TraceId,SpanId和Flags,
+// 默认与log.SetTraceKeys的默认值相同. 使用了log.SetTraceKeys时需要设置为相同的值
+func WithTraceKeys(traceID, spanID, traceFlags string) Option {
+	return optionFunc(func(c *config) {
+		c.traceKeys = [3]string{traceID, spanID, traceFlags}
+	})
+}
+
+// WithMaxBatch 设置每个请求最多包含的日志条数, 默认为512, 超过时分成多个请求发送
+func WithMaxBatch(n int) Option {
+	return optionFunc(func(c *config) {
+		c.maxBatch = n
+	})
+}
+
+// WithRetry 设置失败重试: 最多发送maxAttempts次, 每次重试的等待时间从backoff开始翻倍, 最长为maxBackoff.
+// 网络错误和429,502,503,504会重试, 服务端返回Retry-After时按它等待, 但不超过maxBackoff
+func WithRetry(maxAttempts int, backoff, maxBackoff time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.maxAttempts = maxAttempts
+		c.backoff = backoff
+		c.maxBackoff = maxBackoff
+	})
+}
+
+// WithMaxElapsed 设置每次Send最多花费的时间, 包括所有请求和重试的等待, 默认为15秒, 为0时不限制.
+// 超过之后不再重试, 返回错误由log包落到磁盘溢出队列, 以免一直占用发送日志的goroutine
+func WithMaxElapsed(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.maxElapsed = d
+	})
+}
+
+// WithKeepInvalid collector认为日志无效(400, 或者单条日志也超过大小限制的413)时, 默认丢弃这些日志并输出到标准错误,
+// 以免阻塞后面的日志. keep为true时返回错误, 由log包落到磁盘溢出队列, 等修复collector的配置后再发送
+func WithKeepInvalid(keep bool) Option {
+	return optionFunc(func(c *config) {
+		c.keepInvalid = keep
+	})
+}
+
+// Sink 把日志发送给OTLP/HTTP的collector, 实现了log.Sink
+type Sink struct {
+	conf     config
+	endpoint string
+}
+
+// New 创建发送到endpoint的Sink. endpoint为collector的地址, 比如http://localhost:4318,
+// 没有路径时使用/v1/logs
+func New(endpoint string, opts ...Option) *Sink {
+	c := config{
+		name:        DefaultName,
+		encoding:    EncodingProtobuf,
+		headers:     make(map[string]string),
+		timeout:     DefaultTimeout,
+		traceKeys:   [3]string{log.DefaultTraceIDKey, log.DefaultSpanIDKey, log.DefaultTraceFlagsKey},
+		maxBatch:    DefaultMaxBatch,
+		maxAttempts: DefaultMaxAttempts,
+		backoff:     DefaultBackoff,
+		maxBackoff:  DefaultMaxBackoff,
+		maxElapsed:  DefaultMaxElapsed,
+	}
+	for _, opt := range opts {
+		opt.apply(&c)
+	}
+	if c.client == nil {
+		c.client = &http.Client{Timeout: c.timeout}
+	}
+	if c.maxBatch <= 0 {
+		c.maxBatch = DefaultMaxBatch
+	}
+	if c.maxAttempts <= 0 {
+		c.maxAttempts = 1
+	}
+	if u, err := url.Parse(endpoint); err == nil && (u.Path == "" || u.Path == "/") {
+		u.Path = DefaultLogsPath
+		endpoint = u.String()
+	}
+	return &Sink{conf: c, endpoint: endpoint}
+}
+
+func (s *Sink) Name() string {
+	return s.conf.name
+}
+
+// Send 转换并发送一批日志, 超过maxBatch条时分成多个请求. 重试之后仍然失败, 或者认证和配置错误(比如401,403,404)时
+// 返回错误, 由log包落到磁盘溢出队列; 前面的请求已经成功时返回*log.PartialSendError, 这些日志不会再发送.
+// collector返回413时把这批日志分成两半再发送. 无效的日志的处理见WithKeepInvalid
+func (s *Sink) Send(entries [][]byte) error {
+	var deadline time.Time
+	if s.conf.maxElapsed > 0 {
+		deadline = time.Now().Add(s.conf.maxElapsed)
+	}
+	sent := 0
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > s.conf.maxBatch {
+			n = s.conf.maxBatch
+		}
+		records := make([]logRecord, n)
+		for i, entry := range entries[:n] {
+			records[i] = s.conf.record(entry)
+		}
+		k, err := s.export(records, deadline)
+		sent += k
+		if err != nil {
+			if sent > 0 {
+				return &log.PartialSendError{Sent: sent, Err: err}
+			}
+			return err
+		}
+		entries = entries[n:]
+	}
+	return nil
+}
+
+// post的结果
+const (
+	postOK       = iota
+	postRetry    // 网络错误和429,502,503,504, 等待后重试
+	postTooLarge // 413, 分成两半再发送
+	postInvalid  // 400, 日志无效, 重试也不会成功
+	postFailed   // 认证和配置错误等, 不重试
+)
+
+// export 发送一批日志, 返回发送成功(包括作为无效日志丢弃)的条数
+func (s *Sink) export(records []logRecord, deadline time.Time) (int, error) {
+	var body []byte
+	var contentType string
+	var err error
+	if s.conf.encoding == EncodingJSON {
+		body, err = marshalJSON(s.conf.resource, records)
+		contentType = "application/json"
+	} else {
+		body = marshalProto(s.conf.resource, records)
+		contentType = "application/x-protobuf"
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	wait := s.conf.backoff
+	for attempt := 1; ; attempt++ {
+		result, after, err := s.post(body, contentType, deadline)
+		switch result {
+		case postOK:
+			return len(records), nil
+		case postTooLarge, postInvalid:
+			if result == postTooLarge && len(records) > 1 {
+				half := len(records) / 2
+				n, err := s.export(records[:half], deadline)
+				if err != nil {
+					return n, err
+				}
+				m, err := s.export(records[half:], deadline)
+				return n + m, err
+			}
+			if s.conf.keepInvalid {
+				return 0, err
+			}
+			fmt.Fprintf(os.Stderr, "log: otlp sink %s dropped %d entries: %v\n", s.conf.name, len(records), err)
+			return len(records), nil
+		case postFailed:
+			return 0, err
+		}
+		if attempt >= s.conf.maxAttempts {
+			return 0, err
+		}
+		if after <= 0 {
+			after = wait
+		} else if after > s.conf.maxBackoff {
+			after = s.conf.maxBackoff
+		}
+		if !deadline.IsZero() && time.Now().Add(after).After(deadline) {
+			return 0, err
+		}
+		time.Sleep(after)
+		if wait *= 2; wait > s.conf.maxBackoff {
+			wait = s.conf.maxBackoff
+		}
+	}
+}
+
+// post 发送一次请求, 返回结果和服务端要求的等待时间. deadline不为零时请求在deadline之后取消
+func (s *Sink) post(body []byte, contentType string, deadline time.Time) (int, time.Duration, error) {
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return postFailed, 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range s.conf.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.conf.client.Do(req)
+	if err != nil {
+		return postRetry, 0, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return postOK, 0, nil
+	}
+	err = fmt.Errorf("otlp: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return postRetry, retryAfter(resp.Header.Get("Retry-After")), err
+	case http.StatusRequestEntityTooLarge:
+		return postTooLarge, 0, err
+	case http.StatusBadRequest:
+		return postInvalid, 0, err
+	}
+	return postFailed, 0, err
+}
+
+// retryAfter 解析Retry-After, 支持秒数和HTTP日期
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,307 @@
+package otlpsink
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/terryliu/log/v2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const testEntry = `{"level":"info","ts":"2020-01-02T03:04:05.000Z","msg":"hello","trace_id":"0102030405060708090a0b0c0d0e0f10","k":"v"}`
+
+// collector 记录收到的请求, 按statuses依次返回状态码, 用完后返回200
+type collector struct {
+	mu       sync.Mutex
+	statuses []int
+	header   http.Header
+	bodies   [][]byte
+	types    []string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bodies = append(c.bodies, body)
+	c.types = append(c.types, r.Header.Get("Content-Type"))
+	status := http.StatusOK
+	if len(c.statuses) > 0 {
+		status, c.statuses = c.statuses[0], c.statuses[1:]
+	}
+	for k, vs := range c.header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(status)
+}
+
+func (c *collector) requests() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.bodies)
+}
+
+func startCollector(t *testing.T, c *collector) string {
+	srv := httptest.NewServer(c)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// protoField 返回消息中字段号为num的所有长度前缀字段
+func protoField(t *testing.T, b []byte, num protowire.Number) [][]byte {
+	t.Helper()
+	var values [][]byte
+	for len(b) > 0 {
+		n, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			t.Fatalf("invalid protobuf: %v", protowire.ParseError(l))
+		}
+		b = b[l:]
+		if typ == protowire.BytesType {
+			v, l := protowire.ConsumeBytes(b)
+			if l < 0 {
+				t.Fatalf("invalid protobuf: %v", protowire.ParseError(l))
+			}
+			if n == num {
+				values = append(values, v)
+			}
+			b = b[l:]
+			continue
+		}
+		l = protowire.ConsumeFieldValue(n, typ, b)
+		if l < 0 {
+			t.Fatalf("invalid protobuf: %v", protowire.ParseError(l))
+		}
+		b = b[l:]
+	}
+	return values
+}
+
+func TestSendProtobuf(t *testing.T) {
+	c := &collector{}
+	sink := New(startCollector(t, c), WithResource(map[string]interface{}{"service.name": "order"}))
+	if err := sink.Send([][]byte{[]byte(testEntry)}); err != nil {
+		t.Fatal(err)
+	}
+	if c.types[0] != "application/x-protobuf" {
+		t.Fatalf("Content-Type = %s", c.types[0])
+	}
+
+	resourceLogs := protoField(t, c.bodies[0], fieldResourceLogs)
+	if len(resourceLogs) != 1 {
+		t.Fatalf("got %d resource logs", len(resourceLogs))
+	}
+	resource := protoField(t, resourceLogs[0], fieldResource)[0]
+	attr := protoField(t, resource, fieldResourceAttributes)[0]
+	if key := string(protoField(t, attr, fieldKey)[0]); key != "service.name" {
+		t.Errorf("resource attribute = %s", key)
+	}
+	scopeLogs := protoField(t, resourceLogs[0], fieldScopeLogs)[0]
+	records := protoField(t, scopeLogs, fieldLogRecords)
+	if len(records) != 1 {
+		t.Fatalf("got %d log records", len(records))
+	}
+	body := protoField(t, records[0], fieldBody)[0]
+	if msg := string(protoField(t, body, fieldStringValue)[0]); msg != "hello" {
+		t.Errorf("body = %s", msg)
+	}
+	if level := string(protoField(t, records[0], fieldSeverityText)[0]); level != "info" {
+		t.Errorf("severity text = %s", level)
+	}
+	if traceID := protoField(t, records[0], fieldTraceID)[0]; len(traceID) != 16 || traceID[0] != 1 {
+		t.Errorf("trace id = %x", traceID)
+	}
+}
+
+func TestSendJSON(t *testing.T) {
+	c := &collector{}
+	sink := New(startCollector(t, c), WithEncoding(EncodingJSON))
+	if err := sink.Send([][]byte{[]byte(testEntry)}); err != nil {
+		t.Fatal(err)
+	}
+	if c.types[0] != "application/json" {
+		t.Fatalf("Content-Type = %s", c.types[0])
+	}
+	var req struct {
+		ResourceLogs []struct {
+			ScopeLogs []struct {
+				LogRecords []struct {
+					TimeUnixNano string `json:"timeUnixNano"`
+					SeverityText string `json:"severityText"`
+					Body         struct {
+						StringValue string `json:"stringValue"`
+					} `json:"body"`
+					TraceID    string `json:"traceId"`
+					Attributes []struct {
+						Key string `json:"key"`
+					} `json:"attributes"`
+				} `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	if err := json.Unmarshal(c.bodies[0], &req); err != nil {
+		t.Fatal(err)
+	}
+	r := req.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	if r.Body.StringValue != "hello" || r.SeverityText != "info" || r.TraceID != "0102030405060708090a0b0c0d0e0f10" {
+		t.Errorf("record = %+v", r)
+	}
+	if r.TimeUnixNano != "1577934245000000000" {
+		t.Errorf("timeUnixNano = %s", r.TimeUnixNano)
+	}
+	if len(r.Attributes) != 1 || r.Attributes[0].Key != "k" {
+		t.Errorf("attributes = %+v", r.Attributes)
+	}
+}
+
+func TestSendRetryAfter(t *testing.T) {
+	c := &collector{statuses: []int{http.StatusTooManyRequests}, header: http.Header{"Retry-After": {"1"}}}
+	// Retry-After为1秒, 被maxBackoff限制为100毫秒, 远大于backoff
+	sink := New(startCollector(t, c), WithRetry(3, time.Millisecond, 100*time.Millisecond))
+	start := time.Now()
+	if err := sink.Send([][]byte{[]byte(testEntry)}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Fatalf("waited %v, want Retry-After capped at 100ms", elapsed)
+	}
+	if n := c.requests(); n != 2 {
+		t.Fatalf("got %d requests, want 2", n)
+	}
+}
+
+func TestSendServerErrorRetry(t *testing.T) {
+	c := &collector{statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway}}
+	sink := New(startCollector(t, c), WithRetry(3, time.Millisecond, time.Millisecond))
+	if err := sink.Send([][]byte{[]byte(testEntry)}); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.requests(); n != 3 {
+		t.Fatalf("got %d requests, want 3", n)
+	}
+
+	// 重试次数用完后返回错误, 由log包落到磁盘队列
+	c = &collector{statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}}
+	sink = New(startCollector(t, c), WithRetry(3, time.Millisecond, time.Millisecond))
+	if err := sink.Send([][]byte{[]byte(testEntry)}); err == nil {
+		t.Fatal("Send succeeded after all attempts failed")
+	}
+}
+
+func TestSendClientErrorDropped(t *testing.T) {
+	c := &collector{statuses: []int{http.StatusBadRequest}}
+	sink := New(startCollector(t, c), WithRetry(3, time.Millisecond, time.Millisecond))
+	if err := sink.Send([][]byte{[]byte(testEntry)}); err != nil {
+		t.Fatalf("rejected entries are returned as an error: %v", err)
+	}
+	if n := c.requests(); n != 1 {
+		t.Fatalf("got %d requests, want 1", n)
+	}
+}
+
+func TestSendPartial(t *testing.T) {
+	c := &collector{statuses: []int{http.StatusOK, http.StatusServiceUnavailable}}
+	sink := New(startCollector(t, c), WithMaxBatch(2), WithRetry(1, time.Millisecond, time.Millisecond))
+	entries := [][]byte{[]byte(testEntry), []byte(testEntry), []byte(testEntry), []byte(testEntry), []byte(testEntry)}
+	err := sink.Send(entries)
+	var pe *log.PartialSendError
+	if !errors.As(err, &pe) || pe.Sent != 2 {
+		t.Fatalf("Send = %v, want a partial send of 2 entries", err)
+	}
+}
+
+func TestSendConfigError(t *testing.T) {
+	// 认证和配置错误修复之后还能发送, 所以返回错误, 不丢弃
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		c := &collector{statuses: []int{status}}
+		sink := New(startCollector(t, c), WithRetry(3, time.Millisecond, time.Millisecond))
+		if err := sink.Send([][]byte{[]byte(testEntry)}); err == nil {
+			t.Errorf("status %d: Send succeeded", status)
+		}
+		if n := c.requests(); n != 1 {
+			t.Errorf("status %d: got %d requests, want 1", status, n)
+		}
+	}
+}
+
+func TestSendKeepInvalid(t *testing.T) {
+	c := &collector{statuses: []int{http.StatusBadRequest}}
+	sink := New(startCollector(t, c), WithKeepInvalid(true))
+	if err := sink.Send([][]byte{[]byte(testEntry)}); err == nil {
+		t.Fatal("invalid entries are dropped with WithKeepInvalid(true)")
+	}
+}
+
+func TestSendTooLarge(t *testing.T) {
+	// 4条日志的请求太大, 分成两个2条的请求
+	c := &collector{statuses: []int{http.StatusRequestEntityTooLarge}}
+	sink := New(startCollector(t, c))
+	entries := [][]byte{[]byte(testEntry), []byte(testEntry), []byte(testEntry), []byte(testEntry)}
+	if err := sink.Send(entries); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.requests(); n != 3 {
+		t.Fatalf("got %d requests, want 3", n)
+	}
+	for _, body := range c.bodies[1:] {
+		scopeLogs := protoField(t, protoField(t, body, fieldResourceLogs)[0], fieldScopeLogs)[0]
+		if n := len(protoField(t, scopeLogs, fieldLogRecords)); n != 2 {
+			t.Fatalf("split request has %d log records, want 2", n)
+		}
+	}
+
+	// 单条日志也太大时作为无效的日志丢弃
+	c = &collector{statuses: []int{http.StatusRequestEntityTooLarge}}
+	sink = New(startCollector(t, c))
+	if err := sink.Send([][]byte{[]byte(testEntry)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 后一半失败时前一半已经发送
+	c = &collector{statuses: []int{http.StatusRequestEntityTooLarge, http.StatusOK, http.StatusUnauthorized}}
+	sink = New(startCollector(t, c))
+	var pe *log.PartialSendError
+	if err := sink.Send(entries); !errors.As(err, &pe) || pe.Sent != 2 {
+		t.Fatalf("Send = %v, want a partial send of 2 entries", err)
+	}
+}
+
+func TestSendMaxElapsed(t *testing.T) {
+	c := &collector{statuses: make([]int, 100)}
+	for i := range c.statuses {
+		c.statuses[i] = http.StatusServiceUnavailable
+	}
+	sink := New(startCollector(t, c), WithRetry(100, 50*time.Millisecond, 50*time.Millisecond), WithMaxElapsed(200*time.Millisecond))
+	start := time.Now()
+	if err := sink.Send([][]byte{[]byte(testEntry)}); err == nil {
+		t.Fatal("Send succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Send took %v with a 200ms limit", elapsed)
+	}
+
+	// 没有响应的请求在超过总时间后取消
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(block)
+	sink = New(srv.URL, WithMaxElapsed(100*time.Millisecond))
+	start = time.Now()
+	if err := sink.Send([][]byte{[]byte(testEntry)}); err == nil {
+		t.Fatal("Send succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Send took %v with a 100ms limit", elapsed)
+	}
+}
@@ -0,0 +1,262 @@
+package otlpsink
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zap的json日志中固定的键, 与log包的编码配置一致
+const (
+	levelKey      = "level"
+	timeKey       = "ts"
+	messageKey    = "msg"
+	callerKey     = "caller"
+	stacktraceKey = "stacktrace"
+)
+
+// 固定字段转换后的属性名, 使用OpenTelemetry的语义约定
+const (
+	attrCaller     = "code.filepath"
+	attrStacktrace = "exception.stacktrace"
+)
+
+var errNotObject = errors.New("otlp: entry is not a json object")
+
+const zapTimeLayout = "2006-01-02T15:04:05.000Z0700"
+
+// severityNumbers zap级别对应的SeverityNumber, 见OpenTelemetry Logs数据模型
+var severityNumbers = map[string]int32{
+	"debug":  5,  // DEBUG
+	"info":   9,  // INFO
+	"warn":   13, // WARN
+	"error":  17, // ERROR
+	"dpanic": 18, // ERROR2
+	"panic":  19, // ERROR3
+	"fatal":  21, // FATAL
+}
+
+// anyValue 对应OTLP的AnyValue, kind为空时表示空值
+type anyValue struct {
+	kind   string // string, bool, int, double, array, kvlist
+	str    string
+	bool   bool
+	int    int64
+	double float64
+	array  []anyValue
+	kvlist []keyValue
+}
+
+type keyValue struct {
+	Key   string
+	Value anyValue
+}
+
+// logRecord 对应OTLP的LogRecord
+type logRecord struct {
+	timeUnixNano         uint64
+	observedTimeUnixNano uint64
+	severityNumber       int32
+	severityText         string
+	body                 anyValue
+	attributes           []keyValue
+	traceID              []byte
+	spanID               []byte
+	flags                uint32
+}
+
+// record 把一条json日志转换为LogRecord. 无法解析的日志整体作为body
+func (c *config) record(entry []byte) logRecord {
+	r := logRecord{observedTimeUnixNano: uint64(time.Now().UnixNano())}
+	dec := json.NewDecoder(bytes.NewReader(entry))
+	dec.UseNumber()
+	fields, err := decodeObject(dec)
+	if err != nil {
+		r.body = anyValue{kind: "string", str: string(entry)}
+		return r
+	}
+	for _, f := range fields {
+		switch f.Key {
+		case levelKey:
+			r.severityText = f.Value.str
+			r.severityNumber = severityNumbers[strings.ToLower(f.Value.str)]
+		case timeKey:
+			r.timeUnixNano = parseTime(f.Value)
+		case messageKey:
+			r.body = f.Value
+		case callerKey:
+			r.attributes = append(r.attributes, keyValue{Key: attrCaller, Value: f.Value})
+		case stacktraceKey:
+			r.attributes = append(r.attributes, keyValue{Key: attrStacktrace, Value: f.Value})
+		case c.traceKeys[0]:
+			if r.traceID = decodeHex(f.Value, 16); r.traceID == nil {
+				r.attributes = append(r.attributes, f)
+			}
+		case c.traceKeys[1]:
+			if r.spanID = decodeHex(f.Value, 8); r.spanID == nil {
+				r.attributes = append(r.attributes, f)
+			}
+		case c.traceKeys[2]:
+			if flags := decodeHex(f.Value, 1); flags != nil {
+				r.flags = uint32(flags[0])
+			} else {
+				r.attributes = append(r.attributes, f)
+			}
+		default:
+			r.attributes = append(r.attributes, f)
+		}
+	}
+	return r
+}
+
+// parseTime 解析ts字段, 支持ISO8601字符串和秒为单位的浮点数
+func parseTime(v anyValue) uint64 {
+	switch v.kind {
+	case "string":
+		for _, layout := range []string{zapTimeLayout, time.RFC3339Nano} {
+			if t, err := time.Parse(layout, v.str); err == nil {
+				return uint64(t.UnixNano())
+			}
+		}
+	case "int":
+		return uint64(v.int) * uint64(time.Second)
+	case "double":
+		return uint64(v.double * float64(time.Second))
+	}
+	return 0
+}
+
+// decodeHex 解析n个字节的十六进制字符串, 全为0或格式不对时返回nil
+func decodeHex(v anyValue, n int) []byte {
+	if v.kind != "string" || len(v.str) != 2*n {
+		return nil
+	}
+	b, err := hex.DecodeString(v.str)
+	if err != nil || (n > 1 && bytes.Equal(b, make([]byte, n))) {
+		return nil
+	}
+	return b
+}
+
+// decodeObject 按原来的顺序解析json对象的字段
+func decodeObject(dec *json.Decoder) ([]keyValue, error) {
+	v, err := decodeValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if v.kind != "kvlist" {
+		return nil, errNotObject
+	}
+	return v.kvlist, nil
+}
+
+func decodeValue(dec *json.Decoder) (anyValue, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return anyValue{}, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '{' {
+			var kvs []keyValue
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return anyValue{}, err
+				}
+				key, _ := keyTok.(string)
+				v, err := decodeValue(dec)
+				if err != nil {
+					return anyValue{}, err
+				}
+				kvs = append(kvs, keyValue{Key: key, Value: v})
+			}
+			_, err := dec.Token()
+			return anyValue{kind: "kvlist", kvlist: kvs}, err
+		}
+		var values []anyValue
+		for dec.More() {
+			v, err := decodeValue(dec)
+			if err != nil {
+				return anyValue{}, err
+			}
+			values = append(values, v)
+		}
+		_, err := dec.Token()
+		return anyValue{kind: "array", array: values}, err
+	case string:
+		return anyValue{kind: "string", str: t}, nil
+	case bool:
+		return anyValue{kind: "bool", bool: t}, nil
+	case json.Number:
+		if i, err := strconv.ParseInt(string(t), 10, 64); err == nil {
+			return anyValue{kind: "int", int: i}, nil
+		}
+		f, err := t.Float64()
+		return anyValue{kind: "double", double: f}, err
+	}
+	return anyValue{}, nil
+}
+
+// toAnyValue 转换WithResource中的静态属性
+func toAnyValue(v interface{}) anyValue {
+	switch x := v.(type) {
+	case nil:
+		return anyValue{}
+	case string:
+		return anyValue{kind: "string", str: x}
+	case bool:
+		return anyValue{kind: "bool", bool: x}
+	case int:
+		return anyValue{kind: "int", int: int64(x)}
+	case int32:
+		return anyValue{kind: "int", int: int64(x)}
+	case int64:
+		return anyValue{kind: "int", int: x}
+	case uint32:
+		return anyValue{kind: "int", int: int64(x)}
+	case float32:
+		return anyValue{kind: "double", double: float64(x)}
+	case float64:
+		return anyValue{kind: "double", double: x}
+	case []string:
+		values := make([]anyValue, len(x))
+		for i, s := range x {
+			values[i] = anyValue{kind: "string", str: s}
+		}
+		return anyValue{kind: "array", array: values}
+	case []interface{}:
+		values := make([]anyValue, len(x))
+		for i, e := range x {
+			values[i] = toAnyValue(e)
+		}
+		return anyValue{kind: "array", array: values}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		kvs := make([]keyValue, len(keys))
+		for i, k := range keys {
+			kvs[i] = keyValue{Key: k, Value: toAnyValue(x[k])}
+		}
+		return anyValue{kind: "kvlist", kvlist: kvs}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return anyValue{kind: "string", str: err.Error()}
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	av, err := decodeValue(dec)
+	if err != nil {
+		return anyValue{kind: "string", str: string(b)}
+	}
+	return av
+}
@@ -0,0 +1,63 @@
+package log
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// parseLevel 将DebugLevel等字符串转换为zap的日志级别, 无法识别时使用info
+func parseLevel(level string) zapcore.Level {
+	switch level {
+	case DebugLevel:
+		return zap.DebugLevel
+	case InfoLevel:
+		return zap.InfoLevel
+	case WarnLevel:
+		return zap.WarnLevel
+	case ErrorLevel:
+		return zap.ErrorLevel
+	case PanicLevel:
+		return zap.PanicLevel
+	case FatalLevel:
+		return zap.FatalLevel
+	default:
+		return zap.InfoLevel
+	}
+}
+
+// dropCounter 按级别统计被丢弃的日志条数
+type dropCounter struct {
+	counts [zapcore.FatalLevel - zapcore.DebugLevel + 1]uint64
+}
+
+func (d *dropCounter) inc(level zapcore.Level) {
+	if level < zapcore.DebugLevel || level > zapcore.FatalLevel {
+		return
+	}
+	atomic.AddUint64(&d.counts[level-zapcore.DebugLevel], 1)
+}
+
+func (d *dropCounter) snapshot() map[string]uint64 {
+	stats := make(map[string]uint64, len(d.counts))
+	for i := range d.counts {
+		level := zapcore.DebugLevel + zapcore.Level(i)
+		stats[level.String()] = atomic.LoadUint64(&d.counts[i])
+	}
+	return stats
+}
+
+// priorityReserved 计算为重要日志保留的队列容量, 未指定时保留队列的1/8
+func priorityReserved(queueSize, reserved int) int {
+	if reserved <= 0 {
+		reserved = queueSize / 8
+	}
+	if reserved < 1 {
+		reserved = 1
+	}
+	if reserved >= queueSize {
+		reserved = queueSize - 1
+	}
+	return reserved
+}
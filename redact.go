@@ -0,0 +1,318 @@
+package log
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// 脱敏方式
+const (
+	MaskFull  = "full"  // 全部替换为******
+	MaskLast4 = "last4" // 只保留最后4个字符
+	MaskHash  = "hash"  // 替换为加盐的sha256摘要, 相同的值摘要相同, 便于关联查询
+)
+
+// 常用的值检测规则, 可用于SetRedactPattern和AddRedactPattern
+const (
+	PatternPhone  = `\b1[3-9]\d{9}\b`                  // 中国大陆手机号
+	PatternIDCard = `\b\d{17}[\dXx]\b`                 // 18位身份证号
+	PatternBearer = `(?i)\bbearer\s+[a-z0-9._~+/-]+=*` // Authorization中的token
+)
+
+const fullMask = "******"
+
+// redactRule 脱敏规则. 按key的规则同时会匹配文本中"key":"value"和key=value形式的内容
+type redactRule struct {
+	name *regexp.Regexp // key规则: 字段名, 支持*和?通配(可以匹配/), 不区分大小写
+	re   *regexp.Regexp // 值规则: 匹配到的内容会被脱敏
+	json *regexp.Regexp // key规则在文本中的json形式
+	form *regexp.Regexp // key规则在文本中的key=value形式
+	mask string
+}
+
+// redactor 保存脱敏规则, 规则可以在运行时修改, 写日志时只读取规则的快照
+type redactor struct {
+	mu    sync.Mutex
+	rules atomic.Value // []*redactRule
+	salt  atomic.Value // string
+}
+
+func newRedactor() *redactor {
+	r := &redactor{}
+	r.rules.Store([]*redactRule(nil))
+	r.salt.Store("")
+	return r
+}
+
+func (r *redactor) addRule(rule *redactRule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.rules.Load().([]*redactRule)
+	rules := make([]*redactRule, len(old), len(old)+1)
+	copy(rules, old)
+	r.rules.Store(append(rules, rule))
+}
+
+func (r *redactor) clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules.Store([]*redactRule(nil))
+}
+
+func newKeyRule(key, mask string) *redactRule {
+	key = strings.ToLower(key)
+	// 将通配符转换为正则: *匹配任意个字符, ?匹配单个字符
+	quoted := regexp.QuoteMeta(key)
+	name := strings.Replace(quoted, `\*`, `.*`, -1)
+	name = strings.Replace(name, `\?`, `.`, -1)
+	quoted = strings.Replace(quoted, `\*`, `[^"=&\s]*`, -1)
+	quoted = strings.Replace(quoted, `\?`, `[^"=&\s]`, -1)
+	return &redactRule{
+		name: regexp.MustCompile(`(?is)^` + name + `$`),
+		json: regexp.MustCompile(`(?i)("` + quoted + `"\s*:\s*")((?:[^"\\]|\\.)*)"`),
+		form: regexp.MustCompile(`(?i)(\b` + quoted + `=)([^&\s,;"]*)`),
+		mask: mask,
+	}
+}
+
+func (rule *redactRule) matchKey(key string) bool {
+	if rule.name == nil {
+		return false
+	}
+	return rule.name.MatchString(key)
+}
+
+// mask 按规则对value脱敏
+func (r *redactor) mask(mask, value string) string {
+	switch mask {
+	case MaskLast4:
+		n := utf8.RuneCountInString(value)
+		if n <= 4 {
+			return strings.Repeat("*", n)
+		}
+		tail := value
+		for i := 0; i < n-4; i++ {
+			_, size := utf8.DecodeRuneInString(tail)
+			tail = tail[size:]
+		}
+		return strings.Repeat("*", n-4) + tail
+	case MaskHash:
+		sum := sha256.Sum256([]byte(r.salt.Load().(string) + value))
+		return "sha256:" + hex.EncodeToString(sum[:16])
+	default:
+		return fullMask
+	}
+}
+
+// text 对文本中命中规则的内容脱敏
+func (r *redactor) text(rules []*redactRule, s string) string {
+	for _, rule := range rules {
+		if rule.re != nil {
+			s = rule.re.ReplaceAllStringFunc(s, func(v string) string { return r.mask(rule.mask, v) })
+			continue
+		}
+		s = replaceGroup(rule.json, s, func(v string) string { return r.mask(rule.mask, v) })
+		s = replaceGroup(rule.form, s, func(v string) string { return r.mask(rule.mask, v) })
+	}
+	return s
+}
+
+// replaceGroup 将re匹配结果中的第2个分组替换为fn的返回值
+func replaceGroup(re *regexp.Regexp, s string, fn func(string) string) string {
+	matches := re.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		b.WriteString(s[last:m[4]])
+		b.WriteString(fn(s[m[4]:m[5]]))
+		last = m[5]
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// field 对单个字段脱敏, 返回的bool表示字段是否被修改
+func (r *redactor) field(rules []*redactRule, f zapcore.Field) (zapcore.Field, bool) {
+	for _, rule := range rules {
+		if rule.matchKey(f.Key) {
+			return zap.String(f.Key, r.mask(rule.mask, fieldString(f))), true
+		}
+	}
+
+	switch f.Type {
+	case zapcore.StringType:
+		if s := r.text(rules, f.String); s != f.String {
+			f.String = s
+			return f, true
+		}
+	case zapcore.ByteStringType, zapcore.StringerType, zapcore.ErrorType:
+		s := fieldString(f)
+		if bs, ok := f.Interface.([]byte); ok {
+			s = string(bs)
+		}
+		if redacted := r.text(rules, s); redacted != s {
+			return zap.String(f.Key, redacted), true
+		}
+	case zapcore.ReflectType:
+		// 按json序列化(遵循log标签)后再脱敏, 结果仍然以json输出, 这样请求参数中嵌套的字段也能被处理
+		b, err := reflectedJSON(f.Interface)
+		if err != nil {
+			return f, false
+		}
+		if s := r.text(rules, string(b)); s != string(b) {
+			f.Interface = json.RawMessage(s)
+			return f, true
+		}
+	}
+	return f, false
+}
+
+// pairs 对key,value交替的参数按key规则脱敏, 用于在拼接成消息之前处理RequestLogInfo的参数,
+// 拼接之后key和value之间没有分隔符, 无法再按key匹配
+func (r *redactor) pairs(rules []*redactRule, keysAndValues []interface{}) []interface{} {
+	var out []interface{}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		key, ok := keysAndValues[i].(string)
+		if !ok {
+			continue
+		}
+		for _, rule := range rules {
+			if !rule.matchKey(key) {
+				continue
+			}
+			if out == nil {
+				out = make([]interface{}, len(keysAndValues))
+				copy(out, keysAndValues)
+			}
+			out[i+1] = r.mask(rule.mask, fmt.Sprint(keysAndValues[i+1]))
+			break
+		}
+	}
+	if out == nil {
+		return keysAndValues
+	}
+	return out
+}
+
+// fields 对字段列表脱敏, 没有字段被修改时返回原来的切片
+func (r *redactor) fields(rules []*redactRule, fields []zapcore.Field) []zapcore.Field {
+	var out []zapcore.Field
+	for i, f := range fields {
+		redacted, changed := r.field(rules, f)
+		if !changed {
+			if out != nil {
+				out = append(out, f)
+			}
+			continue
+		}
+		if out == nil {
+			out = make([]zapcore.Field, i, len(fields))
+			copy(out, fields[:i])
+		}
+		out = append(out, redacted)
+	}
+	if out == nil {
+		return fields
+	}
+	return out
+}
+
+// redactCore 在写入之前对消息和字段脱敏, 与具体的编码格式无关, json和csv都适用.
+// 带log标签的结构体由编码器在反射时处理, 这里按标签序列化后的内容脱敏
+type redactCore struct {
+	zapcore.Core
+	r *redactor
+}
+
+func (c *redactCore) With(fields []zapcore.Field) zapcore.Core {
+	rules := c.r.rules.Load().([]*redactRule)
+	if len(rules) > 0 {
+		fields = c.r.fields(rules, fields)
+	}
+	return &redactCore{Core: c.Core.With(fields), r: c.r}
+}
+
+func (c *redactCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *redactCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	rules := c.r.rules.Load().([]*redactRule)
+	if len(rules) > 0 {
+		ent.Message = c.r.text(rules, ent.Message)
+		fields = c.r.fields(rules, fields)
+	}
+	return writeCore(c.Core, ent, fields)
+}
+
+// SetRedactKeys 对字段名匹配keys的字段按mask方式脱敏, key支持*和?通配(可以匹配/), 不区分大小写.
+// 消息和字符串中"key":"value"以及key=value形式的内容也会被脱敏. RequestLogInfo的参数在拼接成消息之前按key,value脱敏;
+// 其它用fmt格式化到消息中的内容(比如Infof的参数)只能按上面两种文本形式匹配, 需要时用SetRedactPattern按值匹配.
+func SetRedactKeys(mask string, keys ...string) LogOption {
+	return logOptionFunc(func(log *Log) {
+		for _, key := range keys {
+			log.redactor.addRule(newKeyRule(key, mask))
+		}
+	})
+}
+
+// SetRedactPattern 对消息和字段值中匹配正则pattern的内容按mask方式脱敏, 正则非法时会panic
+func SetRedactPattern(pattern, mask string) LogOption {
+	re := regexp.MustCompile(pattern)
+	return logOptionFunc(func(log *Log) {
+		log.redactor.addRule(&redactRule{re: re, mask: mask})
+	})
+}
+
+// SetRedactSalt 设置MaskHash方式使用的盐
+func SetRedactSalt(salt string) LogOption {
+	return logOptionFunc(func(log *Log) {
+		log.redactor.salt.Store(salt)
+	})
+}
+
+// AddRedactKeys 运行时增加按字段名脱敏的规则, 参考SetRedactKeys
+func AddRedactKeys(mask string, keys ...string) {
+	if logger == nil {
+		return
+	}
+	for _, key := range keys {
+		logger.redactor.addRule(newKeyRule(key, mask))
+	}
+}
+
+// AddRedactPattern 运行时增加按正则脱敏的规则, 参考SetRedactPattern
+func AddRedactPattern(pattern, mask string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid redact pattern %q: %v", pattern, err)
+	}
+	if logger != nil {
+		logger.redactor.addRule(&redactRule{re: re, mask: mask})
+	}
+	return nil
+}
+
+// ClearRedactRules 运行时清除所有脱敏规则
+func ClearRedactRules() {
+	if logger == nil {
+		return
+	}
+	logger.redactor.clear()
+}
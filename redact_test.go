@@ -0,0 +1,55 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRedactKeyWildcard(t *testing.T) {
+	rule := newKeyRule("*token*", MaskFull)
+	for _, key := range []string{"token", "X-Token", "headers/x-token", "auth/token/refresh"} {
+		if !rule.matchKey(key) {
+			t.Errorf("*token* does not match %q", key)
+		}
+	}
+	if rule.matchKey("tok") {
+		t.Error("*token* matches tok")
+	}
+	if !newKeyRule("user?id", MaskFull).matchKey("user/id") {
+		t.Error("user?id does not match user/id")
+	}
+}
+
+func TestRedactPairs(t *testing.T) {
+	r := newRedactor()
+	r.addRule(newKeyRule("password", MaskFull))
+	rules := r.rules.Load().([]*redactRule)
+
+	args := []interface{}{"user", "alice", "password", "secret", 42}
+	out := r.pairs(rules, args)
+	if out[3] != fullMask || out[1] != "alice" || out[4] != 42 {
+		t.Fatalf("pairs = %v", out)
+	}
+	if args[3] != "secret" {
+		t.Fatal("pairs modifies its argument")
+	}
+}
+
+func TestRequestLogInfoRedact(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "app.log")
+	Init(path, InfoLevel, true, false, SetRedactKeys(MaskFull, "*token*"))
+	defer func() { logger = nil }()
+
+	RequestLogInfo("user", "alice", "api/token", "abc123")
+	Sync()
+	data, err := ioutil.ReadFile(filepath.Join(dir, "app.log.Request.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("abc123")) || !bytes.Contains(data, []byte("alice")) {
+		t.Fatalf("request log is not redacted:\n%s", data)
+	}
+}
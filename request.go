@@ -0,0 +1,106 @@
+package log
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// 请求日志的消息, 用来区分收到的请求和对外发出的请求
+const (
+	requestMessage  = "request"
+	outboundMessage = "outbound"
+)
+
+// RequestEntry 一次请求的访问日志. LogRequest按固定的顺序写入各个字段, 空值也会写入,
+// 这样csv格式的每一列, json格式的每个键在不同的服务之间都是一致的. Extras按键名排序后写在最后.
+type RequestEntry struct {
+	Method    string
+	Path      string
+	Query     string
+	Status    int
+	Latency   time.Duration
+	ClientIP  string
+	UserAgent string
+	RequestID string
+	BytesIn   int64
+	BytesOut  int64
+	Extras    map[string]interface{}
+}
+
+// 请求日志的字段名
+const (
+	RequestKeyMethod    = "method"
+	RequestKeyPath      = "path"
+	RequestKeyQuery     = "query"
+	RequestKeyStatus    = "status"
+	RequestKeyLatency   = "latency_ms"
+	RequestKeyClientIP  = "client_ip"
+	RequestKeyUserAgent = "user_agent"
+	RequestKeyRequestID = "request_id"
+	RequestKeyBytesIn   = "bytes_in"
+	RequestKeyBytesOut  = "bytes_out"
+)
+
+// Fields 按固定顺序返回请求日志的字段. 耗时统一记为毫秒数, 避免json和csv中的时长格式不一致
+func (e *RequestEntry) Fields() []zapcore.Field {
+	fields := make([]zapcore.Field, 0, 10+len(e.Extras))
+	fields = append(fields,
+		zap.String(RequestKeyMethod, e.Method),
+		zap.String(RequestKeyPath, e.Path),
+		zap.String(RequestKeyQuery, e.Query),
+		zap.Int(RequestKeyStatus, e.Status),
+		zap.Float64(RequestKeyLatency, float64(e.Latency)/float64(time.Millisecond)),
+		zap.String(RequestKeyClientIP, e.ClientIP),
+		zap.String(RequestKeyUserAgent, e.UserAgent),
+		zap.String(RequestKeyRequestID, e.RequestID),
+		zap.Int64(RequestKeyBytesIn, e.BytesIn),
+		zap.Int64(RequestKeyBytesOut, e.BytesOut),
+	)
+	keys := make([]string, 0, len(e.Extras))
+	for k := range e.Extras {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fields = append(fields, zap.Any(k, e.Extras[k]))
+	}
+	return fields
+}
+
+// LogRequest 写一条请求日志, 使用方法: log.LogRequest(log.RequestEntry{Method: "GET", Path: "/ping", Status: 200})
+func LogRequest(entry RequestEntry) {
+	if logger == nil || !logger.NeedRequestLog {
+		return
+	}
+	logger.adapters[needLevelsLog(FileTypeRequest)].Log(zapcore.InfoLevel, requestMessage, entry.Fields()...)
+}
+
+// LogRequestContext 与LogRequest相同, ctx中有OpenTelemetry的span时加上trace_id,span_id和trace_flags
+func LogRequestContext(ctx context.Context, entry RequestEntry) {
+	if logger == nil || !logger.NeedRequestLog {
+		return
+	}
+	fields := append(entry.Fields(), traceFields(ctx)...)
+	logger.adapters[needLevelsLog(FileTypeRequest)].Log(zapcore.InfoLevel, requestMessage, fields...)
+}
+
+// LogOutbound 写一条对外请求的日志到Outbound日志中
+func LogOutbound(entry RequestEntry) {
+	if logger == nil {
+		return
+	}
+	logger.adapters[FileTypeOutbound].Log(zapcore.InfoLevel, outboundMessage, entry.Fields()...)
+}
+
+// LogOutboundContext 与LogOutbound相同, ctx中有OpenTelemetry的span时加上trace_id,span_id和trace_flags
+func LogOutboundContext(ctx context.Context, entry RequestEntry) {
+	if logger == nil {
+		return
+	}
+	fields := append(entry.Fields(), traceFields(ctx)...)
+	logger.adapters[FileTypeOutbound].Log(zapcore.InfoLevel, outboundMessage, fields...)
+}
@@ -0,0 +1,106 @@
+package log
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testRequest = RequestEntry{
+	Method:    "POST",
+	Path:      "/orders",
+	Query:     "id=1",
+	Status:    201,
+	Latency:   1500 * time.Microsecond,
+	ClientIP:  "10.0.0.1",
+	UserAgent: "curl/7.68.0",
+	RequestID: "r-1",
+	BytesIn:   10,
+	BytesOut:  20,
+	Extras:    map[string]interface{}{"zone": "b", "tenant": "a"},
+}
+
+func TestLogRequestCSV(t *testing.T) {
+	dir := tempDir(t)
+	Init(filepath.Join(dir, "app.log"), InfoLevel, true, false)
+	defer func() { logger.close(); logger = nil }()
+
+	LogRequest(testRequest)
+	// 空值也写入, 保证每一列的位置固定
+	LogRequest(RequestEntry{Method: "GET", Path: "/empty"})
+
+	path := filepath.Join(dir, "app.log.Request.csv")
+	want := `"request","method:POST","path:/orders","query:id=1","status:201","latency_ms:1.5","client_ip:10.0.0.1",` +
+		`"user_agent:curl/7.68.0","request_id:r-1","bytes_in:10","bytes_out:20","tenant:a","zone:b"`
+	if line := readLines(t, path, "/orders")[0]; !strings.HasSuffix(line, want) {
+		t.Errorf("csv columns: %s, want suffix %s", line, want)
+	}
+	want = `"request","method:GET","path:/empty","query:","status:0","latency_ms:0","client_ip:","user_agent:","request_id:","bytes_in:0","bytes_out:0"`
+	if line := readLines(t, path, "/empty")[0]; !strings.HasSuffix(line, want) {
+		t.Errorf("csv columns of empty values: %s, want suffix %s", line, want)
+	}
+	Infow("main")
+	if lines := readLines(t, filepath.Join(dir, "app.log"), "/orders"); len(lines) != 0 {
+		t.Errorf("request entry written to the main log: %v", lines)
+	}
+}
+
+func TestLogRequestJSON(t *testing.T) {
+	dir := tempDir(t)
+	Init(filepath.Join(dir, "app.log"), InfoLevel, true, false, SetRequestType("json"))
+	defer func() { logger.close(); logger = nil }()
+
+	LogRequest(testRequest)
+	line := readLines(t, filepath.Join(dir, "app.log.Request"), "/orders")[0]
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &m); err != nil {
+		t.Fatalf("%v: %s", err, line)
+	}
+	want := map[string]interface{}{
+		RequestKeyMethod: "POST", RequestKeyPath: "/orders", RequestKeyQuery: "id=1", RequestKeyStatus: 201.0,
+		RequestKeyLatency: 1.5, RequestKeyClientIP: "10.0.0.1", RequestKeyUserAgent: "curl/7.68.0",
+		RequestKeyRequestID: "r-1", RequestKeyBytesIn: 10.0, RequestKeyBytesOut: 20.0, "tenant": "a", "zone": "b",
+	}
+	for k, v := range want {
+		if m[k] != v {
+			t.Errorf("%s = %v, want %v", k, m[k], v)
+		}
+	}
+	// 键的顺序固定, extras按键名排序写在最后
+	if i, j, k := strings.Index(line, `"method"`), strings.Index(line, `"bytes_out"`), strings.Index(line, `"tenant"`); !(i < j && j < k) {
+		t.Errorf("key order: %s", line)
+	}
+}
+
+func TestLogRequestAccess(t *testing.T) {
+	dir := tempDir(t)
+	Init(filepath.Join(dir, "app.log"), InfoLevel, true, false, SetRequestType(AccessCombined))
+	defer func() { logger.close(); logger = nil }()
+
+	LogRequest(testRequest)
+	want := `10.0.0.1 - - [`
+	line := readLines(t, filepath.Join(dir, "app.log.Request"), "/orders")[0]
+	if !strings.HasPrefix(line, want) || !strings.HasSuffix(line, `"POST /orders?id=1 -" 201 20 "-" "curl/7.68.0"`) {
+		t.Errorf("combined = %s", line)
+	}
+}
+
+func TestLogRequestStatusSampling(t *testing.T) {
+	dir := tempDir(t)
+	Init(filepath.Join(dir, "app.log"), InfoLevel, true, false,
+		SetStatusSampling(FileTypeRequest, RequestKeyStatus, map[int]float64{2: 0}))
+	defer func() { logger.close(); logger = nil }()
+
+	for _, status := range []int{200, 204, 404, 500} {
+		entry := testRequest
+		entry.Path = "/sampled"
+		entry.Status = status
+		LogRequest(entry)
+	}
+	lines := readLines(t, filepath.Join(dir, "app.log.Request.csv"), "/sampled")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"status:404"`) || !strings.Contains(lines[1], `"status:500"`) {
+		t.Fatalf("status sampling kept %q, want the 404 and 500 entries", lines)
+	}
+}
@@ -0,0 +1,266 @@
+package log
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	megabyte = 1024 * 1024
+
+	// 与lumberjack中备份文件的命名规则一致
+	backupTimeFormat = "2006-01-02T15-04-05.000"
+	compressSuffix   = ".gz"
+)
+
+// rollingWriter 包装lumberjack. lumberjack自己切割文件时外部无从知晓, 所以这里按与lumberjack相同的规则
+// 计算文件大小, 在文件写满之前主动调用Rotate, 这样就能在每个新文件的开头写入文件头(比如BOM).
+type rollingWriter struct {
+	mu      sync.Mutex
+	lj      *lumberjack.Logger
+	max     int64
+	size    int64
+	opened  bool
+	headers []func() []byte // 每个新文件开头依次写入的内容
+	cipher  *fileCipher     // 不为nil时文件内容按块加密
+	rotated []func()        // 每次切割后依次调用
+	syncs   []func()        // Sync时依次调用
+}
+
+func newRollingWriter(lj *lumberjack.Logger) *rollingWriter {
+	max := int64(lj.MaxSize) * megabyte
+	if max == 0 {
+		max = 100 * megabyte // 与lumberjack的默认值一致
+	}
+	return &rollingWriter{lj: lj, max: max}
+}
+
+// addHeader 增加新文件的文件头
+func (w *rollingWriter) addHeader(header func() []byte) {
+	w.headers = append(w.headers, header)
+}
+
+// onRotate 增加切割后的回调, 回调在持有锁时调用, 不能阻塞
+func (w *rollingWriter) onRotate(fn func()) {
+	w.rotated = append(w.rotated, fn)
+}
+
+// onSync 增加Sync时的回调, 用来等待切割后在后台进行的工作
+func (w *rollingWriter) onSync(fn func()) {
+	w.syncs = append(w.syncs, fn)
+}
+
+// setCipher 开启加密, 加密的文件头在addHeader的文件头之前, 并且不加密
+func (w *rollingWriter) setCipher(c *fileCipher) {
+	w.cipher = c
+}
+
+func (w *rollingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	writeLen := int64(len(p))
+	if w.cipher != nil {
+		// 数据块和切割时写入的结束块
+		writeLen += 2 * encOverhead
+	}
+	fresh, err := w.prepare(writeLen)
+	if err != nil {
+		return 0, err
+	}
+	if w.cipher == nil && (!fresh || len(w.headers) == 0) {
+		n, err := w.lj.Write(p)
+		w.size += int64(n)
+		return n, err
+	}
+
+	var data []byte
+	if fresh {
+		for _, header := range w.headers {
+			data = append(data, header()...)
+		}
+	}
+	data = append(data, p...)
+	if w.cipher != nil {
+		if data, err = w.seal(data, fresh); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.lj.Write(data)
+	w.size += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// seal 加密data, 新文件以加密的文件头开始
+func (w *rollingWriter) seal(data []byte, fresh bool) ([]byte, error) {
+	var header []byte
+	if fresh {
+		var err error
+		if header, err = w.cipher.begin(); err != nil {
+			return nil, err
+		}
+	}
+	chunk, err := w.cipher.seal(data)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, chunk...), nil
+}
+
+// prepare 判断这次写入是否会写到一个新文件中, 需要切割时先切割
+func (w *rollingWriter) prepare(writeLen int64) (bool, error) {
+	if !w.opened {
+		w.opened = true
+		info, err := os.Stat(w.lj.Filename)
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		// 加密文件不知道已有文件的密钥和块序号, 所以总是从新文件开始
+		if err == nil && info.Size()+writeLen < w.max && w.cipher == nil {
+			w.size = info.Size()
+			return false, nil
+		}
+		return true, w.rotate()
+	}
+	if w.size+writeLen > w.max {
+		return true, w.rotate()
+	}
+	return false, nil
+}
+
+func (w *rollingWriter) rotate() error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+	w.size = 0
+	if err := w.lj.Rotate(); err != nil {
+		return err
+	}
+	for _, fn := range w.rotated {
+		fn()
+	}
+	return nil
+}
+
+// finish 加密时在当前文件的末尾写入结束块
+func (w *rollingWriter) finish() error {
+	if w.cipher == nil || w.cipher.aead == nil {
+		return nil
+	}
+	chunk, err := w.cipher.finish()
+	if err != nil {
+		return err
+	}
+	n, err := w.lj.Write(chunk)
+	w.size += int64(n)
+	return err
+}
+
+// close 结束当前文件. 之后的写入与重新启动时相同, 会切割出一个新文件
+func (w *rollingWriter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cipher == nil {
+		return nil
+	}
+	w.opened = false
+	return w.finish()
+}
+
+// Sync lumberjack直接写文件, 没有缓存
+func (w *rollingWriter) Sync() error {
+	for _, fn := range w.syncs {
+		fn()
+	}
+	return nil
+}
+
+// rotationSet 返回path的所有备份文件和当前文件, 按切割时间从旧到新排列
+func rotationSet(path string) ([]string, error) {
+	dir := filepath.Dir(path)
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+	prefix := name[:len(name)-len(ext)] + "-"
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type backup struct {
+		path string
+		t    time.Time
+	}
+	var backups []backup
+	for _, f := range files {
+		fn := f.Name()
+		if f.IsDir() || !strings.HasPrefix(fn, prefix) {
+			continue
+		}
+		ts := strings.TrimSuffix(fn, compressSuffix)
+		if !strings.HasSuffix(ts, ext) {
+			continue
+		}
+		ts = ts[len(prefix) : len(ts)-len(ext)]
+		t, err := time.Parse(backupTimeFormat, ts)
+		if err != nil {
+			continue
+		}
+		if n := len(backups); n > 0 && backups[n-1].t.Equal(t) {
+			// 正在压缩的备份文件会同时存在压缩前后两个文件, 以未压缩的为准
+			if !strings.HasSuffix(fn, compressSuffix) {
+				backups[n-1].path = filepath.Join(dir, fn)
+			}
+			continue
+		}
+		backups = append(backups, backup{path: filepath.Join(dir, fn), t: t})
+	}
+	sort.SliceStable(backups, func(i, j int) bool { return backups[i].t.Before(backups[j].t) })
+
+	set := make([]string, 0, len(backups)+1)
+	for _, b := range backups {
+		set = append(set, b.path)
+	}
+	if _, err := os.Stat(path); err == nil {
+		set = append(set, path)
+	}
+	return set, nil
+}
+
+// openLogFile 打开日志文件, 被lumberjack压缩过的备份文件会自动解压
+func openLogFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, compressSuffix) {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: zr, f: f}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
@@ -0,0 +1,215 @@
+package log
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const sampleBuckets = 4096
+
+// sampleCounter 与zapcore的采样计数器相同: 每个tick周期内重新计数
+type sampleCounter struct {
+	resetAt int64
+	counter uint64
+}
+
+func (c *sampleCounter) incCheckReset(t time.Time, tick time.Duration) uint64 {
+	tn := t.UnixNano()
+	resetAfter := atomic.LoadInt64(&c.resetAt)
+	if resetAfter > tn {
+		return atomic.AddUint64(&c.counter, 1)
+	}
+	atomic.StoreUint64(&c.counter, 1)
+	if !atomic.CompareAndSwapInt64(&c.resetAt, resetAfter, tn+tick.Nanoseconds()) {
+		return atomic.AddUint64(&c.counter, 1)
+	}
+	return 1
+}
+
+type sampleCounters [sampleBuckets]sampleCounter
+
+// keySampler 按级别,消息和某个字段的值分别采样, 比如按route采样时每个接口各自计数.
+// 没有该字段的日志不参与采样. 每个级别的计数器在第一次用到时才分配
+type keySampler struct {
+	key               string
+	tick              time.Duration
+	first, thereafter uint64
+
+	mu     sync.Mutex
+	counts [zapcore.FatalLevel - zapcore.DebugLevel + 1]atomic.Value // *sampleCounters
+}
+
+func newKeySampler(key string, tick time.Duration, first, thereafter int) *keySampler {
+	return &keySampler{key: key, tick: tick, first: uint64(first), thereafter: uint64(thereafter)}
+}
+
+func (s *keySampler) allow(ent zapcore.Entry, fields []zapcore.Field) bool {
+	if ent.Level < zapcore.DebugLevel || ent.Level > zapcore.FatalLevel {
+		return true
+	}
+	value, ok := findField(fields, s.key)
+	if !ok {
+		return true
+	}
+	counter := &s.levelCounters(ent.Level)[fnv32a(ent.Message+"\x00"+value)%sampleBuckets]
+	n := counter.incCheckReset(ent.Time, s.tick)
+	return n <= s.first || (s.thereafter > 0 && (n-s.first)%s.thereafter == 0)
+}
+
+// levelCounters 返回level级别的计数器, 不存在时创建
+func (s *keySampler) levelCounters(level zapcore.Level) *sampleCounters {
+	v := &s.counts[level-zapcore.DebugLevel]
+	if c, ok := v.Load().(*sampleCounters); ok {
+		return c
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := v.Load().(*sampleCounters); ok {
+		return c
+	}
+	c := new(sampleCounters)
+	v.Store(c)
+	return c
+}
+
+// statusSampler 按状态码类别(2xx,5xx等)采样, rate为保留比例, 未配置的类别全部保留
+type statusSampler struct {
+	key    string
+	every  map[int]uint64
+	counts map[int]*uint64
+}
+
+func newStatusSampler(key string, rates map[int]float64) *statusSampler {
+	s := &statusSampler{key: key, every: make(map[int]uint64), counts: make(map[int]*uint64)}
+	for class, rate := range rates {
+		switch {
+		case rate >= 1:
+			continue
+		case rate <= 0:
+			s.every[class] = 0
+		default:
+			s.every[class] = uint64(math.Round(1 / rate))
+		}
+		s.counts[class] = new(uint64)
+	}
+	return s
+}
+
+func (s *statusSampler) allow(fields []zapcore.Field) bool {
+	value, ok := findField(fields, s.key)
+	if !ok {
+		return true
+	}
+	status, err := strconv.Atoi(value)
+	if err != nil {
+		return true
+	}
+	every, ok := s.every[status/100]
+	if !ok {
+		return true
+	}
+	if every == 0 {
+		return false
+	}
+	return (atomic.AddUint64(s.counts[status/100], 1)-1)%every == 0
+}
+
+// samplingCore 在内部core之前做采样. 不低于critical级别的日志不参与采样;
+// 按消息的采样交给zapcore的sampler在Check阶段完成, 按字段的采样需要在Write阶段才能拿到字段.
+type samplingCore struct {
+	zapcore.Core
+	sampler  zapcore.Core
+	keys     []*keySampler
+	status   *statusSampler
+	critical zapcore.Level
+	drops    *dropCounter
+}
+
+func (c *samplingCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.Core = c.Core.With(fields)
+	if c.sampler != nil {
+		clone.sampler = c.sampler.With(fields)
+	}
+	return &clone
+}
+
+func (c *samplingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.Enabled(ent.Level) {
+		return ce
+	}
+	if ent.Level < c.critical && c.sampler != nil && c.sampler.Check(ent, nil) == nil {
+		c.drops.inc(ent.Level)
+		return ce
+	}
+	return ce.AddCore(ent, c)
+}
+
+func (c *samplingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if ent.Level < c.critical {
+		for _, s := range c.keys {
+			if !s.allow(ent, fields) {
+				c.drops.inc(ent.Level)
+				return nil
+			}
+		}
+		if c.status != nil && !c.status.allow(fields) {
+			c.drops.inc(ent.Level)
+			return nil
+		}
+	}
+	return c.Core.Write(ent, fields)
+}
+
+// findField 查找指定key的字段, 并将其值转换为字符串
+func findField(fields []zapcore.Field, key string) (string, bool) {
+	for _, f := range fields {
+		if f.Key == key {
+			return fieldString(f), true
+		}
+	}
+	return "", false
+}
+
+// fieldString 将字段的值转换为字符串
+func fieldString(f zapcore.Field) string {
+	switch f.Type {
+	case zapcore.StringType:
+		return f.String
+	case zapcore.Int64Type, zapcore.Int32Type, zapcore.Int16Type, zapcore.Int8Type:
+		return strconv.FormatInt(f.Integer, 10)
+	case zapcore.Uint64Type, zapcore.Uint32Type, zapcore.Uint16Type, zapcore.Uint8Type, zapcore.UintptrType:
+		return strconv.FormatUint(uint64(f.Integer), 10)
+	case zapcore.BoolType:
+		return strconv.FormatBool(f.Integer == 1)
+	case zapcore.Float64Type:
+		return strconv.FormatFloat(math.Float64frombits(uint64(f.Integer)), 'g', -1, 64)
+	case zapcore.Float32Type:
+		return strconv.FormatFloat(float64(math.Float32frombits(uint32(f.Integer))), 'g', -1, 32)
+	case zapcore.DurationType:
+		return time.Duration(f.Integer).String()
+	case zapcore.StringerType, zapcore.ErrorType, zapcore.ReflectType:
+		return fmt.Sprint(f.Interface)
+	}
+	return ""
+}
+
+// fnv32a 与zapcore中的实现相同, 避免[]byte(string)的内存分配
+func fnv32a(s string) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	hash := uint32(offset32)
+	for i := 0; i < len(s); i++ {
+		hash ^= uint32(s[i])
+		hash *= prime32
+	}
+	return hash
+}
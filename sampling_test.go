@@ -0,0 +1,45 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestKeySampler(t *testing.T) {
+	s := newKeySampler("route", time.Minute, 2, 0)
+	ent := zapcore.Entry{Level: zapcore.InfoLevel, Time: time.Now(), Message: "request"}
+
+	allowed := func(fields ...zapcore.Field) int {
+		n := 0
+		for i := 0; i < 10; i++ {
+			if s.allow(ent, fields) {
+				n++
+			}
+		}
+		return n
+	}
+	if n := allowed(zap.String("route", "/a")); n != 2 {
+		t.Fatalf("route /a allowed %d entries, want 2", n)
+	}
+	if n := allowed(zap.String("route", "/b")); n != 2 {
+		t.Fatalf("route /b allowed %d entries, want 2", n)
+	}
+	if n := allowed(zap.String("other", "x")); n != 10 {
+		t.Fatalf("entries without the key allowed %d entries, want all 10", n)
+	}
+}
+
+func TestKeySamplerLazyCounters(t *testing.T) {
+	s := newKeySampler("route", time.Minute, 1, 0)
+	ent := zapcore.Entry{Level: zapcore.WarnLevel, Time: time.Now(), Message: "slow"}
+	s.allow(ent, []zapcore.Field{zap.String("route", "/a")})
+	for i := range s.counts {
+		_, ok := s.counts[i].Load().(*sampleCounters)
+		if want := zapcore.DebugLevel+zapcore.Level(i) == zapcore.WarnLevel; ok != want {
+			t.Fatalf("counters of level %v allocated: %v, want %v", zapcore.DebugLevel+zapcore.Level(i), ok, want)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	sinkQueueSize     = 1024
+	sinkBatchSize     = 128
+	sinkFlushInterval = time.Second
+)
+
+// Sink 远程日志接收端, 比如日志收集服务. 日志会被编码为json格式后交给Sink;
+// Send返回错误即认为Sink不可用, 配置了SetSpillQueue时, 发送失败的日志会落到本地磁盘队列,
+// 等Sink恢复后再按原来的顺序重放. 重放的日志在进程崩溃后可能再发送一次, 需要去重时由接收端处理.
+type Sink interface {
+	// Name 用来区分不同的Sink, 同时作为磁盘队列的目录名, 进程重启前后需要保持一致
+	Name() string
+	// Send 发送一批日志(最多128条), 每个元素是一条完整的json日志(不含换行符).
+	// 分成多个请求发送时, 只有前面一部分发送成功需要返回*PartialSendError, 否则这些日志会被再发送一次
+	Send(entries [][]byte) error
+}
+
+// PartialSendError Sink.Send只发送成功了前Sent条日志, 剩下的日志按发送失败处理
+type PartialSendError struct {
+	Sent int
+	Err  error
+}
+
+func (e *PartialSendError) Error() string {
+	return fmt.Sprintf("sent %d entries: %v", e.Sent, e.Err)
+}
+
+func (e *PartialSendError) Unwrap() error {
+	return e.Err
+}
+
+// sentCount 返回Send出错时已经发送成功的条数
+func sentCount(err error, n int) int {
+	var pe *PartialSendError
+	if !errors.As(err, &pe) || pe.Sent < 0 {
+		return 0
+	}
+	if pe.Sent > n {
+		return n
+	}
+	return pe.Sent
+}
+
+// sinkWriter 将日志异步批量的写入Sink
+type sinkWriter struct {
+	sink     Sink
+	spill    *spillQueue // 未配置磁盘队列时为nil, 发送失败的日志会被丢弃
+	overflow string
+	critical zapcore.Level
+	drops    *dropCounter
+	ch       chan []byte
+	flush    chan chan struct{}
+	done     chan struct{}
+	quit     chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newSinkWriter 创建sinkWriter. 队列满时按overflow处理, 未设置时为OverflowDropLow,
+// 以免Sink的Send卡住时阻塞写日志的协程; 不低于critical级别的日志不会被丢弃,
+// 队列满时写入磁盘队列, 没有配置磁盘队列时阻塞等待
+func newSinkWriter(sink Sink, spill *spillQueue, overflow string, critical zapcore.Level, drops *dropCounter) *sinkWriter {
+	if overflow == "" {
+		overflow = OverflowDropLow
+	}
+	w := &sinkWriter{
+		sink:     sink,
+		spill:    spill,
+		overflow: overflow,
+		critical: critical,
+		drops:    drops,
+		ch:       make(chan []byte, sinkQueueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+		quit:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// push 将一条编码好的日志放入队列, 队列满时按overflow处理
+func (w *sinkWriter) push(level zapcore.Level, entry []byte) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	switch {
+	case w.closed:
+		// logger已经被替换, 仍在使用旧logger写的日志不再发送
+		w.drops.inc(level)
+	case level >= w.critical:
+		select {
+		case w.ch <- entry:
+		default:
+			w.spillCritical(level, entry)
+		}
+	case w.overflow == OverflowDrop,
+		w.overflow == OverflowDropLow && level <= zapcore.InfoLevel:
+		select {
+		case w.ch <- entry:
+		default:
+			w.drops.inc(level)
+		}
+	default:
+		w.ch <- entry
+	}
+}
+
+// spillCritical 队列满时将不低于critical级别的日志直接写入磁盘队列, 不阻塞写日志的协程;
+// 这条日志与队列中已有日志的先后顺序可能不一致. 没有配置磁盘队列时只能阻塞等待
+func (w *sinkWriter) spillCritical(level zapcore.Level, entry []byte) {
+	if w.spill == nil {
+		w.ch <- entry
+		return
+	}
+	if err := w.spill.append([][]byte{entry}); err != nil {
+		fmt.Fprintf(os.Stderr, "log: sink %s spill failed: %v\n", w.sink.Name(), err)
+		w.drops.inc(level)
+	}
+}
+
+// Sync 等待队列中的日志全部处理完毕: 发送成功或者落到磁盘队列
+func (w *sinkWriter) Sync() error {
+	done := make(chan struct{})
+	select {
+	case w.flush <- done:
+		<-done
+	case <-w.done:
+	}
+	return nil
+}
+
+// close 发送完队列中的日志后停止后台协程, 并关闭磁盘队列
+func (w *sinkWriter) close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	w.mu.Unlock()
+	close(w.quit)
+	<-w.done
+	if w.spill != nil {
+		w.spill.close()
+	}
+}
+
+func (w *sinkWriter) run() {
+	ticker := time.NewTicker(sinkFlushInterval)
+	defer ticker.Stop()
+	defer close(w.done)
+
+	var batch [][]byte
+	for {
+		select {
+		case entry := <-w.ch:
+			batch = append(batch, entry)
+			if len(batch) >= sinkBatchSize {
+				w.deliver(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			w.deliver(batch)
+			batch = nil
+			w.replay()
+		case done := <-w.flush:
+			w.deliver(w.drain(batch))
+			batch = nil
+			w.replay()
+			close(done)
+		case <-w.quit:
+			w.deliver(w.drain(batch))
+			return
+		}
+	}
+}
+
+// drain 取出队列中现有的全部日志
+func (w *sinkWriter) drain(batch [][]byte) [][]byte {
+	for {
+		select {
+		case entry := <-w.ch:
+			batch = append(batch, entry)
+		default:
+			return batch
+		}
+	}
+}
+
+// deliver 按sinkBatchSize分批发送日志(Sync和退出时取出的日志可能超过一批).
+// 磁盘队列里还有积压时直接追加到队列尾部, 以保证日志的顺序
+func (w *sinkWriter) deliver(batch [][]byte) {
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > sinkBatchSize {
+			n = sinkBatchSize
+		}
+		w.send(batch[:n])
+		batch = batch[n:]
+	}
+}
+
+func (w *sinkWriter) send(batch [][]byte) {
+	if w.spill != nil && w.spill.pending() {
+		w.spillOut(batch)
+		return
+	}
+	if err := w.sink.Send(batch); err != nil && w.spill != nil {
+		if rest := batch[sentCount(err, len(batch)):]; len(rest) > 0 {
+			w.spillOut(rest)
+		}
+	}
+}
+
+func (w *sinkWriter) spillOut(batch [][]byte) {
+	if err := w.spill.append(batch); err != nil {
+		fmt.Fprintf(os.Stderr, "log: sink %s spill failed: %v\n", w.sink.Name(), err)
+	}
+}
+
+// replay 按顺序重放磁盘队列中的日志, 直到队列为空或者Sink再次发送失败
+func (w *sinkWriter) replay() {
+	if w.spill == nil {
+		return
+	}
+	for w.spill.pending() {
+		entries, pos, err := w.spill.peek(sinkBatchSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "log: sink %s replay failed: %v\n", w.sink.Name(), err)
+			return
+		}
+		if len(entries) > 0 {
+			if err := w.sink.Send(entries); err != nil {
+				// 提交已经发送成功的部分, 以免重放时重复发送
+				if n := sentCount(err, len(entries)); n > 0 {
+					if _, pos, err = w.spill.peek(n); err == nil {
+						err = w.spill.commit(pos)
+					}
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "log: sink %s checkpoint failed: %v\n", w.sink.Name(), err)
+					}
+				}
+				return
+			}
+		}
+		// 发送成功之后, commit之前进程退出时, 这一批日志在重启后会再发送一次
+		if err := w.spill.commit(pos); err != nil {
+			fmt.Fprintf(os.Stderr, "log: sink %s checkpoint failed: %v\n", w.sink.Name(), err)
+			return
+		}
+	}
+}
+
+// newSinkWriter 为adapter的某个Sink创建writer. 磁盘队列的目录由日志文件名和Sink名组成,
+// 这样同一个Sink被多类日志使用时也不会相互干扰
+func (zapAdapter *zapAdapter) newSinkWriter(sink Sink) *sinkWriter {
+	var spill *spillQueue
+	if zapAdapter.SpillDir != "" {
+		dir := filepath.Join(zapAdapter.SpillDir, filepath.Base(zapAdapter.Path)+"."+sink.Name())
+		var err error
+		if spill, err = openSpillQueue(dir, zapAdapter.SpillMaxBytes, zapAdapter.SpillMaxAge); err != nil {
+			fmt.Fprintf(os.Stderr, "log: open spill queue %s failed: %v\n", dir, err)
+		}
+	}
+	return newSinkWriter(sink, spill, zapAdapter.Overflow, parseLevel(zapAdapter.PriorityLevel), &zapAdapter.drops)
+}
+
+// sinkCore 将日志编码为json后交给sinkWriter
+type sinkCore struct {
+	zapcore.LevelEnabler
+	enc zapcore.Encoder
+	w   *sinkWriter
+}
+
+func (c *sinkCore) With(fields []zapcore.Field) zapcore.Core {
+	enc := c.enc.Clone()
+	for i := range fields {
+		fields[i].AddTo(enc)
+	}
+	return &sinkCore{LevelEnabler: c.LevelEnabler, enc: enc, w: c.w}
+}
+
+func (c *sinkCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *sinkCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	b, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	// 编码用的buffer会被复用, 所以这里需要拷贝一份
+	entry := make([]byte, len(bytes.TrimRight(b.Bytes(), "\n")))
+	copy(entry, b.Bytes())
+	b.Free()
+	c.w.push(ent.Level, entry)
+	return nil
+}
+
+func (c *sinkCore) Sync() error {
+	return c.w.Sync()
+}
@@ -0,0 +1,166 @@
+//go:build go1.21
+
+package log
+
+import (
+	"context"
+	"log/slog"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// slogHandler 把log/slog的日志写入本包的日志文件, 按级别选择文件的方式与Debug,Info等函数一致.
+// json格式中slog的分组输出为嵌套的对象, csv格式中输出为用.连接的键, 如req.method.
+// 日志文件中每条日志都有时间, Record.Time为零时使用写入的时间
+type slogHandler struct {
+	groups []string
+	attrs  [][]slog.Attr // attrs[i]为在第i层分组中通过WithAttrs加入的属性, 比groups多一层
+}
+
+// NewSlogHandler 返回写入本包日志的slog.Handler, 需要在Init之后使用.
+// 使用方法: slog.SetDefault(slog.New(log.NewSlogHandler()))
+func NewSlogHandler() slog.Handler {
+	return &slogHandler{attrs: make([][]slog.Attr, 1)}
+}
+
+// slogLevel 将slog的级别转换为zap的级别, 高于error的级别也按error处理
+func slogLevel(level slog.Level) zapcore.Level {
+	switch {
+	case level < slog.LevelInfo:
+		return zapcore.DebugLevel
+	case level < slog.LevelWarn:
+		return zapcore.InfoLevel
+	case level < slog.LevelError:
+		return zapcore.WarnLevel
+	}
+	return zapcore.ErrorLevel
+}
+
+func (h *slogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	if logger == nil {
+		return false
+	}
+	zl := slogLevel(level)
+	return levelAdapter(zl).enabled(zl)
+}
+
+func (h *slogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if logger == nil {
+		return nil
+	}
+	level := slogLevel(r.Level)
+	adapter := levelAdapter(level)
+
+	record := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		record = append(record, a)
+		return true
+	})
+	fields := append(slogFields(h.nest(record), "", adapter.LogType == "csv"), traceFields(ctx)...)
+	adapter.logEntry(level, r.Time, pcCaller(r.PC), r.Message, fields...)
+	return nil
+}
+
+// nest 把各层分组的属性和这条日志的属性合并为一组嵌套的属性
+func (h *slogHandler) nest(record []slog.Attr) []slog.Attr {
+	depth := len(h.groups)
+	attrs := append(append([]slog.Attr(nil), h.attrs[depth]...), record...)
+	for i := depth - 1; i >= 0; i-- {
+		outer := append([]slog.Attr(nil), h.attrs[i]...)
+		if len(attrs) > 0 {
+			outer = append(outer, slog.Attr{Key: h.groups[i], Value: slog.GroupValue(attrs...)})
+		}
+		attrs = outer
+	}
+	return attrs
+}
+
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	clone := h.clone()
+	depth := len(clone.groups)
+	clone.attrs[depth] = append(append([]slog.Attr(nil), clone.attrs[depth]...), attrs...)
+	return clone
+}
+
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := h.clone()
+	clone.groups = append(clone.groups, name)
+	clone.attrs = append(clone.attrs, nil)
+	return clone
+}
+
+func (h *slogHandler) clone() *slogHandler {
+	return &slogHandler{
+		groups: append([]string(nil), h.groups...),
+		attrs:  append([][]slog.Attr(nil), h.attrs...),
+	}
+}
+
+// slogFields 将slog的属性转换为zap的字段. flat为true时分组展开为prefix.key形式的字段, 否则为嵌套的对象
+func slogFields(attrs []slog.Attr, prefix string, flat bool) []zapcore.Field {
+	fields := make([]zapcore.Field, 0, len(attrs))
+	for _, a := range attrs {
+		a.Value = a.Value.Resolve()
+		if a.Equal(slog.Attr{}) {
+			continue
+		}
+		if a.Value.Kind() == slog.KindGroup {
+			group := a.Value.Group()
+			if len(group) == 0 {
+				continue
+			}
+			switch {
+			case a.Key == "":
+				// 没有名字的分组直接展开到当前层
+				fields = append(fields, slogFields(group, prefix, flat)...)
+			case flat:
+				fields = append(fields, slogFields(group, prefix+a.Key+".", flat)...)
+			default:
+				fields = append(fields, zap.Object(prefix+a.Key, slogGroup(group)))
+			}
+			continue
+		}
+		fields = append(fields, slogField(prefix+a.Key, a.Value))
+	}
+	return fields
+}
+
+func slogField(key string, v slog.Value) zapcore.Field {
+	switch v.Kind() {
+	case slog.KindString:
+		return zap.String(key, v.String())
+	case slog.KindInt64:
+		return zap.Int64(key, v.Int64())
+	case slog.KindUint64:
+		return zap.Uint64(key, v.Uint64())
+	case slog.KindFloat64:
+		return zap.Float64(key, v.Float64())
+	case slog.KindBool:
+		return zap.Bool(key, v.Bool())
+	case slog.KindDuration:
+		return zap.Duration(key, v.Duration())
+	case slog.KindTime:
+		return zap.Time(key, v.Time())
+	}
+	if err, ok := v.Any().(error); ok {
+		return zap.String(key, err.Error())
+	}
+	return zap.Any(key, v.Any())
+}
+
+// slogGroup 嵌套输出slog的分组
+type slogGroup []slog.Attr
+
+func (g slogGroup) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, f := range slogFields(g, "", false) {
+		f.AddTo(enc)
+	}
+	return nil
+}
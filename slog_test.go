@@ -0,0 +1,148 @@
+//go:build go1.21
+
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/slogtest"
+)
+
+const zeroTimeKey = "zero_time"
+
+// zeroTimeHandler 标记Record.Time为零的日志
+type zeroTimeHandler struct {
+	slog.Handler
+}
+
+func (h zeroTimeHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Time.IsZero() {
+		r.AddAttrs(slog.Bool(zeroTimeKey, true))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h zeroTimeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return zeroTimeHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h zeroTimeHandler) WithGroup(name string) slog.Handler {
+	return zeroTimeHandler{h.Handler.WithGroup(name)}
+}
+
+func TestSlogHandler(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "app.log")
+	Init(path, DebugLevel, false, false)
+	defer func() { logger.close(); logger = nil }()
+
+	results := func() []map[string]any {
+		Sync()
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ms []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var m map[string]any
+			if err := json.Unmarshal([]byte(line), &m); err != nil {
+				t.Fatalf("%v: %s", err, line)
+			}
+			// 时间的键为ts. 日志文件中每条日志都有时间, Record.Time为零时使用写入的时间
+			if ts, ok := m["ts"]; ok && m[zeroTimeKey] == nil {
+				m[slog.TimeKey] = ts
+			}
+			delete(m, "ts")
+			delete(m, zeroTimeKey)
+			ms = append(ms, m)
+		}
+		return ms
+	}
+	if err := slogtest.TestHandler(zeroTimeHandler{NewSlogHandler()}, results); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSlogLevels(t *testing.T) {
+	dir := tempDir(t)
+	Init(filepath.Join(dir, "app.log"), InfoLevel, false, false)
+	l := slog.New(NewSlogHandler())
+	if l.Enabled(context.Background(), slog.LevelDebug) || !l.Enabled(context.Background(), slog.LevelInfo) {
+		t.Fatal("Enabled does not follow the level of the main log")
+	}
+	logger.close()
+
+	Init(filepath.Join(dir, "app.log"), DebugLevel, false, true)
+	defer func() { logger.close(); logger = nil }()
+	l = slog.New(NewSlogHandler())
+	l.Log(context.Background(), slog.LevelDebug-4, "slog debug-4")
+	l.Info("slog info")
+	l.Log(context.Background(), slog.LevelWarn+2, "slog warn+2")
+	l.Log(context.Background(), slog.LevelError+4, "slog error+4")
+
+	// 介于两个级别之间的按较低的级别处理, 低于debug的按debug处理, 高于error的按error处理
+	for file, msg := range map[string]string{
+		"app.log.DEBUG": "slog debug-4",
+		"app.log.INFO":  "slog info",
+		"app.log.WARN":  "slog warn+2",
+		"app.log.ERROR": "slog error+4",
+	} {
+		if lines := readLines(t, filepath.Join(dir, file), "slog"); len(lines) != 1 || !strings.Contains(lines[0], msg) {
+			t.Errorf("%s: %v, want %s", file, lines, msg)
+		}
+	}
+}
+
+func TestSlogGroupsCSV(t *testing.T) {
+	dir := tempDir(t)
+	Init(filepath.Join(dir, "app.log"), InfoLevel, false, false, SetLogType("csv"))
+	defer func() { logger.close(); logger = nil }()
+
+	l := slog.New(NewSlogHandler()).With("app", "demo").WithGroup("req").With("method", "GET")
+	l.Info("grouped", slog.Group("user", "id", 1), "path", "/a")
+	want := `"grouped","app:demo","req.method:GET","req.user.id:1","req.path:/a"`
+	if line := readLines(t, filepath.Join(dir, "app.log.csv"), "grouped")[0]; !strings.HasSuffix(line, want) {
+		t.Errorf("csv = %s, want suffix %s", line, want)
+	}
+}
+
+func TestSlogTraceFields(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "app.log")
+	Init(path, InfoLevel, false, false)
+	defer func() { logger.close(); logger = nil }()
+
+	l := slog.New(NewSlogHandler())
+	l.InfoContext(spanContext(t), "slog with span")
+	l.InfoContext(context.Background(), "slog without span")
+
+	line := readLines(t, path, "slog with span")[0]
+	if !strings.Contains(line, `"trace_id":"`+testTraceID+`"`) || !strings.Contains(line, `"span_id":"`+testSpanID+`"`) {
+		t.Errorf("missing trace fields: %s", line)
+	}
+	if line := readLines(t, path, "slog without span")[0]; strings.Contains(line, "trace_id") {
+		t.Errorf("trace fields without a span: %s", line)
+	}
+}
+
+func TestSlogDefaultCaller(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "app.log")
+	Init(path, InfoLevel, false, false, SetCaller(true))
+	defer func() { logger.close(); logger = nil }()
+
+	// 没有调用slog.SetDefault时, slog的默认Handler通过标准库log包输出
+	restore := RedirectStdLog(InfoLevel)
+	defer restore()
+	slog.Info("slog default")
+	want := fmt.Sprintf(`slog_test.go:%d"`, line()-1)
+	if l := readLines(t, path, "slog default"); len(l) != 1 || !strings.Contains(l[0], want) {
+		t.Errorf("caller is not %s: %v", want, l)
+	}
+}
@@ -0,0 +1,404 @@
+package log
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spillSegmentExt  = ".seg"
+	spillCheckpoint  = "checkpoint"
+	spillMinSegSize  = 4 << 10
+	spillMaxSegSize  = 64 << 20
+	spillDefaultSize = 1 << 30
+)
+
+// spillPos 磁盘队列中的位置: 段文件序号和段内偏移
+type spillPos struct {
+	seg uint64
+	off int64
+}
+
+// spillQueue 基于段文件的磁盘队列. 每条记录为4字节大端长度加日志内容;
+// checkpoint文件记录下一条待重放记录的位置, 每次重放成功后更新, 进程重启后从checkpoint继续, 不会丢失日志.
+// 发送成功之后, 更新checkpoint之前进程退出时, 这一批日志会在重启后再发送一次, 即至少发送一次(at-least-once).
+// 进程崩溃时段文件尾部可能留下写了一半的记录, 打开队列时会截掉, 并且重启后总是写入新的段文件.
+type spillQueue struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	segSize  int64
+
+	mu    sync.Mutex
+	segs  []uint64         // 现有的段文件序号, 升序
+	sizes map[uint64]int64 // 段文件大小
+	w     *os.File         // 正在写入的段文件, 总是segs中的最后一个
+	ck    spillPos
+}
+
+func openSpillQueue(dir string, maxBytes int64, maxAge time.Duration) (*spillQueue, error) {
+	if maxBytes <= 0 {
+		maxBytes = spillDefaultSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &spillQueue{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		segSize:  maxBytes / 8,
+		sizes:    make(map[uint64]int64),
+	}
+	if q.segSize < spillMinSegSize {
+		q.segSize = spillMinSegSize
+	}
+	if q.segSize > spillMaxSegSize {
+		q.segSize = spillMaxSegSize
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		var seq uint64
+		if !strings.HasSuffix(f.Name(), spillSegmentExt) {
+			continue
+		}
+		if _, err := fmt.Sscanf(f.Name(), "%d"+spillSegmentExt, &seq); err != nil {
+			continue
+		}
+		q.segs = append(q.segs, seq)
+		q.sizes[seq] = f.Size()
+	}
+	sort.Slice(q.segs, func(i, j int) bool { return q.segs[i] < q.segs[j] })
+	for _, seq := range q.segs {
+		if err := q.repair(seq); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := q.readCheckpoint(); err != nil {
+		return nil, err
+	}
+	if size, ok := q.sizes[q.ck.seg]; ok && q.ck.off > size {
+		q.ck.off = size
+	}
+	// 已经重放完的段文件直接删除
+	for len(q.segs) > 1 && q.segs[0] < q.ck.seg {
+		q.removeOldest()
+	}
+	if _, ok := q.sizes[q.ck.seg]; !ok && len(q.segs) > 0 {
+		// checkpoint指向的段文件已经不存在, 从之后的第一个段开始重放
+		q.ck = q.nextPos(q.ck.seg)
+		if err := q.writeCheckpoint(); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// repair 截掉段文件尾部不完整的记录
+func (q *spillQueue) repair(seq uint64) error {
+	path := q.segPath(seq)
+	size, err := validLength(path)
+	if err != nil {
+		return err
+	}
+	if size == q.sizes[seq] {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "log: spill segment %s has a torn tail, truncated %d bytes\n", path, q.sizes[seq]-size)
+	if err := os.Truncate(path, size); err != nil {
+		return err
+	}
+	q.sizes[seq] = size
+	return nil
+}
+
+// validLength 返回段文件开头完整记录的总长度
+func validLength(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var off int64
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return off, nil
+			}
+			return off, err
+		}
+		n := int64(binary.BigEndian.Uint32(header[:]))
+		if _, err := io.CopyN(ioutil.Discard, r, n); err != nil {
+			if err == io.EOF {
+				return off, nil
+			}
+			return off, err
+		}
+		off += int64(len(header)) + n
+	}
+}
+
+func (q *spillQueue) segPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, spillSegmentExt))
+}
+
+func (q *spillQueue) readCheckpoint() error {
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, spillCheckpoint))
+	if os.IsNotExist(err) {
+		if len(q.segs) > 0 {
+			q.ck = spillPos{seg: q.segs[0]}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Sscanf(string(data), "%d %d", &q.ck.seg, &q.ck.off); err != nil {
+		return fmt.Errorf("invalid checkpoint: %v", err)
+	}
+	return nil
+}
+
+// writeCheckpoint 先写临时文件再改名, 避免进程中途退出时留下损坏的checkpoint
+func (q *spillQueue) writeCheckpoint() error {
+	path := filepath.Join(q.dir, spillCheckpoint)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", q.ck.seg, q.ck.off)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// pending 队列中是否还有未重放的日志
+func (q *spillQueue) pending() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pendingLocked()
+}
+
+func (q *spillQueue) pendingLocked() bool {
+	if len(q.segs) == 0 {
+		return false
+	}
+	last := q.segs[len(q.segs)-1]
+	return q.ck.seg < last || q.ck.off < q.sizes[last]
+}
+
+// append 将一批日志追加到队列尾部, 并按大小和时间清理最旧的段文件
+func (q *spillQueue) append(entries [][]byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var header [4]byte
+	for _, entry := range entries {
+		if err := q.ensureWriter(); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(header[:], uint32(len(entry)))
+		if _, err := q.w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := q.w.Write(entry); err != nil {
+			return err
+		}
+		q.sizes[q.segs[len(q.segs)-1]] += int64(len(header) + len(entry))
+	}
+	if err := q.w.Sync(); err != nil {
+		return err
+	}
+	return q.enforceLimits()
+}
+
+// ensureWriter 保证有可写的段文件, 当前段写满后切换到新段. 打开队列之前就存在的段文件只读不写,
+// 以免追加在可能损坏的段后面
+func (q *spillQueue) ensureWriter() error {
+	if q.w != nil && q.sizes[q.segs[len(q.segs)-1]] < q.segSize {
+		return nil
+	}
+
+	if q.w != nil {
+		q.w.Close()
+		q.w = nil
+	}
+	var seq uint64 = 1
+	if len(q.segs) > 0 {
+		seq = q.segs[len(q.segs)-1] + 1
+	}
+	f, err := os.OpenFile(q.segPath(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if len(q.segs) == 0 || !q.pendingLocked() {
+		q.ck = spillPos{seg: seq}
+	}
+	q.segs = append(q.segs, seq)
+	q.sizes[seq] = 0
+	q.w = f
+	return nil
+}
+
+// enforceLimits 超过容量或者保存时间的段文件会被删除, 其中未重放的日志也随之丢弃
+func (q *spillQueue) enforceLimits() error {
+	var total int64
+	for _, seq := range q.segs {
+		total += q.sizes[seq]
+	}
+	dropped := false
+	for len(q.segs) > 1 && total > q.maxBytes {
+		total -= q.sizes[q.segs[0]]
+		q.removeOldest()
+		dropped = true
+	}
+	if q.maxAge > 0 {
+		deadline := time.Now().Add(-q.maxAge)
+		for len(q.segs) > 1 {
+			info, err := os.Stat(q.segPath(q.segs[0]))
+			if err == nil && info.ModTime().After(deadline) {
+				break
+			}
+			q.removeOldest()
+			dropped = true
+		}
+	}
+	if dropped && q.ck.seg < q.segs[0] {
+		q.ck = spillPos{seg: q.segs[0]}
+		return q.writeCheckpoint()
+	}
+	return nil
+}
+
+func (q *spillQueue) removeOldest() {
+	seq := q.segs[0]
+	os.Remove(q.segPath(seq))
+	delete(q.sizes, seq)
+	q.segs = q.segs[1:]
+}
+
+// peek 从checkpoint开始读取最多max条日志, 返回读取后的位置; 位置需要在发送成功后通过commit提交
+func (q *spillQueue) peek(max int) ([][]byte, spillPos, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pos := q.ck
+	f, err := os.Open(q.segPath(pos.seg))
+	if os.IsNotExist(err) {
+		// 段文件在打开队列之后被外部删除, 跳过这个段, 否则重放会一直失败
+		fmt.Fprintf(os.Stderr, "log: spill segment %s is missing, skipped\n", q.segPath(pos.seg))
+		q.forget(pos.seg)
+		return nil, q.nextPos(pos.seg), nil
+	}
+	if err != nil {
+		return nil, pos, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(pos.off, io.SeekStart); err != nil {
+		return nil, pos, err
+	}
+
+	r := bufio.NewReader(f)
+	size := q.sizes[pos.seg]
+	var entries [][]byte
+	var header [4]byte
+	for len(entries) < max && pos.off < size {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			q.skipDamaged(&pos, size, err)
+			break
+		}
+		entry := make([]byte, binary.BigEndian.Uint32(header[:]))
+		if _, err := io.ReadFull(r, entry); err != nil {
+			q.skipDamaged(&pos, size, err)
+			break
+		}
+		entries = append(entries, entry)
+		pos.off += int64(len(header) + len(entry))
+	}
+	// 当前段已经读完, 后面还有段时切换到下一段
+	if len(entries) < max && pos.seg != q.segs[len(q.segs)-1] {
+		for _, seq := range q.segs {
+			if seq > pos.seg {
+				pos = spillPos{seg: seq}
+				break
+			}
+		}
+	}
+	return entries, pos, nil
+}
+
+// forget 从队列中去掉已经不存在的段文件
+func (q *spillQueue) forget(seq uint64) {
+	for i, s := range q.segs {
+		if s != seq {
+			continue
+		}
+		if i == len(q.segs)-1 && q.w != nil {
+			q.w.Close()
+			q.w = nil
+		}
+		q.segs = append(q.segs[:i], q.segs[i+1:]...)
+		delete(q.sizes, seq)
+		return
+	}
+}
+
+// nextPos 返回seq之后第一个段的开头. 没有更新的段时, 之前的段都已经重放过, 返回最后一个段的结尾
+func (q *spillQueue) nextPos(seq uint64) spillPos {
+	for _, s := range q.segs {
+		if s > seq {
+			return spillPos{seg: s}
+		}
+	}
+	if len(q.segs) > 0 {
+		last := q.segs[len(q.segs)-1]
+		return spillPos{seg: last, off: q.sizes[last]}
+	}
+	return spillPos{seg: seq}
+}
+
+// skipDamaged 段文件在打开之后被外部修改而读不出完整的记录时, 跳过段内剩余的内容, 保证重放能继续进行
+func (q *spillQueue) skipDamaged(pos *spillPos, size int64, err error) {
+	fmt.Fprintf(os.Stderr, "log: spill segment %s damaged at offset %d, skipped %d bytes: %v\n",
+		q.segPath(pos.seg), pos.off, size-pos.off, err)
+	pos.off = size
+}
+
+// commit 提交重放进度, 并删除已经重放完毕的段文件
+func (q *spillQueue) commit(pos spillPos) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.ck = pos
+	for len(q.segs) > 1 && q.segs[0] < q.ck.seg {
+		q.removeOldest()
+	}
+	return q.writeCheckpoint()
+}
+
+// close 关闭正在写入的段文件
+func (q *spillQueue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.w == nil {
+		return nil
+	}
+	err := q.w.Close()
+	q.w = nil
+	return err
+}
@@ -0,0 +1,385 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// tempDir 创建测试用的临时目录, 测试结束后删除
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "log-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func spillEntries(prefix string, n int) [][]byte {
+	entries := make([][]byte, n)
+	for i := range entries {
+		entries[i] = []byte(fmt.Sprintf("%s-%d", prefix, i))
+	}
+	return entries
+}
+
+func drainSpill(t *testing.T, q *spillQueue) []string {
+	t.Helper()
+	var got []string
+	for i := 0; q.pending(); i++ {
+		if i > 100 {
+			t.Fatal("replay does not make progress")
+		}
+		entries, pos, err := q.peek(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			got = append(got, string(e))
+		}
+		if err := q.commit(pos); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return got
+}
+
+func TestSpillQueueTornTail(t *testing.T) {
+	dir := tempDir(t)
+	q, err := openSpillQueue(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.append(spillEntries("a", 3)); err != nil {
+		t.Fatal(err)
+	}
+	seg := q.segPath(q.segs[len(q.segs)-1])
+	q.close()
+
+	// 模拟崩溃: 最后一条记录只写了长度和一部分内容
+	f, err := os.OpenFile(seg, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 100, 'x', 'y'})
+	f.Close()
+
+	q, err = openSpillQueue(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+	if err := q.append(spillEntries("b", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.segs) != 2 {
+		t.Fatalf("append after restart should start a new segment, got segments %v", q.segs)
+	}
+	got := drainSpill(t, q)
+	want := []string{"a-0", "a-1", "a-2", "b-0", "b-1"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+}
+
+func TestSpillQueueRestart(t *testing.T) {
+	dir := tempDir(t)
+	q, err := openSpillQueue(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.append(spillEntries("a", 5)); err != nil {
+		t.Fatal(err)
+	}
+	entries, pos, err := q.peek(2)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("peek = %d entries, %v", len(entries), err)
+	}
+	if err := q.commit(pos); err != nil {
+		t.Fatal(err)
+	}
+	// 第二批读出后没有提交, 重启后需要重新发送
+	if _, _, err := q.peek(2); err != nil {
+		t.Fatal(err)
+	}
+	q.close()
+
+	q, err = openSpillQueue(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+	got := drainSpill(t, q)
+	want := []string{"a-2", "a-3", "a-4"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+
+	q.close()
+	q, err = openSpillQueue(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.pending() {
+		t.Fatal("committed entries are replayed again after restart")
+	}
+}
+
+type testSink struct {
+	mu   sync.Mutex
+	fail bool
+	got  []string
+}
+
+func (s *testSink) Name() string {
+	return "test"
+}
+
+func (s *testSink) Send(entries [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return errors.New("unavailable")
+	}
+	for _, e := range entries {
+		s.got = append(s.got, string(e))
+	}
+	return nil
+}
+
+func (s *testSink) setFail(fail bool) {
+	s.mu.Lock()
+	s.fail = fail
+	s.mu.Unlock()
+}
+
+func TestSinkWriterReplayOrder(t *testing.T) {
+	spill, err := openSpillQueue(tempDir(t), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spill.close()
+	sink := &testSink{fail: true}
+	var drops dropCounter
+	w := newSinkWriter(sink, spill, OverflowBlock, zapcore.ErrorLevel, &drops)
+
+	var want []string
+	for i := 0; i < 300; i++ {
+		entry := fmt.Sprintf("e-%d", i)
+		want = append(want, entry)
+		w.push(zapcore.InfoLevel, []byte(entry))
+		if i == 150 {
+			w.Sync()
+			sink.setFail(false)
+		}
+	}
+	w.Sync()
+	if spill.pending() {
+		t.Fatal("spill queue is not drained after the sink recovered")
+	}
+	if fmt.Sprint(sink.got) != fmt.Sprint(want) {
+		t.Fatalf("sink got %d entries out of order", len(sink.got))
+	}
+}
+
+func TestSinkWriterOverflow(t *testing.T) {
+	block := make(chan struct{})
+	sink := &blockingSink{block: block}
+	var drops dropCounter
+	w := newSinkWriter(sink, nil, "", zapcore.ErrorLevel, &drops)
+	defer close(block)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < sinkQueueSize+2*sinkBatchSize; i++ {
+			w.push(zapcore.InfoLevel, []byte("info"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push blocks while the sink hangs")
+	}
+	if drops.snapshot()["info"] == 0 {
+		t.Fatal("dropped info entries are not counted")
+	}
+}
+
+type blockingSink struct {
+	block chan struct{}
+}
+
+func (s *blockingSink) Name() string {
+	return "blocking"
+}
+
+func (s *blockingSink) Send(entries [][]byte) error {
+	<-s.block
+	return nil
+}
+
+// partialSink 每批最多接受accept条日志, 其余的返回*PartialSendError, 并记录每批的大小
+type partialSink struct {
+	testSink
+	accept  int
+	batches []int
+}
+
+func (s *partialSink) Send(entries [][]byte) error {
+	s.mu.Lock()
+	s.batches = append(s.batches, len(entries))
+	accept := s.accept
+	s.mu.Unlock()
+	if len(entries) <= accept {
+		return s.testSink.Send(entries)
+	}
+	if err := s.testSink.Send(entries[:accept]); err != nil {
+		return err
+	}
+	return &PartialSendError{Sent: accept, Err: errors.New("unavailable")}
+}
+
+func TestSinkWriterBatchSize(t *testing.T) {
+	sink := &partialSink{accept: 1 << 30}
+	var drops dropCounter
+	w := newSinkWriter(sink, nil, OverflowBlock, zapcore.ErrorLevel, &drops)
+	defer w.close()
+
+	// Sync和退出时从队列中取出的日志可能超过一批
+	batch := make([][]byte, 300)
+	for i := range batch {
+		batch[i] = []byte("e")
+	}
+	w.deliver(batch)
+	if fmt.Sprint(sink.batches) != fmt.Sprint([]int{sinkBatchSize, sinkBatchSize, 300 - 2*sinkBatchSize}) {
+		t.Fatalf("sent batches of %v entries", sink.batches)
+	}
+}
+
+func TestSinkWriterPartialSend(t *testing.T) {
+	spill, err := openSpillQueue(tempDir(t), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spill.close()
+	sink := &partialSink{accept: 50}
+	var drops dropCounter
+	w := newSinkWriter(sink, spill, OverflowBlock, zapcore.ErrorLevel, &drops)
+
+	var want []string
+	for i := 0; i < 300; i++ {
+		entry := fmt.Sprintf("e-%d", i)
+		want = append(want, entry)
+		w.push(zapcore.InfoLevel, []byte(entry))
+	}
+	w.Sync()
+	sink.mu.Lock()
+	sink.accept = sinkBatchSize
+	sink.mu.Unlock()
+	w.Sync()
+
+	if spill.pending() {
+		t.Fatal("spill queue is not drained")
+	}
+	if fmt.Sprint(sink.got) != fmt.Sprint(want) {
+		t.Fatalf("sink got %d entries, want %d in order without duplicates", len(sink.got), len(want))
+	}
+}
+
+func TestSpillQueueSmallLimit(t *testing.T) {
+	q, err := openSpillQueue(tempDir(t), 64<<10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+	entry := make([]byte, 1000)
+	for i := 0; i < 200; i++ {
+		if err := q.append([][]byte{entry}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var total int64
+	for _, seq := range q.segs {
+		total += q.sizes[seq]
+	}
+	if total > 64<<10+q.segSize {
+		t.Fatalf("queue holds %d bytes, limit is %d", total, 64<<10)
+	}
+}
+
+func TestSpillQueueMissingSegment(t *testing.T) {
+	dir := tempDir(t)
+	q, err := openSpillQueue(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.append(spillEntries("a", 2))
+	q.close()
+	q, err = openSpillQueue(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.append(spillEntries("b", 2))
+	q.close()
+
+	// checkpoint指向的段文件被删除后, 从下一个段继续重放
+	os.Remove(q.segPath(q.segs[0]))
+	q, err = openSpillQueue(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := drainSpill(t, q); fmt.Sprint(got) != "[b-0 b-1]" {
+		t.Fatalf("replayed %v after the checkpoint segment was removed", got)
+	}
+
+	// 运行时段文件被删除
+	q.append(spillEntries("c", 2))
+	os.Remove(q.segPath(q.segs[len(q.segs)-1]))
+	if got := drainSpill(t, q); len(got) != 0 {
+		t.Fatalf("replayed %v from a removed segment", got)
+	}
+	q.append(spillEntries("d", 1))
+	defer q.close()
+	if got := drainSpill(t, q); fmt.Sprint(got) != "[d-0]" {
+		t.Fatalf("replayed %v after a segment was removed", got)
+	}
+}
+
+func TestSinkWriterSpillCritical(t *testing.T) {
+	spill, err := openSpillQueue(tempDir(t), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := make(chan struct{})
+	sink := &blockingSink{block: block}
+	var drops dropCounter
+	w := newSinkWriter(sink, spill, "", zapcore.ErrorLevel, &drops)
+	defer close(block)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < sinkQueueSize+2*sinkBatchSize; i++ {
+			w.push(zapcore.ErrorLevel, []byte("error"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("critical entries block while the sink hangs")
+	}
+	if !spill.pending() {
+		t.Fatal("critical entries are not spilled when the queue is full")
+	}
+	if n := drops.snapshot()["error"]; n != 0 {
+		t.Fatalf("dropped %d critical entries", n)
+	}
+}
@@ -0,0 +1,426 @@
+package log
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// SQL日志的字段名
+const (
+	SQLKeyOp           = "op"
+	SQLKeyQuery        = "query"
+	SQLKeyArgs         = "args"
+	SQLKeyArgValues    = "arg_values"
+	SQLKeyLatency      = "latency_ms"
+	SQLKeyRowsAffected = "rows_affected"
+	SQLKeyError        = "error"
+	SQLKeyRequestID    = "request_id"
+)
+
+// SQL日志的操作类型
+const (
+	SQLOpExec    = "exec"
+	SQLOpQuery   = "query"
+	SQLOpPrepare = "prepare"
+)
+
+// DefaultSlowQuery 默认的慢查询阈值
+const DefaultSlowQuery = time.Second
+
+const sqlMessage = "sql"
+
+type sqlConfig struct {
+	slow    time.Duration
+	argMask string
+}
+
+type SQLOption interface {
+	apply(*sqlConfig)
+}
+
+type sqlOptionFunc func(*sqlConfig)
+
+func (f sqlOptionFunc) apply(c *sqlConfig) {
+	f(c)
+}
+
+// WithSlowQuery 耗时超过d的语句以warn级别记录, 默认为DefaultSlowQuery, 为0时不区分慢查询
+func WithSlowQuery(d time.Duration) SQLOption {
+	return sqlOptionFunc(func(c *sqlConfig) {
+		c.slow = d
+	})
+}
+
+// WithSQLArgMask 设置参数值的脱敏方式, 可以是MaskFull(默认),MaskLast4,MaskHash, 为空时记录原值.
+// 无论哪种方式, 全局的脱敏规则(SetRedactPattern等)同样会作用于SQL日志
+func WithSQLArgMask(mask string) SQLOption {
+	return sqlOptionFunc(func(c *sqlConfig) {
+		c.argMask = mask
+	})
+}
+
+// WrapDriver 包装d并以name注册到database/sql, 记录每条语句的内容,参数个数和脱敏后的参数值,耗时,影响的行数和错误,
+// 写入SQL日志. 执行出错的语句以error级别记录, 慢查询以warn级别记录. 与sql.Register相同, name重复时会panic.
+// 使用方法: log.WrapDriver("mysql-log", &mysql.MySQLDriver{}); db, err := sql.Open("mysql-log", dsn)
+func WrapDriver(name string, d driver.Driver, opts ...SQLOption) {
+	c := &sqlConfig{slow: DefaultSlowQuery, argMask: MaskFull}
+	for _, opt := range opts {
+		opt.apply(c)
+	}
+	sql.Register(name, &sqlDriver{Driver: d, conf: c})
+}
+
+// sqlEntry 一条SQL日志
+type sqlEntry struct {
+	op      string
+	query   string
+	args    []driver.NamedValue
+	latency time.Duration
+	rows    int64 // 影响的行数, 查询和出错时为-1
+	err     error
+}
+
+// log 写一条SQL日志. driver.ErrSkip表示由database/sql改用其它方式执行, 不记录
+func (c *sqlConfig) log(ctx context.Context, e sqlEntry) {
+	if logger == nil || e.err == driver.ErrSkip {
+		return
+	}
+	level := zapcore.InfoLevel
+	switch {
+	case e.err != nil:
+		level = zapcore.ErrorLevel
+	case c.slow > 0 && e.latency >= c.slow:
+		level = zapcore.WarnLevel
+	}
+	errText := ""
+	if e.err != nil {
+		errText = e.err.Error()
+	}
+	requestID := ""
+	if ctx != nil {
+		requestID = RequestIDFromContext(ctx)
+	}
+	logger.adapters[FileTypeSQL].Log(level, sqlMessage,
+		zap.String(SQLKeyOp, e.op),
+		zap.String(SQLKeyQuery, e.query),
+		zap.Int(SQLKeyArgs, len(e.args)),
+		zap.Strings(SQLKeyArgValues, c.argValues(e.args)),
+		zap.Float64(SQLKeyLatency, float64(e.latency)/float64(time.Millisecond)),
+		zap.Int64(SQLKeyRowsAffected, e.rows),
+		zap.String(SQLKeyError, errText),
+		zap.String(SQLKeyRequestID, requestID),
+	)
+}
+
+// argValues 按argMask对参数值脱敏, NULL不脱敏. 命名参数记为name=value
+func (c *sqlConfig) argValues(args []driver.NamedValue) []string {
+	values := make([]string, len(args))
+	for i, arg := range args {
+		var v string
+		switch value := arg.Value.(type) {
+		case nil:
+			v = "NULL"
+		case []byte:
+			if utf8.Valid(value) {
+				v = string(value)
+			} else {
+				v = fmt.Sprintf("<%d bytes>", len(value))
+			}
+		case time.Time:
+			v = value.Format(time.RFC3339Nano)
+		default:
+			v = fmt.Sprint(value)
+		}
+		if arg.Value != nil && c.argMask != "" {
+			v = logger.redactor.mask(c.argMask, v)
+		}
+		if arg.Name != "" {
+			v = arg.Name + "=" + v
+		}
+		values[i] = v
+	}
+	return values
+}
+
+// sqlDriver 包装driver.Driver, 返回的连接会记录执行的语句
+type sqlDriver struct {
+	driver.Driver
+	conf *sqlConfig
+}
+
+func (d *sqlDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return wrapConn(conn, d.conf), nil
+}
+
+// OpenConnector 底层驱动实现了driver.DriverContext时使用它的Connector, 否则与sql.Open的默认行为一致
+func (d *sqlDriver) OpenConnector(name string) (driver.Connector, error) {
+	if dc, ok := d.Driver.(driver.DriverContext); ok {
+		connector, err := dc.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+		return &sqlConnector{Connector: connector, driver: d}, nil
+	}
+	return &sqlConnector{name: name, driver: d}, nil
+}
+
+type sqlConnector struct {
+	driver.Connector // 为nil时用driver.Open(name)打开连接
+	name             string
+	driver           *sqlDriver
+}
+
+func (c *sqlConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if c.Connector == nil {
+		return c.driver.Open(c.name)
+	}
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return wrapConn(conn, c.driver.conf), nil
+}
+
+func (c *sqlConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// sqlConn 包装driver.Conn. database/sql按接口判断驱动支持的功能, 所以这里实现了记录语句的可选接口,
+// 底层连接不支持时按database/sql的约定返回driver.ErrSkip或使用旧的接口
+type sqlConn struct {
+	driver.Conn
+	conf *sqlConfig
+}
+
+// wrapConn 包装conn. Ping,ResetSession和IsValid不需要记录, 但是database/sql会根据它们是否存在改变行为
+// (比如不支持SessionResetter时不重置连接), 所以只在conn实现了这些接口时才转发
+func wrapConn(conn driver.Conn, conf *sqlConfig) driver.Conn {
+	c := &sqlConn{Conn: conn, conf: conf}
+	pinger, isPinger := conn.(driver.Pinger)
+	resetter, isResetter := conn.(driver.SessionResetter)
+	validator, isValidator := conn.(driver.Validator)
+	switch {
+	case isPinger && isResetter && isValidator:
+		return struct {
+			*sqlConn
+			driver.Pinger
+			driver.SessionResetter
+			driver.Validator
+		}{c, pinger, resetter, validator}
+	case isPinger && isResetter:
+		return struct {
+			*sqlConn
+			driver.Pinger
+			driver.SessionResetter
+		}{c, pinger, resetter}
+	case isPinger && isValidator:
+		return struct {
+			*sqlConn
+			driver.Pinger
+			driver.Validator
+		}{c, pinger, validator}
+	case isResetter && isValidator:
+		return struct {
+			*sqlConn
+			driver.SessionResetter
+			driver.Validator
+		}{c, resetter, validator}
+	case isPinger:
+		return struct {
+			*sqlConn
+			driver.Pinger
+		}{c, pinger}
+	case isResetter:
+		return struct {
+			*sqlConn
+			driver.SessionResetter
+		}{c, resetter}
+	case isValidator:
+		return struct {
+			*sqlConn
+			driver.Validator
+		}{c, validator}
+	}
+	return c
+}
+
+func (c *sqlConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *sqlConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	start := time.Now()
+	var stmt driver.Stmt
+	var err error
+	if cp, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = cp.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		c.conf.log(ctx, sqlEntry{op: SQLOpPrepare, query: query, latency: time.Since(start), rows: -1, err: err})
+		return nil, err
+	}
+	return &sqlStmt{Stmt: stmt, conn: c, query: query}, nil
+}
+
+func (c *sqlConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if cb, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return cb.BeginTx(ctx, opts)
+	}
+	if opts.ReadOnly || opts.Isolation != driver.IsolationLevel(sql.LevelDefault) {
+		return nil, errors.New("log: driver does not support non-default transaction options")
+	}
+	return c.Conn.Begin()
+}
+
+func (c *sqlConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var result driver.Result
+	var err error
+	switch execer := c.Conn.(type) {
+	case driver.ExecerContext:
+		result, err = execer.ExecContext(ctx, query, args)
+	case driver.Execer:
+		var values []driver.Value
+		if values, err = namedValues(args); err == nil {
+			result, err = execer.Exec(query, values)
+		}
+	default:
+		return nil, driver.ErrSkip
+	}
+	c.conf.log(ctx, sqlEntry{op: SQLOpExec, query: query, args: args, latency: time.Since(start), rows: rowsAffected(result, err), err: err})
+	return result, err
+}
+
+func (c *sqlConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	switch queryer := c.Conn.(type) {
+	case driver.QueryerContext:
+		rows, err = queryer.QueryContext(ctx, query, args)
+	case driver.Queryer:
+		var values []driver.Value
+		if values, err = namedValues(args); err == nil {
+			rows, err = queryer.Query(query, values)
+		}
+	default:
+		return nil, driver.ErrSkip
+	}
+	c.conf.log(ctx, sqlEntry{op: SQLOpQuery, query: query, args: args, latency: time.Since(start), rows: -1, err: err})
+	return rows, err
+}
+
+func (c *sqlConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// sqlStmt 包装driver.Stmt, 预处理语句每次执行都会记录一条日志
+type sqlStmt struct {
+	driver.Stmt
+	conn  *sqlConn
+	query string
+}
+
+func (s *sqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), valuesNamed(args))
+}
+
+func (s *sqlStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var result driver.Result
+	var err error
+	if se, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = se.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValues(args); err == nil {
+			result, err = s.Stmt.Exec(values)
+		}
+	}
+	s.conn.conf.log(ctx, sqlEntry{op: SQLOpExec, query: s.query, args: args, latency: time.Since(start), rows: rowsAffected(result, err), err: err})
+	return result, err
+}
+
+func (s *sqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), valuesNamed(args))
+}
+
+func (s *sqlStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if sq, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = sq.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValues(args); err == nil {
+			rows, err = s.Stmt.Query(values)
+		}
+	}
+	s.conn.conf.log(ctx, sqlEntry{op: SQLOpQuery, query: s.query, args: args, latency: time.Since(start), rows: -1, err: err})
+	return rows, err
+}
+
+// CheckNamedValue 优先使用语句的检查, 其次是连接的检查, 与database/sql的顺序一致
+func (s *sqlStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return s.conn.CheckNamedValue(nv)
+}
+
+func (s *sqlStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if cc, ok := s.Stmt.(driver.ColumnConverter); ok {
+		return cc.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+// rowsAffected 返回影响的行数, 出错或驱动不支持时为-1
+func rowsAffected(result driver.Result, err error) int64 {
+	if err != nil || result == nil {
+		return -1
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// namedValues 转换为旧接口使用的参数, 旧接口不支持命名参数
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("log: driver does not support the use of Named Parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+func valuesNamed(values []driver.Value) []driver.NamedValue {
+	args := make([]driver.NamedValue, len(values))
+	for i, v := range values {
+		args[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return args
+}
@@ -0,0 +1,108 @@
+package log
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (fakeConn) Close() error                              { return nil }
+func (fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type fakePinger struct{ pinged *bool }
+
+func (p fakePinger) Ping(ctx context.Context) error {
+	*p.pinged = true
+	return nil
+}
+
+type fakeResetter struct{}
+
+func (fakeResetter) ResetSession(ctx context.Context) error { return driver.ErrBadConn }
+
+type fakeValidator struct{}
+
+func (fakeValidator) IsValid() bool { return false }
+
+// sqlConnInterfaces 包装后的连接总是实现的接口
+type sqlConnInterfaces interface {
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.ConnPrepareContext
+	driver.ConnBeginTx
+	driver.NamedValueChecker
+}
+
+func TestWrapConnOptionalInterfaces(t *testing.T) {
+	var pinged bool
+	conns := []driver.Conn{
+		fakeConn{},
+		struct {
+			fakeConn
+			fakePinger
+		}{fakeConn{}, fakePinger{&pinged}},
+		struct {
+			fakeConn
+			fakeResetter
+		}{},
+		struct {
+			fakeConn
+			fakeValidator
+		}{},
+		struct {
+			fakeConn
+			fakePinger
+			fakeResetter
+		}{fakeConn{}, fakePinger{&pinged}, fakeResetter{}},
+		struct {
+			fakeConn
+			fakePinger
+			fakeValidator
+		}{fakeConn{}, fakePinger{&pinged}, fakeValidator{}},
+		struct {
+			fakeConn
+			fakeResetter
+			fakeValidator
+		}{},
+		struct {
+			fakeConn
+			fakePinger
+			fakeResetter
+			fakeValidator
+		}{fakeConn{}, fakePinger{&pinged}, fakeResetter{}, fakeValidator{}},
+	}
+	for i, conn := range conns {
+		wrapped := wrapConn(conn, &sqlConfig{})
+		_, wantPinger := conn.(driver.Pinger)
+		_, wantResetter := conn.(driver.SessionResetter)
+		_, wantValidator := conn.(driver.Validator)
+
+		p, isPinger := wrapped.(driver.Pinger)
+		r, isResetter := wrapped.(driver.SessionResetter)
+		v, isValidator := wrapped.(driver.Validator)
+		if isPinger != wantPinger || isResetter != wantResetter || isValidator != wantValidator {
+			t.Errorf("conn %d: wrapped Pinger=%v SessionResetter=%v Validator=%v, want %v %v %v",
+				i, isPinger, isResetter, isValidator, wantPinger, wantResetter, wantValidator)
+			continue
+		}
+		if isPinger {
+			pinged = false
+			if p.Ping(context.Background()); !pinged {
+				t.Errorf("conn %d: Ping is not forwarded", i)
+			}
+		}
+		if isResetter && r.ResetSession(context.Background()) != driver.ErrBadConn {
+			t.Errorf("conn %d: ResetSession is not forwarded", i)
+		}
+		if isValidator && v.IsValid() {
+			t.Errorf("conn %d: IsValid is not forwarded", i)
+		}
+		if _, ok := wrapped.(sqlConnInterfaces); !ok {
+			t.Errorf("conn %d: wrapped conn does not log statements", i)
+		}
+	}
+}
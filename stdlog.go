@@ -0,0 +1,96 @@
+package log
+
+import (
+	"bytes"
+	stdlog "log"
+	"runtime"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// stdLevel 标准库日志使用的级别, panic和fatal由标准库自己处理, 这里最高按error记录
+func stdLevel(level string) zapcore.Level {
+	l := parseLevel(level)
+	if l > zapcore.ErrorLevel {
+		return zapcore.ErrorLevel
+	}
+	return l
+}
+
+// stdOutput 以level级别写一条来自标准库风格接口的日志
+func stdOutput(level zapcore.Level, caller zapcore.EntryCaller, s string) {
+	if logger == nil {
+		return
+	}
+	levelAdapter(level).logEntry(level, time.Time{}, caller, strings.TrimSuffix(s, "\n"))
+}
+
+// callerAt 返回跳过skip层调用之后的调用位置, skip为0时是callerAt的调用方
+func callerAt(skip int) zapcore.EntryCaller {
+	pc, file, line, ok := runtime.Caller(skip + 1)
+	return zapcore.NewEntryCaller(pc, file, line, ok)
+}
+
+// stdWriter 作为标准库*log.Logger的输出, 每次Write是一条日志
+type stdWriter struct {
+	level zapcore.Level
+}
+
+func (w *stdWriter) Write(p []byte) (int, error) {
+	stdOutput(w.level, stdCaller(), string(bytes.TrimSuffix(p, []byte("\n"))))
+	return len(p), nil
+}
+
+// stdPackages 写入stdWriter时调用栈中需要跳过的标准库包. slog.SetDefault之前,
+// log/slog的默认Handler也是通过标准库log包输出的
+var stdPackages = map[string]bool{"log": true, "log/slog": true}
+
+// stdCaller 从调用栈中跳过标准库log包的函数, 找到调用log.Printf等函数的位置.
+// 不同Go版本中标准库log包内部的调用层数不同, 所以按函数所在的包判断
+func stdCaller() zapcore.EntryCaller {
+	pcs := make([]uintptr, 16)
+	n := runtime.Callers(3, pcs) // 跳过Callers, stdCaller, stdWriter.Write
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !stdPackages[funcPackage(frame.Function)] {
+			return zapcore.NewEntryCaller(frame.PC, frame.File, frame.Line, true)
+		}
+		if !more {
+			return zapcore.EntryCaller{}
+		}
+	}
+}
+
+// funcPackage 返回函数全名中的包路径, 比如log.(*Logger).Output返回log, log/slog.Info返回log/slog
+func funcPackage(name string) string {
+	slash := strings.LastIndex(name, "/")
+	if i := strings.Index(name[slash+1:], "."); i >= 0 {
+		return name[:slash+1+i]
+	}
+	return name
+}
+
+// NewStdLogger 返回一个标准库的*log.Logger, 写入的内容以level级别记录到本包的日志中,
+// 调用位置为调用该Logger的代码. 可以传给只接受*log.Logger的第三方库, 比如http.Server.ErrorLog
+func NewStdLogger(level string) *stdlog.Logger {
+	return stdlog.New(&stdWriter{level: stdLevel(level)}, "", 0)
+}
+
+// RedirectStdLog 将标准库log包的默认输出重定向到本包的日志中, 以level级别记录.
+// 返回的函数用来恢复标准库原来的输出, 前缀和格式
+func RedirectStdLog(level string) func() {
+	flags := stdlog.Flags()
+	prefix := stdlog.Prefix()
+	out := stdlog.Writer()
+	stdlog.SetFlags(0)
+	stdlog.SetPrefix("")
+	stdlog.SetOutput(&stdWriter{level: stdLevel(level)})
+	return func() {
+		stdlog.SetFlags(flags)
+		stdlog.SetPrefix(prefix)
+		stdlog.SetOutput(out)
+	}
+}
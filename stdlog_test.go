@@ -0,0 +1,67 @@
+package log
+
+import (
+	"fmt"
+	stdlog "log"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// line 返回调用方的行号
+func line() int {
+	_, _, l, _ := runtime.Caller(1)
+	return l
+}
+
+// checkCaller 检查包含msg的日志的调用位置是本文件的第n行
+func checkCaller(t *testing.T, path, msg string, n int) {
+	t.Helper()
+	lines := readLines(t, path, msg)
+	if len(lines) != 1 {
+		t.Fatalf("%s: %d entries", msg, len(lines))
+	}
+	if want := fmt.Sprintf(`stdlog_test.go:%d"`, n); !strings.Contains(lines[0], want) {
+		t.Errorf("%s: caller is not %s: %s", msg, want, lines[0])
+	}
+}
+
+func TestStdCaller(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "app.log")
+	Init(path, InfoLevel, false, false, SetCaller(true))
+	defer func() { logger.close(); logger = nil }()
+
+	Output(1, "output message")
+	checkCaller(t, path, "output message", line()-1)
+	Println("println message")
+	checkCaller(t, path, "println message", line()-1)
+	Printf("printf %s", "message")
+	checkCaller(t, path, "printf message", line()-1)
+
+	NewStdLogger(WarnLevel).Printf("std logger message")
+	checkCaller(t, path, "std logger message", line()-1)
+
+	restore := RedirectStdLog(InfoLevel)
+	defer restore()
+	stdlog.Println("redirected message")
+	checkCaller(t, path, "redirected message", line()-1)
+	stdlog.Output(1, "redirected output")
+	checkCaller(t, path, "redirected output", line()-1)
+}
+
+func TestFuncPackage(t *testing.T) {
+	for name, want := range map[string]string{
+		"log.(*Logger).Output":               "log",
+		"log.Printf":                         "log",
+		"log/slog.(*defaultHandler).Handle":  "log/slog",
+		"github.com/terryliu/log/v2.Printf":  "github.com/terryliu/log/v2",
+		"github.com/a/log.(*T).Printf.func1": "github.com/a/log",
+		"main.main":                          "main",
+	} {
+		if got := funcPackage(name); got != want {
+			t.Errorf("funcPackage(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,619 @@
+package log
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	buf "go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// 结构体标签, 用法:
+//
+//	Password string `log:"-"`          不输出
+//	Token    string `log:"redact"`     输出为******
+//	UserID   int64  `log:"name=uid"`   以uid为字段名输出
+//
+// 多个选项用逗号分隔, 如`log:"name=tk,redact"`. 未指定name时使用json标签中的名字, 都没有时使用字段名.
+// 与encoding/json一致, json标签为"-"的字段不输出, omitempty生效, 嵌入的结构体的字段提升到外层.
+// 带标签的结构体出现在interface字段, map的值或者切片中时同样按标签输出.
+const logTag = "log"
+
+// maxTagDepth 按标签输出时最多展开的层数, 防止指针形成环时无限递归
+const maxTagDepth = 32
+
+type tagField struct {
+	index     []int // 字段在结构体中的位置, 嵌入结构体中的字段有多级
+	typ       reflect.Type
+	name      string
+	named     bool // 名字来自json或log标签
+	depth     int  // 嵌入的层数
+	redact    bool
+	omitEmpty bool
+}
+
+// structInfo 缓存结构体的反射信息, 每个类型只解析一次
+type structInfo struct {
+	fields []tagField
+	tagged bool // 自身或者嵌入的结构体中是否有log标签
+}
+
+// typeTags 类型中能到达的所有类型是否需要按标签输出
+type typeTags struct {
+	static  bool // 有带log标签的结构体
+	dynamic bool // 有interface, 需要按实际的值判断
+}
+
+var (
+	_structInfos sync.Map // map[reflect.Type]*structInfo
+	_typeTags    sync.Map // map[reflect.Type]typeTags
+
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// customMarshaler 自定义了json或文本序列化的类型由自己决定输出的内容, 不按标签处理
+func customMarshaler(t reflect.Type) bool {
+	if t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) {
+		return true
+	}
+	pt := reflect.PtrTo(t)
+	return t.Kind() != reflect.Ptr && (pt.Implements(jsonMarshalerType) || pt.Implements(textMarshalerType))
+}
+
+func getStructInfo(t reflect.Type) *structInfo {
+	if info, ok := _structInfos.Load(t); ok {
+		return info.(*structInfo)
+	}
+	info := typeFields(t)
+	_structInfos.Store(t, info)
+	return info
+}
+
+// typeFields 与encoding/json相同, 嵌入的结构体(没有指定名字时)的字段提升到外层, 名字冲突时层数少的字段优先,
+// 同一层有多个时只保留指定了名字的那个, 否则都不输出
+func typeFields(t reflect.Type) *structInfo {
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+	info := &structInfo{}
+	var fields []tagField
+	visited := make(map[reflect.Type]bool)
+	next := []embedded{{typ: t}}
+	for depth := 0; len(next) > 0; depth++ {
+		current := next
+		next = nil
+		for _, e := range current {
+			if visited[e.typ] {
+				continue
+			}
+			visited[e.typ] = true
+			for i := 0; i < e.typ.NumField(); i++ {
+				sf := e.typ.Field(i)
+				tag, ok := sf.Tag.Lookup(logTag)
+				if ok {
+					info.tagged = true
+				}
+				jsonTag := sf.Tag.Get("json")
+				if tag == "-" || jsonTag == "-" {
+					continue
+				}
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				// 与encoding/json一致, 不输出未导出的字段, 但未导出的嵌入结构体中导出的字段仍然输出
+				if sf.PkgPath != "" && (!sf.Anonymous || ft.Kind() != reflect.Struct) {
+					continue
+				}
+				f := tagField{index: append(append([]int(nil), e.index...), i), typ: sf.Type, name: sf.Name, depth: depth}
+				opts := strings.Split(jsonTag, ",")
+				if opts[0] != "" {
+					f.name = opts[0]
+					f.named = true
+				}
+				for _, opt := range opts[1:] {
+					if opt == "omitempty" {
+						f.omitEmpty = true
+					}
+				}
+				for _, opt := range strings.Split(tag, ",") {
+					switch {
+					case opt == "redact":
+						f.redact = true
+					case strings.HasPrefix(opt, "name="):
+						f.name = strings.TrimPrefix(opt, "name=")
+						f.named = true
+					}
+				}
+				if sf.Anonymous && !f.named && !f.redact && ft.Kind() == reflect.Struct {
+					next = append(next, embedded{typ: ft, index: f.index})
+					continue
+				}
+				fields = append(fields, f)
+			}
+		}
+	}
+
+	sort.SliceStable(fields, func(i, j int) bool {
+		if fields[i].name != fields[j].name {
+			return fields[i].name < fields[j].name
+		}
+		if fields[i].depth != fields[j].depth {
+			return fields[i].depth < fields[j].depth
+		}
+		return fields[i].named && !fields[j].named
+	})
+	for i := 0; i < len(fields); {
+		j := i + 1
+		for j < len(fields) && fields[j].name == fields[i].name {
+			j++
+		}
+		if j-i == 1 || fields[i].depth != fields[i+1].depth || fields[i].named != fields[i+1].named {
+			info.fields = append(info.fields, fields[i])
+		}
+		i = j
+	}
+	sort.Slice(info.fields, func(i, j int) bool {
+		a, b := info.fields[i].index, info.fields[j].index
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	return info
+}
+
+func getTypeTags(t reflect.Type) typeTags {
+	if tt, ok := _typeTags.Load(t); ok {
+		return tt.(typeTags)
+	}
+	var tt typeTags
+	walkType(t, make(map[reflect.Type]bool), &tt)
+	_typeTags.Store(t, tt)
+	return tt
+}
+
+// walkType 遍历t能到达的所有类型. 只缓存根类型的结果, 以免类型之间循环引用时缓存了只遍历了一部分的结果
+func walkType(t reflect.Type, seen map[reflect.Type]bool, tt *typeTags) {
+	if seen[t] || (tt.static && tt.dynamic) {
+		return
+	}
+	seen[t] = true
+	if t.Kind() == reflect.Interface {
+		tt.dynamic = true
+		return
+	}
+	if customMarshaler(t) {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		walkType(t.Elem(), seen, tt)
+	case reflect.Struct:
+		info := getStructInfo(t)
+		if info.tagged {
+			tt.static = true
+		}
+		for _, f := range info.fields {
+			walkType(f.typ, seen, tt)
+		}
+	}
+}
+
+// hasTags 判断v中是否有需要按标签输出的结构体, 类型中有interface时检查实际的值
+func hasTags(v reflect.Value, depth int) bool {
+	if !v.IsValid() || depth > maxTagDepth {
+		return false
+	}
+	tt := getTypeTags(v.Type())
+	if tt.static {
+		return true
+	}
+	if !tt.dynamic {
+		return false
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return !v.IsNil() && hasTags(v.Elem(), depth+1)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if hasTags(v.Index(i), depth+1) {
+				return true
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if hasTags(iter.Value(), depth+1) {
+				return true
+			}
+		}
+	case reflect.Struct:
+		for _, f := range getStructInfo(v.Type()).fields {
+			if fv, ok := fieldByIndex(v, f.index); ok && hasTags(fv, depth+1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fieldByIndex 与reflect.Value.FieldByIndex相同, 但嵌入的指针为nil时返回false
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// isEmptyValue 与encoding/json的omitempty判断相同
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// taggedValue 按log标签输出结构体, 实现了zapcore.ObjectMarshaler供json使用,
+// 同时实现了fmt.Stringer供csv和RequestLogInfo使用
+type taggedValue struct {
+	v     reflect.Value
+	info  *structInfo
+	depth int
+}
+
+// taggedArray 元素中有带标签结构体的切片或数组
+type taggedArray struct {
+	v     reflect.Value
+	depth int
+}
+
+// taggedMap 值中有带标签结构体的map, 与encoding/json相同按键排序输出
+type taggedMap struct {
+	v     reflect.Value
+	depth int
+}
+
+// newTagged 值中(包括嵌套的字段, 切片元素, map的值和interface中的值)有带log标签的结构体时返回对应的包装, 否则返回nil
+func newTagged(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	return taggedOf(reflect.ValueOf(value), 0)
+}
+
+func taggedOf(v reflect.Value, depth int) interface{} {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if !hasTags(v, depth) {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		return taggedValue{v: v, info: getStructInfo(v.Type()), depth: depth}
+	case reflect.Slice, reflect.Array:
+		return taggedArray{v: v, depth: depth}
+	case reflect.Map:
+		return taggedMap{v: v, depth: depth}
+	}
+	return nil
+}
+
+// addTagged 将v以key加入enc, 需要时按标签输出
+func addTagged(enc zapcore.ObjectEncoder, key string, v reflect.Value, depth int) error {
+	switch nested := taggedOf(v, depth).(type) {
+	case taggedValue:
+		return enc.AddObject(key, nested)
+	case taggedArray:
+		return enc.AddArray(key, nested)
+	case taggedMap:
+		return enc.AddObject(key, nested)
+	}
+	return enc.AddReflected(key, reflectedValue(v))
+}
+
+// appendTagged 将v追加到enc, 需要时按标签输出
+func appendTagged(enc zapcore.ArrayEncoder, v reflect.Value, depth int) error {
+	switch nested := taggedOf(v, depth).(type) {
+	case taggedValue:
+		return enc.AppendObject(nested)
+	case taggedArray:
+		return enc.AppendArray(nested)
+	case taggedMap:
+		return enc.AppendObject(nested)
+	}
+	return enc.AppendReflected(reflectedValue(v))
+}
+
+// fprintTagged 以fmt的%v格式输出v, 需要时按标签输出
+func fprintTagged(b *strings.Builder, v reflect.Value, depth int) {
+	if nested := taggedOf(v, depth); nested != nil {
+		fmt.Fprint(b, nested)
+		return
+	}
+	fmt.Fprintf(b, "%v", v)
+}
+
+// reflectedValue 返回v的值, 交给json序列化. 通过未导出的嵌入结构体得到的字段不能调用Interface,
+// 基本类型按类型取值, 其它的按fmt格式化为字符串
+func reflectedValue(v reflect.Value) interface{} {
+	if v.CanInterface() {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint()
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func (t taggedValue) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, f := range t.info.fields {
+		fv, ok := fieldByIndex(t.v, f.index)
+		if !ok || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+		if f.redact {
+			enc.AddString(f.name, fullMask)
+			continue
+		}
+		if err := addTagged(enc, f.name, fv, t.depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t taggedValue) String() string {
+	var b strings.Builder
+	b.WriteByte('{')
+	first := true
+	for _, f := range t.info.fields {
+		fv, ok := fieldByIndex(t.v, f.index)
+		if !ok || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+		b.WriteString(f.name)
+		b.WriteByte(':')
+		if f.redact {
+			b.WriteString(fullMask)
+			continue
+		}
+		fprintTagged(&b, fv, t.depth+1)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (t taggedArray) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for i := 0; i < t.v.Len(); i++ {
+		if err := appendTagged(enc, t.v.Index(i), t.depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t taggedArray) String() string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i := 0; i < t.v.Len(); i++ {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fprintTagged(&b, t.v.Index(i), t.depth+1)
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// keys 返回按字符串形式排序后的键和对应的字符串
+func (t taggedMap) keys() ([]reflect.Value, []string) {
+	keys := t.v.MapKeys()
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		if k.Kind() == reflect.String {
+			names[i] = k.String()
+		} else {
+			names[i] = fmt.Sprintf("%v", k)
+		}
+	}
+	sort.Sort(mapKeys{keys: keys, names: names})
+	return keys, names
+}
+
+type mapKeys struct {
+	keys  []reflect.Value
+	names []string
+}
+
+func (m mapKeys) Len() int           { return len(m.keys) }
+func (m mapKeys) Less(i, j int) bool { return m.names[i] < m.names[j] }
+func (m mapKeys) Swap(i, j int) {
+	m.keys[i], m.keys[j] = m.keys[j], m.keys[i]
+	m.names[i], m.names[j] = m.names[j], m.names[i]
+}
+
+func (t taggedMap) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	keys, names := t.keys()
+	for i, k := range keys {
+		if err := addTagged(enc, names[i], t.v.MapIndex(k), t.depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t taggedMap) String() string {
+	var b strings.Builder
+	b.WriteString("map[")
+	keys, names := t.keys()
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(names[i])
+		b.WriteByte(':')
+		fprintTagged(&b, t.v.MapIndex(k), t.depth+1)
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// tagEncoder 在json编码器的反射路径上按log标签输出结构体, 包括With添加的字段和日志的字段
+type tagEncoder struct {
+	zapcore.Encoder
+}
+
+// newJSONEncoder 创建按log标签输出结构体的json编码器
+func newJSONEncoder(conf zapcore.EncoderConfig) zapcore.Encoder {
+	return tagEncoder{zapcore.NewJSONEncoder(conf)}
+}
+
+func (enc tagEncoder) Clone() zapcore.Encoder {
+	return tagEncoder{enc.Encoder.Clone()}
+}
+
+func (enc tagEncoder) AddReflected(key string, obj interface{}) error {
+	switch t := newTagged(obj).(type) {
+	case taggedValue:
+		return enc.Encoder.AddObject(key, t)
+	case taggedArray:
+		return enc.Encoder.AddArray(key, t)
+	case taggedMap:
+		return enc.Encoder.AddObject(key, t)
+	}
+	return enc.Encoder.AddReflected(key, obj)
+}
+
+// EncodeEntry json编码器在内部的副本上添加字段, 不经过AddReflected, 所以先替换反射字段
+func (enc tagEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*buf.Buffer, error) {
+	return enc.Encoder.EncodeEntry(ent, tagFields(fields))
+}
+
+// reflectedJSON 按log标签将obj序列化为json, 用于脱敏时按json内容匹配
+func reflectedJSON(obj interface{}) ([]byte, error) {
+	return encodeField(zap.Reflect("", obj))
+}
+
+// encodedValue 返回字段值按json编码(遵循log标签)后的内容, 用于截断对象,数组等字段
+func encodedValue(f zapcore.Field) string {
+	b, err := encodeField(f)
+	if err != nil {
+		return fieldCellString(f)
+	}
+	return string(b)
+}
+
+// encodeField 按json编码字段的值
+func encodeField(f zapcore.Field) ([]byte, error) {
+	f.Key = "v"
+	enc := newJSONEncoder(zapcore.EncoderConfig{})
+	line, err := enc.EncodeEntry(zapcore.Entry{}, []zapcore.Field{f})
+	if err != nil {
+		return nil, err
+	}
+	defer line.Free()
+	// 去掉外层的{"v": 和 }\n
+	b := line.Bytes()
+	return append([]byte(nil), b[len(`{"v":`):len(b)-len("}\n")]...), nil
+}
+
+// tagFields 将值为带标签结构体的反射字段替换为按标签输出的字段
+func tagFields(fields []zapcore.Field) []zapcore.Field {
+	var out []zapcore.Field
+	for i, f := range fields {
+		var tagged interface{}
+		if f.Type == zapcore.ReflectType {
+			tagged = newTagged(f.Interface)
+		}
+		if tagged == nil {
+			if out != nil {
+				out = append(out, f)
+			}
+			continue
+		}
+		if out == nil {
+			out = make([]zapcore.Field, i, len(fields))
+			copy(out, fields[:i])
+		}
+		switch t := tagged.(type) {
+		case taggedValue:
+			out = append(out, zap.Object(f.Key, t))
+		case taggedArray:
+			out = append(out, zap.Array(f.Key, t))
+		case taggedMap:
+			out = append(out, zap.Object(f.Key, t))
+		}
+	}
+	if out == nil {
+		return fields
+	}
+	return out
+}
+
+// tagArgs 用于Info,Infof等直接格式化参数的接口, 将带标签的结构体替换为按标签输出的值
+func tagArgs(args []interface{}) []interface{} {
+	var out []interface{}
+	for i, arg := range args {
+		tagged := newTagged(arg)
+		if tagged == nil {
+			if out != nil {
+				out = append(out, arg)
+			}
+			continue
+		}
+		if out == nil {
+			out = make([]interface{}, i, len(args))
+			copy(out, args[:i])
+		}
+		out = append(out, tagged)
+	}
+	if out == nil {
+		return args
+	}
+	return out
+}
@@ -0,0 +1,172 @@
+package log
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type tagSecret struct {
+	User  string
+	Token string `log:"redact"`
+}
+
+type tagWrapper struct {
+	Payload interface{}
+	Extras  map[string]interface{}
+	List    []interface{}
+}
+
+type tagBase struct {
+	ID    int
+	Token string `log:"redact"`
+}
+
+type tagEmbed struct {
+	tagBase
+	*tagSecret `json:"secret"`
+	ID         int
+	Hidden     string `json:"-"`
+	Empty      string `json:",omitempty"`
+}
+
+type TagEmbedded struct {
+	Key string `log:"redact"`
+}
+
+type tagOuter struct {
+	TagEmbedded
+	Name string
+}
+
+// tagCycleA和tagCycleB相互引用, 只有tagCycleA带标签
+type tagCycleA struct {
+	B      *tagCycleB
+	Secret string `log:"redact"`
+}
+
+type tagCycleB struct {
+	A *tagCycleA
+}
+
+func encodeTagged(t *testing.T, fields ...zapcore.Field) string {
+	t.Helper()
+	enc := newJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg"})
+	buf, err := enc.EncodeEntry(zapcore.Entry{Time: time.Now()}, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestTagsInDynamicValues(t *testing.T) {
+	secret := tagSecret{User: "alice", Token: "s3cret"}
+	out := encodeTagged(t, zap.Any("req", tagWrapper{
+		Payload: secret,
+		Extras:  map[string]interface{}{"auth": &secret, "n": 1},
+		List:    []interface{}{"x", secret},
+	}))
+	if strings.Contains(out, "s3cret") {
+		t.Fatalf("secret leaked: %s", out)
+	}
+	if strings.Count(out, fullMask) != 3 || !strings.Contains(out, `"n":1`) {
+		t.Fatalf("unexpected output: %s", out)
+	}
+
+	out = encodeTagged(t, zap.Any("extras", map[string]interface{}{"auth": secret}))
+	if strings.Contains(out, "s3cret") {
+		t.Fatalf("secret in map leaked: %s", out)
+	}
+
+	entry := RequestEntry{Method: "GET", Extras: map[string]interface{}{"user": secret}}
+	if out := encodeTagged(t, entry.Fields()...); strings.Contains(out, "s3cret") {
+		t.Fatalf("secret in RequestEntry.Extras leaked: %s", out)
+	}
+}
+
+func TestTagsWithoutSecrets(t *testing.T) {
+	if newTagged(tagWrapper{Payload: "plain", Extras: map[string]interface{}{"a": 1}}) != nil {
+		t.Fatal("values without log tags should be left to the reflected encoder")
+	}
+	if newTagged(time.Now()) != nil {
+		t.Fatal("types with a custom marshaler should not be walked")
+	}
+}
+
+func TestTagsMutualRecursion(t *testing.T) {
+	// 先解析tagCycleA, 此时tagCycleB只遍历了一部分, 不能把它缓存为不带标签
+	newTagged(tagCycleA{})
+	out := encodeTagged(t, zap.Any("b", tagCycleB{A: &tagCycleA{Secret: "s3cret"}}))
+	if strings.Contains(out, "s3cret") {
+		t.Fatalf("secret leaked through recursive types: %s", out)
+	}
+}
+
+func TestTagsEmbedded(t *testing.T) {
+	v := tagEmbed{
+		tagBase:   tagBase{ID: 1, Token: "s3cret"},
+		tagSecret: &tagSecret{User: "alice", Token: "t0ken"},
+		ID:        2,
+		Hidden:    "hidden",
+	}
+	out := encodeTagged(t, zap.Any("v", v))
+	for _, leaked := range []string{"s3cret", "t0ken", "hidden", "Empty", "tagBase"} {
+		if strings.Contains(out, leaked) {
+			t.Fatalf("%s in output: %s", leaked, out)
+		}
+	}
+	if !strings.Contains(out, `"v":{"Token":"******","secret":{"User":"alice","Token":"******"},"ID":2}`) {
+		t.Fatalf("embedded struct is not flattened: %s", out)
+	}
+
+	out = encodeTagged(t, zap.Any("v", tagOuter{TagEmbedded: TagEmbedded{Key: "k3y"}, Name: "n"}))
+	if !strings.Contains(out, `"v":{"Key":"******","Name":"n"}`) {
+		t.Fatalf("exported embedded struct is not flattened: %s", out)
+	}
+}
+
+func TestTagsString(t *testing.T) {
+	s := newTagged(map[string]interface{}{"b": tagSecret{User: "u", Token: "s3cret"}, "a": 1}).(interface{ String() string }).String()
+	if s != "map[a:1 b:{User:u Token:******}]" {
+		t.Fatalf("String() = %s", s)
+	}
+}
+
+func TestTagsSugar(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "app.log")
+	Init(path, InfoLevel, true, false, SetRedactPattern(`alice`, MaskFull))
+	defer func() { logger.close(); logger = nil }()
+
+	Info("info ", tagSecret{User: "bob", Token: "s3cret-info"})
+	Infof("infof %v", &tagSecret{User: "bob", Token: "s3cret-infof"})
+	Infow("infow", "v", []tagSecret{{User: "bob", Token: "s3cret-infow"}})
+	// 脱敏规则按标签序列化后的内容匹配, 结果中不会出现被标签隐藏的字段
+	Infow("redacted", "v", tagSecret{User: "alice", Token: "s3cret-redacted"})
+
+	for _, msg := range []string{"info ", "infof", "infow", "redacted"} {
+		line := readLines(t, path, msg)[0]
+		if strings.Contains(line, "s3cret") || !strings.Contains(line, fullMask) {
+			t.Errorf("tags are not applied: %s", line)
+		}
+	}
+	if line := readLines(t, path, "redacted")[0]; strings.Contains(line, "alice") {
+		t.Errorf("tagged value is not redacted: %s", line)
+	}
+}
+
+func TestTagsWith(t *testing.T) {
+	enc := newJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg"})
+	zap.Any("v", tagSecret{User: "u", Token: "s3cret"}).AddTo(enc)
+	buf, err := enc.Clone().EncodeEntry(zapcore.Entry{Message: "m"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); !strings.Contains(out, `"v":{"User":"u","Token":"******"}`) {
+		t.Fatalf("tags are not applied to With fields: %s", out)
+	}
+}
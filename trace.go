@@ -0,0 +1,160 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// 默认的trace关联字段名
+const (
+	DefaultTraceIDKey    = "trace_id"
+	DefaultSpanIDKey     = "span_id"
+	DefaultTraceFlagsKey = "trace_flags"
+)
+
+type traceKeys struct {
+	traceID    string
+	spanID     string
+	traceFlags string
+}
+
+var defaultTraceKeys = traceKeys{traceID: DefaultTraceIDKey, spanID: DefaultSpanIDKey, traceFlags: DefaultTraceFlagsKey}
+
+// list 返回不为空的键, 顺序与csv中的列一致
+func (k traceKeys) list() []string {
+	keys := make([]string, 0, 3)
+	for _, key := range []string{k.traceID, k.spanID, k.traceFlags} {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// SetTraceKeys 设置trace关联字段的键名, 默认为trace_id,span_id,trace_flags, 为空的键不记录
+func SetTraceKeys(traceID, spanID, traceFlags string) LogOption {
+	return logOptionFunc(func(log *Log) {
+		log.traceKeys = traceKeys{traceID: traceID, spanID: spanID, traceFlags: traceFlags}
+	})
+}
+
+// SetTraceColumns 为true时, csv格式的主日志,Request日志和Outbound日志在消息之后增加trace_id,span_id,trace_flags三列,
+// 没有span的日志这几列为空, 这样每一列的含义是固定的. 列的顺序不受SetTraceKeys影响, 为空的键没有对应的列
+func SetTraceColumns(enable bool) LogOption {
+	return logOptionFunc(func(log *Log) {
+		log.traceColumns = enable
+	})
+}
+
+// traceFields 返回ctx中OpenTelemetry span的关联字段, 没有有效的span时返回nil
+func traceFields(ctx context.Context) []zapcore.Field {
+	if ctx == nil || logger == nil {
+		return nil
+	}
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	keys := logger.traceKeys
+	fields := make([]zapcore.Field, 0, 3)
+	if keys.traceID != "" {
+		fields = append(fields, zap.String(keys.traceID, sc.TraceID().String()))
+	}
+	if keys.spanID != "" {
+		fields = append(fields, zap.String(keys.spanID, sc.SpanID().String()))
+	}
+	if keys.traceFlags != "" {
+		fields = append(fields, zap.String(keys.traceFlags, sc.TraceFlags().String()))
+	}
+	return fields
+}
+
+// CtxLogger 写主日志和Request日志时自动加上context中OpenTelemetry span的trace_id,span_id和trace_flags.
+// 不通过Ctx的Infow,RequestLogInfow等函数不会记录这些字段
+type CtxLogger struct {
+	ctx context.Context
+}
+
+// Ctx 返回关联ctx的日志, 使用方法: log.Ctx(ctx).Infow("order created", "id", id)
+func Ctx(ctx context.Context) CtxLogger {
+	return CtxLogger{ctx: ctx}
+}
+
+// log 以level级别写一条日志, 调用位置为CtxLogger方法的调用方
+func (c CtxLogger) log(level zapcore.Level, msg string, keysAndValues []interface{}) {
+	if logger == nil {
+		return
+	}
+	adapter := levelAdapter(level)
+	if !adapter.enabled(level) {
+		return
+	}
+	fields := append(kvFields(keysAndValues), traceFields(c.ctx)...)
+	adapter.logEntry(level, time.Time{}, callerAt(2), msg, fields...)
+}
+
+func (c CtxLogger) Debug(args ...interface{}) {
+	c.log(zapcore.DebugLevel, fmt.Sprint(args...), nil)
+}
+
+func (c CtxLogger) Debugf(template string, args ...interface{}) {
+	c.log(zapcore.DebugLevel, fmt.Sprintf(template, args...), nil)
+}
+
+func (c CtxLogger) Debugw(msg string, keysAndValues ...interface{}) {
+	c.log(zapcore.DebugLevel, msg, keysAndValues)
+}
+
+func (c CtxLogger) Info(args ...interface{}) {
+	c.log(zapcore.InfoLevel, fmt.Sprint(args...), nil)
+}
+
+func (c CtxLogger) Infof(template string, args ...interface{}) {
+	c.log(zapcore.InfoLevel, fmt.Sprintf(template, args...), nil)
+}
+
+func (c CtxLogger) Infow(msg string, keysAndValues ...interface{}) {
+	c.log(zapcore.InfoLevel, msg, keysAndValues)
+}
+
+func (c CtxLogger) Warn(args ...interface{}) {
+	c.log(zapcore.WarnLevel, fmt.Sprint(args...), nil)
+}
+
+func (c CtxLogger) Warnf(template string, args ...interface{}) {
+	c.log(zapcore.WarnLevel, fmt.Sprintf(template, args...), nil)
+}
+
+func (c CtxLogger) Warnw(msg string, keysAndValues ...interface{}) {
+	c.log(zapcore.WarnLevel, msg, keysAndValues)
+}
+
+func (c CtxLogger) Error(args ...interface{}) {
+	c.log(zapcore.ErrorLevel, fmt.Sprint(args...), nil)
+}
+
+func (c CtxLogger) Errorf(template string, args ...interface{}) {
+	c.log(zapcore.ErrorLevel, fmt.Sprintf(template, args...), nil)
+}
+
+func (c CtxLogger) Errorw(msg string, keysAndValues ...interface{}) {
+	c.log(zapcore.ErrorLevel, msg, keysAndValues)
+}
+
+// RequestLogInfow 与log.RequestLogInfow相同, 写入Request日志
+func (c CtxLogger) RequestLogInfow(msg string, keysAndValues ...interface{}) {
+	if logger == nil || !logger.NeedRequestLog {
+		return
+	}
+	adapter := logger.adapters[needLevelsLog(FileTypeRequest)]
+	if !adapter.enabled(zapcore.InfoLevel) {
+		return
+	}
+	fields := append(kvFields(keysAndValues), traceFields(c.ctx)...)
+	adapter.logEntry(zapcore.InfoLevel, time.Time{}, callerAt(1), msg, fields...)
+}
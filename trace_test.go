@@ -0,0 +1,125 @@
+package log
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testTraceID = "0102030405060708090a0b0c0d0e0f10"
+	testSpanID  = "0102030405060708"
+)
+
+// spanContext 返回带有span的ctx. 使用no-op tracer开始span, 与没有配置SDK时的应用一致
+func spanContext(t *testing.T) context.Context {
+	t.Helper()
+	traceID, _ := trace.TraceIDFromHex(testTraceID)
+	spanID, _ := trace.SpanIDFromHex(testSpanID)
+	parent := trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+	ctx, span := trace.NewNoopTracerProvider().Tracer("test").Start(parent, "op")
+	t.Cleanup(func() { span.End() })
+	return ctx
+}
+
+// readLines 同步日志后返回文件中包含msg的行
+func readLines(t *testing.T, path, msg string) []string {
+	t.Helper()
+	Sync()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.Contains(line, msg) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestCtxTraceFields(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "app.log")
+	Init(path, InfoLevel, true, false)
+	defer func() { logger.close(); logger = nil }()
+
+	Ctx(spanContext(t)).Infow("with span")
+	Ctx(context.Background()).Infow("without span")
+
+	line := readLines(t, path, "with span")[0]
+	for _, want := range []string{`"trace_id":"` + testTraceID + `"`, `"span_id":"` + testSpanID + `"`, `"trace_flags":"01"`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("missing %s in %s", want, line)
+		}
+	}
+	if line := readLines(t, path, "without span")[0]; strings.Contains(line, "trace_id") {
+		t.Errorf("trace fields without a span: %s", line)
+	}
+}
+
+func TestTraceColumns(t *testing.T) {
+	dir := tempDir(t)
+	Init(filepath.Join(dir, "app.log"), InfoLevel, true, false, SetLogType("csv"), SetTraceColumns(true))
+	defer func() { logger.close(); logger = nil }()
+
+	Ctx(spanContext(t)).Infow("with span", "k", "v")
+	Ctx(context.Background()).Infow("without span", "k", "v")
+
+	path := filepath.Join(dir, "app.log.csv")
+	want := `"with span","` + testTraceID + `","` + testSpanID + `","01","k:v"`
+	if line := readLines(t, path, "with span")[0]; !strings.Contains(line, want) {
+		t.Errorf("trace columns: %s, want %s", line, want)
+	}
+	want = `"without span","","","","k:v"`
+	if line := readLines(t, path, "without span")[0]; !strings.Contains(line, want) {
+		t.Errorf("empty trace columns: %s, want %s", line, want)
+	}
+}
+
+func TestLogOutboundContext(t *testing.T) {
+	dir := tempDir(t)
+	Init(filepath.Join(dir, "app.log"), InfoLevel, true, false, SetTraceColumns(true))
+	defer func() { logger.close(); logger = nil }()
+
+	LogOutboundContext(spanContext(t), RequestEntry{Method: "GET", Path: "/traced", Status: 200})
+	LogOutboundContext(context.Background(), RequestEntry{Method: "GET", Path: "/untraced", Status: 200})
+
+	path := filepath.Join(dir, "app.log.Outbound.csv")
+	want := `"outbound","` + testTraceID + `","` + testSpanID + `","01"`
+	if line := readLines(t, path, "/traced")[0]; !strings.Contains(line, want) {
+		t.Errorf("outbound trace columns: %s, want %s", line, want)
+	}
+	if line := readLines(t, path, "/untraced")[0]; !strings.Contains(line, `"outbound","","",""`) {
+		t.Errorf("outbound without a span: %s", line)
+	}
+}
+
+func TestCtxRequestLog(t *testing.T) {
+	dir := tempDir(t)
+	Init(filepath.Join(dir, "app.log"), InfoLevel, true, false, SetRequestType("json"))
+	defer func() { logger.close(); logger = nil }()
+
+	Ctx(spanContext(t)).RequestLogInfow("ctx request", "route", "/a")
+	RequestLogInfow("plain request", "route", "/b")
+
+	path := filepath.Join(dir, "app.log.Request")
+	line := readLines(t, path, "ctx request")[0]
+	for _, want := range []string{`"route":"/a"`, `"trace_id":"` + testTraceID + `"`, `"span_id":"` + testSpanID + `"`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("missing %s in %s", want, line)
+		}
+	}
+	if line := readLines(t, path, "plain request")[0]; strings.Contains(line, "trace_id") {
+		t.Errorf("trace fields without a context: %s", line)
+	}
+}
@@ -0,0 +1,211 @@
+package log
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 对外请求日志在Extras中的键
+const (
+	RequestKeyURL   = "url"
+	RequestKeyHost  = "host"
+	RequestKeyError = "error"
+)
+
+// DefaultRedactQuery 默认脱敏的查询参数
+var DefaultRedactQuery = []string{"*token*", "*secret*", "password", "passwd", "sign", "signature", "api_key", "apikey"}
+
+type transportConfig struct {
+	fileType        int
+	requestIDHeader string
+	redactQuery     []string
+}
+
+type TransportOption interface {
+	apply(*transportConfig)
+}
+
+type transportOptionFunc func(*transportConfig)
+
+func (f transportOptionFunc) apply(c *transportConfig) {
+	f(c)
+}
+
+// WithOutboundFileType 设置对外请求写入的日志, 默认为FileTypeOutbound, 也可以是FileTypeRequest
+func WithOutboundFileType(fileType int) TransportOption {
+	return transportOptionFunc(func(c *transportConfig) {
+		c.fileType = fileType
+	})
+}
+
+// WithOutboundRequestIDHeader 设置传递请求ID的请求头, 默认为X-Request-ID
+func WithOutboundRequestIDHeader(header string) TransportOption {
+	return transportOptionFunc(func(c *transportConfig) {
+		c.requestIDHeader = header
+	})
+}
+
+// WithRedactQuery 设置需要脱敏的查询参数, 与SetRedactKeys的规则相同, 支持*和?通配, 不区分大小写, 默认为DefaultRedactQuery.
+// 全局的脱敏规则(SetRedactKeys等)同样会作用于对外请求的日志
+func WithRedactQuery(params ...string) TransportOption {
+	return transportOptionFunc(func(c *transportConfig) {
+		c.redactQuery = params
+	})
+}
+
+// transport 记录对外请求的http.RoundTripper
+type transport struct {
+	base  http.RoundTripper
+	conf  transportConfig
+	query []*redactRule
+}
+
+// Transport 包装base, 记录每个对外请求的方法,URL(查询参数已脱敏),状态码,耗时和错误, 并把context中的请求ID
+// (见HTTPMiddleware)写到请求头中, 这样调用双方的日志可以关联起来. 有响应内容时在读到结尾或者关闭时才写日志,
+// 耗时包括读取响应内容, 收到的字节数为实际读取的字节数, 所以分块传输和长度未知的响应也能统计.
+// base为nil时使用http.DefaultTransport. 使用方法: client := &http.Client{Transport: log.Transport(nil)}
+func Transport(base http.RoundTripper, opts ...TransportOption) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &transport{
+		base: base,
+		conf: transportConfig{
+			fileType:        FileTypeOutbound,
+			requestIDHeader: DefaultRequestIDHeader,
+			redactQuery:     DefaultRedactQuery,
+		},
+	}
+	for _, opt := range opts {
+		opt.apply(&t.conf)
+	}
+	for _, p := range t.conf.redactQuery {
+		t.query = append(t.query, newKeyRule(p, fullMask))
+	}
+	return t
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := req.Header.Get(t.conf.requestIDHeader)
+	if id == "" {
+		if id = RequestIDFromContext(req.Context()); id != "" {
+			// RoundTripper不能修改传入的请求
+			req = req.Clone(req.Context())
+			req.Header.Set(t.conf.requestIDHeader, id)
+		}
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+
+	query := redactQuery(req.URL.RawQuery, t.query)
+	u := *req.URL
+	u.RawQuery = query
+	u.User = nil
+	entry := RequestEntry{
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Query:     query,
+		RequestID: id,
+		BytesOut:  req.ContentLength,
+		Extras: map[string]interface{}{
+			RequestKeyURL:  u.String(),
+			RequestKeyHost: req.URL.Host,
+		},
+	}
+	if entry.BytesOut < 0 {
+		entry.BytesOut = 0
+	}
+	if err != nil {
+		entry.Extras[RequestKeyError] = err.Error()
+		entry.Latency = time.Since(start)
+		t.log(req, entry)
+		return resp, err
+	}
+	entry.Status = resp.StatusCode
+	if _, ok := resp.Body.(io.Writer); ok || resp.Body == nil || resp.Body == http.NoBody {
+		// 没有响应内容, 或者是101 Switching Protocols之后的连接
+		entry.Latency = time.Since(start)
+		t.log(req, entry)
+		return resp, err
+	}
+	resp.Body = &outboundBody{ReadCloser: resp.Body, t: t, req: req, entry: entry, start: start}
+	return resp, err
+}
+
+func (t *transport) log(req *http.Request, entry RequestEntry) {
+	if t.conf.fileType == FileTypeRequest {
+		LogRequestContext(req.Context(), entry)
+	} else {
+		LogOutboundContext(req.Context(), entry)
+	}
+}
+
+// outboundBody 统计实际读取的响应内容的字节数, 读到结尾, 出错或者关闭时写对外请求的日志
+type outboundBody struct {
+	io.ReadCloser
+	t     *transport
+	req   *http.Request
+	entry RequestEntry
+	start time.Time
+	size  int64
+	once  sync.Once
+}
+
+func (b *outboundBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.size, int64(n))
+	if err == io.EOF {
+		b.finish("")
+	} else if err != nil {
+		b.finish(err.Error())
+	}
+	return n, err
+}
+
+func (b *outboundBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish("")
+	return err
+}
+
+func (b *outboundBody) finish(readErr string) {
+	b.once.Do(func() {
+		b.entry.Latency = time.Since(b.start)
+		b.entry.BytesIn = atomic.LoadInt64(&b.size)
+		if readErr != "" {
+			b.entry.Extras[RequestKeyError] = readErr
+		}
+		b.t.log(b.req, b.entry)
+	})
+}
+
+// redactQuery 把名字匹配rules的查询参数的值替换为******, 保持参数原来的顺序
+func redactQuery(rawQuery string, rules []*redactRule) string {
+	if rawQuery == "" || len(rules) == 0 {
+		return rawQuery
+	}
+	pairs := strings.Split(rawQuery, "&")
+	for i, pair := range pairs {
+		key := pair
+		if j := strings.Index(pair, "="); j >= 0 {
+			key = pair[:j]
+		}
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		for _, rule := range rules {
+			if rule.matchKey(name) {
+				pairs[i] = key + "=" + fullMask
+				break
+			}
+		}
+	}
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,112 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// outboundEntries 返回Outbound日志中路径为path的请求
+func outboundEntries(t *testing.T, file, path string) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	for _, line := range readLines(t, file, `"path":"`+path+`"`) {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("%v: %s", err, line)
+		}
+		entries = append(entries, m)
+	}
+	return entries
+}
+
+func TestTransport(t *testing.T) {
+	dir := tempDir(t)
+	Init(filepath.Join(dir, "app.log"), InfoLevel, true, false, SetOutboundType("json"))
+	defer func() { logger.close(); logger = nil }()
+	file := filepath.Join(dir, "app.log.Outbound")
+	LogOutbound(RequestEntry{Path: "/created"})
+
+	var gotID string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotID = r.Header.Get(DefaultRequestIDHeader)
+		// 分块传输, 响应头之后过一段时间才写完内容
+		w.Write([]byte("first "))
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("second"))
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: Transport(nil)}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/chunked?access_token=abc&q=1", nil)
+	req = req.WithContext(ContextWithRequestID(context.Background(), "r-1"))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outboundEntries(t, file, "/chunked")) != 0 {
+		t.Fatal("entry written before the response body is read")
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "first second" || gotID != "r-1" {
+		t.Fatalf("body %q, request id %q", body, gotID)
+	}
+
+	entries := outboundEntries(t, file, "/chunked")
+	if len(entries) != 1 {
+		t.Fatalf("logged %d entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e[RequestKeyBytesIn] != 12.0 || e[RequestKeyStatus] != 200.0 || e[RequestKeyRequestID] != "r-1" {
+		t.Errorf("entry = %v", e)
+	}
+	if e[RequestKeyQuery] != "access_token="+fullMask+"&q=1" {
+		t.Errorf("query = %v", e[RequestKeyQuery])
+	}
+	if e[RequestKeyLatency].(float64) < 50 {
+		t.Errorf("latency %vms does not include reading the body", e[RequestKeyLatency])
+	}
+
+	// 没有读完就关闭时记录实际读取的字节数
+	resp, err = client.Get(srv.URL + "/closed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Read(make([]byte, 3))
+	resp.Body.Close()
+	if e := outboundEntries(t, file, "/closed"); len(e) != 1 || e[0][RequestKeyBytesIn] != 3.0 {
+		t.Errorf("entries = %v", e)
+	}
+
+	// 请求失败时立即记录错误
+	srv.Close()
+	if _, err := client.Get(srv.URL + "/failed"); err == nil {
+		t.Fatal("request to a closed server succeeded")
+	}
+	if e := outboundEntries(t, file, "/failed"); len(e) != 1 || e[0][RequestKeyError] == nil {
+		t.Errorf("entries = %v", e)
+	}
+}
+
+func TestRedactQuery(t *testing.T) {
+	rules := []*redactRule{newKeyRule("*token*", fullMask), newKeyRule("*key", fullMask)}
+	got := redactQuery("Access_Token=a&a%2Fkey=b&name=c&flag", rules)
+	// 与脱敏规则一样, 通配符可以匹配/
+	if want := "Access_Token=" + fullMask + "&a%2Fkey=" + fullMask + "&name=c&flag"; got != want {
+		t.Fatalf("redactQuery = %q, want %q", got, want)
+	}
+	if got := redactQuery("a=1", nil); got != "a=1" {
+		t.Fatalf("redactQuery without rules = %q", got)
+	}
+	if !strings.Contains(redactQuery("token=x", rules), fullMask) {
+		t.Fatal("key equal to the pattern without wildcards is not redacted")
+	}
+}